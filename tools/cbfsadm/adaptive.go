@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/couchbaselabs/cbfs/tools"
+)
+
+var restoreAdaptive = restoreFlags.Bool("adaptive", false,
+	"Start with a few workers and add more while the cluster keeps up, "+
+		"halving them when it doesn't (up to -adaptive-max per target)")
+var restoreAdaptiveMax = restoreFlags.Int("adaptive-max", 64,
+	"The most workers -adaptive runs per target")
+
+// How many workers -adaptive starts with, and how often it adjusts.
+const (
+	adaptiveStart    = 2
+	adaptiveInterval = time.Second
+)
+
+// A window's mean latency more than this many times the best seen
+// means the cluster is queueing requests rather than serving them.
+const adaptiveSlowdown = 2
+
+// Sizes a worker pool AIMD-style, as TCP does its window: one more
+// worker after each interval whose requests all went well, half as
+// many after one with temporary failures (5xx, timeouts, 429s) or a
+// slowdown.
+type adaptiveController struct {
+	pool *workerPool
+	max  int
+
+	mu       sync.Mutex
+	ok, bad  int
+	latency  time.Duration
+	baseline time.Duration
+}
+
+type adaptiveKey struct{}
+
+// Attach c to ctx, for restoreTimed to report to.
+func withAdaptive(ctx context.Context, c *adaptiveController) context.Context {
+	return context.WithValue(ctx, adaptiveKey{}, c)
+}
+
+// The controller of the worker handling ctx, nil if none.
+func adaptiveFor(ctx context.Context) *adaptiveController {
+	c, _ := ctx.Value(adaptiveKey{}).(*adaptiveController)
+	return c
+}
+
+// Record a request that took d and ended with err.  Files that
+// exist, and other permanent failures, say nothing about the
+// cluster's load.
+func (c *adaptiveController) observe(d time.Duration, err error) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case cbfstool.IsTemporary(err) || cbfstool.StatusCode(err) == 429:
+		c.bad++
+	case err == nil || err == errExists || err == errUnchanged:
+		c.ok++
+		c.latency += d
+	}
+}
+
+// Decide the pool's next size from its current one and the last
+// interval, and start the next interval.
+func (c *adaptiveController) next(n int) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ok, bad, latency := c.ok, c.bad, c.latency
+	c.ok, c.bad, c.latency = 0, 0, 0
+
+	if bad > 0 {
+		return n / 2
+	}
+	if ok == 0 {
+		return n
+	}
+	mean := latency / time.Duration(ok)
+	if c.baseline == 0 || mean < c.baseline {
+		c.baseline = mean
+	}
+	if mean > adaptiveSlowdown*c.baseline {
+		return n / 2
+	}
+	if n >= c.max {
+		return c.max
+	}
+	return n + 1
+}
+
+// Resize the pool every adaptiveInterval until stop is closed.
+func (c *adaptiveController) run(stop <-chan bool) {
+	t := time.NewTicker(adaptiveInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			n := c.pool.size()
+			if m := c.next(n); m != n {
+				mainLog.Infof("Now running %v workers", c.pool.resize(m))
+			}
+		case <-stop:
+			return
+		}
+	}
+}
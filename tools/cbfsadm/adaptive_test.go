@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/cbfs/tools"
+)
+
+func TestAdaptiveController(t *testing.T) {
+	c := &adaptiveController{max: 4}
+	ms := time.Millisecond
+	tempErr := cbfstool.TempError{Err: errors.New("503")}
+	tooMany := cbfstool.StatusError{Code: 429, Err: errors.New("429")}
+
+	steps := []struct {
+		latency []time.Duration
+		errs    []error
+		from    int
+		exp     int
+	}{
+		// Nothing happened, so there's nothing to go on.
+		{nil, nil, 2, 2},
+		{[]time.Duration{10 * ms, 10 * ms}, nil, 2, 3},
+		{[]time.Duration{15 * ms}, []error{errExists}, 3, 4},
+		{[]time.Duration{10 * ms}, nil, 4, 4},
+		// Permanent failures don't count against the cluster.
+		{nil, []error{errors.New("400")}, 4, 4},
+		{[]time.Duration{10 * ms}, []error{tempErr}, 4, 2},
+		{nil, []error{tooMany}, 2, 1},
+		{[]time.Duration{30 * ms}, nil, 4, 2},
+		{[]time.Duration{5 * ms}, nil, 2, 3},
+	}
+	for i, step := range steps {
+		for _, d := range step.latency {
+			c.observe(d, nil)
+		}
+		for _, err := range step.errs {
+			c.observe(time.Millisecond, err)
+		}
+		if got := c.next(step.from); got != step.exp {
+			t.Errorf("Expected %v workers from %v at step %v, got %v",
+				step.exp, step.from, i, got)
+		}
+	}
+	if c.baseline != 5*ms {
+		t.Errorf("Expected the fastest window kept as the baseline, got %v",
+			c.baseline)
+	}
+
+	var none *adaptiveController
+	none.observe(time.Second, tempErr)
+}
+
+func TestRestoreAdaptive(t *testing.T) {
+	var inflight, most int64
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			n := atomic.AddInt64(&inflight, 1)
+			defer atomic.AddInt64(&inflight, -1)
+			for {
+				m := atomic.LoadInt64(&most)
+				if n <= m || atomic.CompareAndSwapInt64(&most, m, n) {
+					break
+				}
+			}
+			time.Sleep(time.Millisecond)
+			w.WriteHeader(201)
+		}))
+	defer ts.Close()
+
+	paths := []string{}
+	for i := 0; i < 50; i++ {
+		paths = append(paths, fmt.Sprintf("f%v", i))
+	}
+	fn := writeTestBackup(t, paths...)
+	defer os.Remove(fn)
+
+	defer func(a bool, w int) {
+		*restoreAdaptive, *restoreWorkers = a, w
+	}(*restoreAdaptive, *restoreWorkers)
+	*restoreAdaptive, *restoreWorkers = true, 16
+
+	before := restoreConcurrency.Value()
+	stats, err := restore(context.Background(), context.Background(),
+		ts.URL, fn)
+	if err != nil || stats.Restored != 50 {
+		t.Fatalf("Expected all 50 restored, got %+v (%v)", stats, err)
+	}
+	if most > adaptiveStart {
+		t.Errorf("Expected at most %v requests at once to begin with, got %v",
+			adaptiveStart, most)
+	}
+	if n := restoreConcurrency.Value(); n != before {
+		t.Errorf("Expected the worker count back to %v, got %v", before, n)
+	}
+
+	defer func(m int) { *restoreAdaptiveMax = m }(*restoreAdaptiveMax)
+	*restoreAdaptiveMax = 0
+	if _, err := restore(context.Background(), context.Background(),
+		ts.URL, fn); err == nil {
+		t.Errorf("Expected -adaptive-max 0 refused")
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// A file written under a temporary name in the same directory, and
+// only moved into place by Commit.  Until then, however the process
+// ends, the file keeps whatever it had before (if anything), so a
+// report, checkpoint or deadletter file is never left half written.
+type atomicFile struct {
+	*os.File
+	fn string
+}
+
+func createAtomic(fn string) (*atomicFile, error) {
+	dir, base := filepath.Split(fn)
+	if dir == "" {
+		dir = "."
+	}
+	f, err := ioutil.TempFile(dir, "."+base+".tmp")
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return &atomicFile{f, fn}, nil
+}
+
+// Sync the file to disk and rename it into place.  On an error, the
+// temporary file is removed and the original left alone.
+func (f *atomicFile) Commit() error {
+	err := f.Sync()
+	if e := f.File.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), f.fn)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	// Make the rename itself durable where directories can be
+	// synced (not on Windows, say).
+	if d, err := os.Open(filepath.Dir(f.fn)); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// Give up on the new contents, leaving the original alone.
+func (f *atomicFile) Abort() {
+	f.File.Close()
+	os.Remove(f.Name())
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// The files in dir, to check no temporary file is left behind.
+func dirNames(t *testing.T, dir string) []string {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("Error reading %v: %v", dir, err)
+	}
+	var names []string
+	for _, fi := range fis {
+		names = append(names, fi.Name())
+	}
+	return names
+}
+
+func TestAtomicFile(t *testing.T) {
+	dir := t.TempDir()
+	fn := filepath.Join(dir, "state")
+	if err := ioutil.WriteFile(fn, []byte("old\n"), 0644); err != nil {
+		t.Fatalf("Error writing %v: %v", fn, err)
+	}
+	check := func(when, exp string) {
+		b, err := ioutil.ReadFile(fn)
+		if err != nil || string(b) != exp {
+			t.Errorf("Expected %q %v, got %q (%v)", exp, when, b, err)
+		}
+	}
+
+	f, err := createAtomic(fn)
+	if err != nil {
+		t.Fatalf("Error creating %v: %v", fn, err)
+	}
+	f.WriteString("new, half")
+	check("while writing", "old\n")
+	f.Abort()
+	check("after giving up", "old\n")
+
+	f, err = createAtomic(fn)
+	if err != nil {
+		t.Fatalf("Error creating %v: %v", fn, err)
+	}
+	f.WriteString("new\n")
+	if err := f.Commit(); err != nil {
+		t.Fatalf("Error committing: %v", err)
+	}
+	check("after committing", "new\n")
+	if names := dirNames(t, dir); fmt.Sprint(names) != "[state]" {
+		t.Errorf("Expected just the file left, got %v", names)
+	}
+
+	// An unencodable report leaves the last one alone.
+	if err := writeReport(fn, map[string]interface{}{"f": func() {}}); err == nil {
+		t.Errorf("Expected an error writing an unencodable report")
+	}
+	check("after a failed report", "new\n")
+	if names := dirNames(t, dir); fmt.Sprint(names) != "[state]" {
+		t.Errorf("Expected just the file left, got %v", names)
+	}
+}
+
+// Read a checkpoint over and over while it's saved, as a restore
+// killed at any moment would leave it: each read must be a whole
+// checkpoint, from one save or another.
+func TestCheckpointNeverPartial(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "checkpoint")
+	c, err := openCheckpoint(fn, false)
+	if err != nil {
+		t.Fatalf("Error opening checkpoint: %v", err)
+	}
+
+	const batch, saves = 50, 40
+	done := make(chan bool)
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			b, err := ioutil.ReadFile(fn)
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				t.Errorf("Error reading checkpoint: %v", err)
+				return
+			}
+			lines := strings.Split(string(b), "\n")
+			n := len(lines) - 1
+			if lines[n] != "" || n == 0 || n%batch != 0 {
+				t.Errorf("Read a partial checkpoint of %v bytes, %v lines",
+					len(b), n)
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < saves; i++ {
+		for j := 0; j < batch; j++ {
+			c.add(fmt.Sprintf("dir/%v/file-%v", i, j))
+		}
+		if err := c.save(); err != nil {
+			t.Fatalf("Error saving checkpoint: %v", err)
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	resumed, err := openCheckpoint(fn, true)
+	if err != nil || len(resumed.done) != batch*saves {
+		t.Errorf("Expected %v paths resumed, got %v (%v)",
+			batch*saves, len(resumed.done), err)
+	}
+}
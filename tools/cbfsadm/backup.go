@@ -2,17 +2,16 @@ package main
 
 import (
 	"flag"
-	"io"
+	"fmt"
 	"log"
-	"net/http"
 	"net/url"
-	"os"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/couchbaselabs/cbfs/config"
 	"github.com/couchbaselabs/cbfs/tools"
+	"github.com/dustin/httputil"
 )
 
 var backupFlags = flag.NewFlagSet("backup", flag.ExitOnError)
@@ -25,30 +24,43 @@ type Backup struct {
 	Conf     cbfsconfig.CBFSConfig
 }
 
-func backupCommand(ustr string, args []string) {
-	u := cbfstool.ParseURL(ustr)
-
-	fn := backupFlags.Arg(0)
+// Ask the cluster at ustr to back itself up to fn.  If wait is true,
+// this doesn't return until the backup is complete.
+func backup(ustr, fn string, wait bool) error {
+	u, err := url.Parse(ustr)
+	if err != nil {
+		return err
+	}
 
 	u.Path = "/.cbfs/backup/"
 
 	form := url.Values{
 		"fn": []string{fn},
-		"bg": []string{strconv.FormatBool(*backupWait == false)},
+		"bg": []string{strconv.FormatBool(wait == false)},
 	}
 
-	start := time.Now()
-	res, err := http.Post(u.String(),
+	res, err := headerClient.Post(u.String(),
 		"application/x-www-form-urlencoded",
 		strings.NewReader(form.Encode()))
-	cbfstool.MaybeFatal(err, "Error executing POST to %v - %v", u, err)
+	if err != nil {
+		return fmt.Errorf("Error executing POST to %v - %v", u, err)
+	}
 
 	defer res.Body.Close()
 	if !(res.StatusCode == 202 || res.StatusCode == 201) {
-		log.Printf("backup error: %v", res.Status)
-		io.Copy(os.Stderr, res.Body)
-		os.Exit(1)
+		return httputil.HTTPErrorf(res, "backup error: %S\n%B")
 	}
+	return nil
+}
+
+func backupCommand(ustr string, args []string) {
+	sendHeadersTo(ustr)
+
+	fn := backupFlags.Arg(0)
+
+	start := time.Now()
+	err := backup(ustr, fn, *backupWait)
+	cbfstool.MaybeFatal(err, "%v", err)
 
 	if *backupWait {
 		log.Printf("Completed backup to %v in %v", fn, time.Since(start))
@@ -7,13 +7,19 @@ import (
 func main() {
 	cbfstool.ToolMain(
 		map[string]cbfstool.Command{
-			"getconf": {0, getConfCommand, "", nil},
-			"setconf": {2, setConfCommand, "prop value", nil},
-			"fsck":    {0, fsckCommand, "", fsckFlags},
-			"backup":  {1, backupCommand, "filename", backupFlags},
-			"rmbak":   {0, rmBakCommand, "", rmbakFlags},
-			"restore": {1, restoreCommand, "filename", restoreFlags},
-			"induce":  {0, induceCommand, "taskname", induceFlags},
-			"lsbak":   {0, lsBakCommand, "", nil},
+			"getconf":     {0, getConfCommand, "", nil},
+			"setconf":     {2, setConfCommand, "prop value", nil},
+			"fsck":        {0, fsckCommand, "", fsckFlags},
+			"backup":      {1, backupCommand, "filename", backupFlags},
+			"export":      {1, exportCommand, "filename|-", exportFlags},
+			"rmbak":       {0, rmBakCommand, "", rmbakFlags},
+			"restore":     {1, restoreCommand, "filename|-|url", restoreFlags},
+			"induce":      {0, induceCommand, "taskname", induceFlags},
+			"lsbak":       {0, lsBakCommand, "", nil},
+			"list-backup": {1, listBackupCommand, "filename|-|url", listFlags},
+			"diff-backup": {2, diffBackupCommand, "old new", diffFlags},
+			"find":        {0, findCommand, "", findFlags},
+			"verify":      {1, verifyCommand, "filename|-|url", verifyFlags},
+			"stat":        {1, statCommand, "path", statFlags},
 		})
 }
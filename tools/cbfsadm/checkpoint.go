@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"sync"
+	"time"
+)
+
+const checkpointInterval = 10 * time.Second
+
+// The set of paths that have been successfully restored, periodically
+// written to disk so an interrupted restore can be resumed.
+//
+// All methods are safe to call on a nil checkpoint and do nothing.
+type checkpoint struct {
+	fn    string
+	mu    sync.Mutex
+	done  map[string]bool
+	dirty bool
+}
+
+// Create a checkpoint stored in fn.  If resume is true, previously
+// recorded paths are loaded from it.
+func openCheckpoint(fn string, resume bool) (*checkpoint, error) {
+	c := &checkpoint{fn: fn, done: map[string]bool{}}
+	if !resume {
+		return c, nil
+	}
+
+	f, err := os.Open(fn)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if s.Text() != "" {
+			c.done[s.Text()] = true
+		}
+	}
+	return c, s.Err()
+}
+
+func (c *checkpoint) has(path string) bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.done[path]
+}
+
+func (c *checkpoint) add(path string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.done[path] = true
+	c.dirty = true
+}
+
+// Write the checkpoint to a temporary file and move it into place so
+// a crash mid-write never leaves a truncated checkpoint behind.  It's
+// synced to disk first, so neither does a crash just after.
+func (c *checkpoint) save() error {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.dirty {
+		return nil
+	}
+
+	f, err := createAtomic(c.fn)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	for p := range c.done {
+		w.WriteString(p)
+		w.WriteByte('\n')
+	}
+	if err := w.Flush(); err != nil {
+		f.Abort()
+		return err
+	}
+
+	err = f.Commit()
+	if err == nil {
+		c.dirty = false
+	}
+	return err
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+var verifyCompareOnly = verifyFlags.Bool("compare-only", false,
+	"Print a one line summary for monitoring instead of each "+
+		"discrepancy, and exit 0 if the cluster matches the backup, 1 if "+
+		"files are missing, 2 if hashes differ or 3 if it couldn't tell")
+
+// verify -compare-only's exit statuses, which are also the Nagios
+// plugin statuses (OK, WARNING, CRITICAL and UNKNOWN).
+const (
+	compareIdentical = 0
+	compareMissing   = 1
+	compareMismatch  = 2
+	compareUnknown   = 3
+)
+
+var compareStatusNames = []string{"OK", "WARNING", "CRITICAL", "UNKNOWN"}
+
+// Which status wins when files differ in more than one way.
+var compareSeverity = map[int]int{
+	compareIdentical: 0,
+	compareMissing:   1,
+	compareUnknown:   2,
+	compareMismatch:  3,
+}
+
+// The exit status for a verify that returned rep and err, and a line
+// summing it up, with the counts as performance data.  Hash
+// mismatches win over files that couldn't be checked, which win over
+// missing (or drifted) files: a verify that couldn't check
+// everything can't say only files are missing.
+func compareSummary(rep *verifyReport, err error) (int, string) {
+	if err != nil {
+		return compareUnknown, fmt.Sprintf("CBFS %v - %v",
+			compareStatusNames[compareUnknown], err)
+	}
+
+	c := rep.Counts
+	hashes := c["mismatch"] + c["corrupt"]
+	status, msg := compareIdentical,
+		fmt.Sprintf("%v files match the backup", rep.Checked)
+	var problems []string
+	for _, p := range []struct {
+		n      int
+		what   string
+		status int
+	}{
+		{hashes, "with a different hash", compareMismatch},
+		{c["missing"], "missing", compareMissing},
+		{c["drift"], "drifted", compareMissing},
+		{c["error"], "unchecked", compareUnknown},
+	} {
+		if p.n == 0 {
+			continue
+		}
+		problems = append(problems, fmt.Sprintf("%v %v", p.n, p.what))
+		if compareSeverity[p.status] > compareSeverity[status] {
+			status = p.status
+		}
+	}
+	if len(problems) > 0 {
+		msg = fmt.Sprintf("%v files checked: %v", rep.Checked,
+			strings.Join(problems, ", "))
+	}
+	return status, fmt.Sprintf("CBFS %v - %v | checked=%v missing=%v "+
+		"mismatched=%v drifted=%v errors=%v",
+		compareStatusNames[status], msg, rep.Checked, c["missing"], hashes,
+		c["drift"], c["error"])
+}
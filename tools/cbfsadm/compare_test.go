@@ -0,0 +1,43 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCompareSummary(t *testing.T) {
+	tests := []struct {
+		counts map[string]int
+		err    error
+		status int
+		line   string
+	}{
+		{map[string]int{}, nil, 0, "CBFS OK - 10 files match the backup | " +
+			"checked=10 missing=0 mismatched=0 drifted=0 errors=0"},
+		{map[string]int{"missing": 2, "drift": 1}, nil, 1,
+			"CBFS WARNING - 10 files checked: 2 missing, 1 drifted | " +
+				"checked=10 missing=2 mismatched=0 drifted=1 errors=0"},
+		{map[string]int{"missing": 2, "mismatch": 1, "corrupt": 1}, nil, 2,
+			"CBFS CRITICAL - 10 files checked: 2 with a different hash, " +
+				"2 missing | checked=10 missing=2 mismatched=2 drifted=0 errors=0"},
+		{map[string]int{"missing": 2, "error": 1}, nil, 3,
+			"CBFS UNKNOWN - 10 files checked: 2 missing, 1 unchecked | " +
+				"checked=10 missing=2 mismatched=0 drifted=0 errors=1"},
+		{map[string]int{"mismatch": 1, "error": 1}, nil, 2,
+			"CBFS CRITICAL - 10 files checked: 1 with a different hash, " +
+				"1 unchecked | checked=10 missing=0 mismatched=1 drifted=0 errors=1"},
+		{nil, errors.New("Error finding backup files: nope"), 3,
+			"CBFS UNKNOWN - Error finding backup files: nope"},
+	}
+	for _, test := range tests {
+		var rep *verifyReport
+		if test.counts != nil {
+			rep = &verifyReport{Seen: 12, Checked: 10, Counts: test.counts}
+		}
+		status, line := compareSummary(rep, test.err)
+		if status != test.status || line != test.line {
+			t.Errorf("Expected %v %q for %v (%v), got %v %q", test.status,
+				test.line, test.counts, test.err, status, line)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/dustin/go-humanize"
+)
+
+var restoreDryRunCount = restoreFlags.Bool("dry-run-count", false,
+	"Only count the matching entries (and their bytes), without "+
+		"contacting the cluster")
+
+// Decode the backup fn, counting the entries that would be restored,
+// and write the totals to w.
+func countBackup(w io.Writer, fn string) (*restoreStats, error) {
+	matches, err := restoreMatcher()
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing match pattern: %v", err)
+	}
+	key, err := loadBackupKey(*restoreKeyfile)
+	if err != nil {
+		return nil, fmt.Errorf("Error loading backup key: %v", err)
+	}
+	segs, err := backupSegments(fn)
+	if err != nil {
+		return nil, fmt.Errorf("Error finding backup files: %v", err)
+	}
+
+	// Malformed records are counted, but not saved.
+	restoreQuarantine = nil
+	if *restoreContinue {
+		restoreQuarantine = &quarantine{}
+	}
+
+	stats, err := scanBackup(segs, key, newResumePoint().wrap(matches))
+	if err != nil {
+		return stats, err
+	}
+
+	fmt.Fprintf(w, "%v of %v entries match", humanize.Comma(stats.Matched),
+		humanize.Comma(stats.Seen))
+	switch {
+	case stats.Matched == 0:
+	case stats.UnknownSize == 0:
+		fmt.Fprintf(w, ", %v", humanize.Bytes(uint64(stats.Bytes)))
+	case stats.UnknownSize < stats.Matched:
+		fmt.Fprintf(w, ", %v in the %v with a recorded length",
+			humanize.Bytes(uint64(stats.Bytes)),
+			humanize.Comma(stats.Matched-stats.UnknownSize))
+	}
+	if stats.Quarantined > 0 {
+		fmt.Fprintf(w, " (%v malformed)", stats.Quarantined)
+	}
+	_, err = fmt.Fprintln(w)
+	return stats, err
+}
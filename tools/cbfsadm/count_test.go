@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestDryRunCount(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "backup.json")
+	backup := `{"path": "a/1", "meta": {"oid": "1", "length": 1000}}
+{"path": "a/2", "meta": {"oid": "2", "length": 2000}}
+{"path": "a/3", "meta": {"oid": "3"}}
+{"path": "b/1", "meta": {"oid": "4", "length": 4000}}
+`
+	if err := ioutil.WriteFile(fn, []byte(backup), 0644); err != nil {
+		t.Fatalf("Error writing backup: %v", err)
+	}
+
+	defer func(p string) { *restorePat = p }(*restorePat)
+	tests := []struct {
+		pat string
+		exp string
+	}{
+		{"^a/[12]", "2 of 4 entries match, 3.0 kB\n"},
+		{"^a/", "3 of 4 entries match, 3.0 kB in the 2 with a recorded length\n"},
+		{"^a/3", "1 of 4 entries match\n"},
+		{"^c/", "0 of 4 entries match\n"},
+	}
+	for _, test := range tests {
+		*restorePat = test.pat
+		buf := &bytes.Buffer{}
+		if _, err := countBackup(buf, fn); err != nil {
+			t.Fatalf("Error counting %v: %v", test.pat, err)
+		}
+		if buf.String() != test.exp {
+			t.Errorf("For %v, expected %q, got %q", test.pat, test.exp, buf)
+		}
+	}
+}
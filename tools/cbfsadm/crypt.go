@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Encrypted backups start with encMagic, a version byte and a random
+// nonce.  The (already compressed) backup follows as a series of
+// AES-GCM sealed chunks, each preceded by its big-endian uint32
+// length.  A chunk's nonce is the header nonce with the chunk number
+// XORed into its last eight bytes, and the final chunk is sealed with
+// different additional data so truncation is detected.
+var encMagic = []byte("CBFE")
+
+const (
+	encVersion   = 1
+	encChunkSize = 64 * 1024
+)
+
+var (
+	encMiddle = []byte{0}
+	encFinal  = []byte{1}
+)
+
+var errEncrypted = errors.New(
+	"backup is encrypted; use -keyfile or set CBFS_BACKUP_KEY")
+
+// Load the backup encryption key from keyfile, or from the
+// CBFS_BACKUP_KEY environment variable if keyfile is empty.  Either
+// way the key is hex encoded (as from openssl rand -hex 32), with any
+// surrounding whitespace ignored, and must decode to 16, 24 or 32
+// bytes.  Returns nil if no key was configured.
+func loadBackupKey(keyfile string) ([]byte, error) {
+	var text string
+	if keyfile != "" {
+		b, err := ioutil.ReadFile(keyfile)
+		if err != nil {
+			return nil, err
+		}
+		text = string(b)
+	} else if env := os.Getenv("CBFS_BACKUP_KEY"); env != "" {
+		text = env
+	} else {
+		return nil, nil
+	}
+
+	key, err := hex.DecodeString(strings.TrimSpace(text))
+	if err != nil {
+		return nil, fmt.Errorf("backup key must be hex encoded: %v", err)
+	}
+	switch len(key) {
+	case 16, 24, 32:
+		return key, nil
+	}
+	return nil, fmt.Errorf("backup key must be 16, 24 or 32 bytes "+
+		"(32, 48 or 64 hex digits), not %v", len(key))
+}
+
+func chunkNonce(base []byte, n uint64) []byte {
+	nonce := append([]byte{}, base...)
+	off := len(nonce) - 8
+	binary.BigEndian.PutUint64(nonce[off:],
+		binary.BigEndian.Uint64(nonce[off:])^n)
+	return nonce
+}
+
+type encryptWriter struct {
+	w     io.Writer
+	aead  cipher.AEAD
+	nonce []byte
+	buf   []byte
+	n     uint64
+}
+
+// Encrypt everything written to the returned writer onto w.  Close
+// must be called to write the final chunk; it doesn't close w.
+func newEncrypter(w io.Writer, key []byte) (io.WriteCloser, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	hdr := append(append([]byte{}, encMagic...), encVersion)
+	if _, err := w.Write(append(hdr, nonce...)); err != nil {
+		return nil, err
+	}
+
+	return &encryptWriter{w: w, aead: aead, nonce: nonce,
+		buf: make([]byte, 0, encChunkSize)}, nil
+}
+
+func (e *encryptWriter) seal(ad []byte) error {
+	ct := e.aead.Seal(nil, chunkNonce(e.nonce, e.n), e.buf, ad)
+	e.n++
+	e.buf = e.buf[:0]
+
+	l := make([]byte, 4)
+	binary.BigEndian.PutUint32(l, uint32(len(ct)))
+	if _, err := e.w.Write(l); err != nil {
+		return err
+	}
+	_, err := e.w.Write(ct)
+	return err
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// Keep a full buffer around until more data shows up so
+		// the last chunk can always be sealed as final.
+		if len(e.buf) == encChunkSize {
+			if err := e.seal(encMiddle); err != nil {
+				return written, err
+			}
+		}
+		n := copy(e.buf[len(e.buf):encChunkSize], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (e *encryptWriter) Close() error {
+	return e.seal(encFinal)
+}
+
+type decryptReader struct {
+	r     io.Reader
+	aead  cipher.AEAD
+	nonce []byte
+	n     uint64
+	buf   []byte
+	next  []byte
+	final bool
+}
+
+// If r holds an encrypted backup, return a reader decrypting it with
+// key.  Otherwise r's contents are returned as they are.
+func decrypt(r io.Reader, key []byte) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(encMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if !bytes.Equal(magic, encMagic) {
+		return br, nil
+	}
+	if key == nil {
+		return nil, errEncrypted
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	hdr := make([]byte, len(encMagic)+1+aead.NonceSize())
+	if _, err := io.ReadFull(br, hdr); err != nil {
+		return nil, err
+	}
+	if v := hdr[len(encMagic)]; v != encVersion {
+		return nil, fmt.Errorf("unsupported encrypted backup version %v", v)
+	}
+
+	d := &decryptReader{r: br, aead: aead, nonce: hdr[len(encMagic)+1:]}
+	d.next, err = d.readChunk()
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *decryptReader) readChunk() ([]byte, error) {
+	l := make([]byte, 4)
+	if _, err := io.ReadFull(d.r, l); err != nil {
+		if err == io.EOF {
+			return nil, nil
+		}
+		return nil, err
+	}
+	// Check the length before trusting it with an allocation: no
+	// chunk is sealed from more than encChunkSize bytes.
+	n := binary.BigEndian.Uint32(l)
+	if max := encChunkSize + d.aead.Overhead(); n > uint32(max) {
+		return nil, fmt.Errorf("invalid encrypted backup: %v byte chunk, "+
+			"over the %v maximum", n, max)
+	}
+	ct := make([]byte, n)
+	if _, err := io.ReadFull(d.r, ct); err != nil {
+		return nil, err
+	}
+	return ct, nil
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		if d.final {
+			return 0, io.EOF
+		}
+		if d.next == nil {
+			return 0, io.ErrUnexpectedEOF
+		}
+
+		ct := d.next
+		next, err := d.readChunk()
+		if err != nil {
+			return 0, err
+		}
+		ad := encMiddle
+		if next == nil {
+			ad = encFinal
+		}
+		d.buf, err = d.aead.Open(nil, chunkNonce(d.nonce, d.n), ct, ad)
+		if err != nil {
+			return 0, fmt.Errorf("error decrypting backup: %v", err)
+		}
+		d.n++
+		d.next = next
+		d.final = next == nil
+	}
+
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var testKey = []byte("0123456789abcdef0123456789abcdef")
+
+func encryptTest(t *testing.T, data []byte) []byte {
+	buf := &bytes.Buffer{}
+	w, err := newEncrypter(buf, testKey)
+	if err != nil {
+		t.Fatalf("Error creating encrypter: %v", err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatalf("Error encrypting: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Error closing encrypter: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	for _, size := range []int{0, 1, encChunkSize, encChunkSize*3 + 17} {
+		data := bytes.Repeat([]byte{'x'}, size)
+		enc := encryptTest(t, data)
+		if bytes.Contains(enc, []byte("xxxx")) {
+			t.Errorf("Plaintext visible in encrypted output of %v bytes", size)
+		}
+
+		r, err := decrypt(bytes.NewReader(enc), testKey)
+		if err != nil {
+			t.Fatalf("Error setting up decryption: %v", err)
+		}
+		got, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("Error decrypting %v bytes: %v", size, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("Round trip of %v bytes produced %v bytes",
+				size, len(got))
+		}
+	}
+}
+
+func TestDecryptDamaged(t *testing.T) {
+	enc := encryptTest(t, bytes.Repeat([]byte{'x'}, encChunkSize*2+5))
+
+	// Truncated at the end of the first chunk.
+	truncated := enc[:len(encMagic)+1+12+4+encChunkSize+16]
+	corrupt := append([]byte{}, enc...)
+	corrupt[len(corrupt)-1] ^= 1
+
+	for name, in := range map[string][]byte{
+		"truncated": truncated,
+		"corrupt":   corrupt,
+	} {
+		r, err := decrypt(bytes.NewReader(in), testKey)
+		if err == nil {
+			_, err = ioutil.ReadAll(r)
+		}
+		if err == nil {
+			t.Errorf("Expected error decrypting %v backup", name)
+		}
+	}
+
+	if _, err := decrypt(bytes.NewReader(enc), nil); err != errEncrypted {
+		t.Errorf("Expected errEncrypted without a key, got %v", err)
+	}
+}
+
+func TestDecryptPlain(t *testing.T) {
+	r, err := decrypt(strings.NewReader(`{"path": "x"}`), testKey)
+	if err != nil {
+		t.Fatalf("Error reading plain backup: %v", err)
+	}
+	got, _ := ioutil.ReadAll(r)
+	if string(got) != `{"path": "x"}` {
+		t.Errorf("Plain backup was altered: %q", got)
+	}
+}
+
+// A chunk length no encrypter writes is refused before it's allocated.
+func TestDecryptHugeChunk(t *testing.T) {
+	in := append(append([]byte{}, encMagic...), encVersion)
+	in = append(in, make([]byte, 12)...)
+	in = append(in, 0xff, 0xff, 0xff, 0xff)
+	_, err := decrypt(bytes.NewReader(in), testKey)
+	if err == nil || !strings.Contains(err.Error(), "byte chunk") {
+		t.Errorf("Expected a huge chunk refused, got %v", err)
+	}
+}
+
+func TestLoadBackupKey(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		content string
+		len     int
+		err     string
+	}{
+		{"000102030405060708090a0b0c0d0e0f\n", 16, ""},
+		{"  " + strings.Repeat("ab", 32) + "\r\n", 32, ""},
+		// Hex digits only, but meant raw: still read as hex.
+		{"0123456789abcdef0123456789abcdef", 16, ""},
+		{"not hex at all, even if 32 bytes", 0, "must be hex encoded"},
+		{strings.Repeat("ab", 20), 0, "not 20"},
+	}
+	for i, test := range tests {
+		fn := filepath.Join(dir, fmt.Sprintf("key%v", i))
+		if err := ioutil.WriteFile(fn, []byte(test.content), 0600); err != nil {
+			t.Fatalf("Error writing %v: %v", fn, err)
+		}
+		key, err := loadBackupKey(fn)
+		switch {
+		case test.err != "":
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("Expected %q loading %q, got %v", test.err,
+					test.content, err)
+			}
+		case err != nil || len(key) != test.len:
+			t.Errorf("Expected a %v byte key from %q, got %v (%v)",
+				test.len, test.content, len(key), err)
+		}
+	}
+
+	defer os.Setenv("CBFS_BACKUP_KEY", os.Getenv("CBFS_BACKUP_KEY"))
+	os.Setenv("CBFS_BACKUP_KEY", strings.Repeat("0f", 24))
+	if key, err := loadBackupKey(""); err != nil || len(key) != 24 {
+		t.Errorf("Expected a 24 byte key from the environment, got %v (%v)",
+			len(key), err)
+	}
+	os.Setenv("CBFS_BACKUP_KEY", "")
+	if key, err := loadBackupKey(""); err != nil || key != nil {
+		t.Errorf("Expected no key, got %v (%v)", key, err)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+)
+
+var restoreDeadletter = restoreFlags.String("deadletter", "",
+	"Write the backup entries of files that failed to restore to this "+
+		"file, which can be restored from in turn")
+
+// The entries of files that failed to restore (after any retries),
+// written as newline-delimited {"path": ..., "meta": ...} objects, a
+// backup restore reads like any other.  Each path is written once,
+// however many targets it failed on.  Only collectResults writes to
+// it.  The file only appears, complete, once it's closed.
+//
+// All methods are safe to call on a nil deadletter, which writes
+// nothing.
+type deadletter struct {
+	f    *atomicFile
+	w    *bufio.Writer
+	e    *json.Encoder
+	seen map[string]bool
+	// The first error writing, reported by Close.
+	err error
+}
+
+// Create the -deadletter file, or return nil if there isn't one.
+func createDeadletter(fn string) (*deadletter, error) {
+	if fn == "" {
+		return nil, nil
+	}
+	f, err := createAtomic(fn)
+	if err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriter(f)
+	return &deadletter{f: f, w: w, e: json.NewEncoder(w),
+		seen: map[string]bool{}}, nil
+}
+
+// Record the backed up entry of a file that failed.
+func (d *deadletter) add(path string, meta *json.RawMessage) {
+	if d == nil || d.err != nil || d.seen[path] {
+		return
+	}
+	d.seen[path] = true
+	d.err = d.e.Encode(restoreWorkItem{Path: path, Meta: meta})
+}
+
+// Flush the file and move it into place, returning the first error
+// writing it.
+func (d *deadletter) Close() error {
+	if d == nil {
+		return nil
+	}
+	err := d.err
+	if err == nil {
+		err = d.w.Flush()
+	}
+	if err != nil {
+		d.f.Abort()
+		return err
+	}
+	return d.f.Commit()
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// The failures written to -deadletter can be restored from once the
+// cluster recovers.
+func TestRestoreDeadletter(t *testing.T) {
+	mu := sync.Mutex{}
+	broken := true
+	restored := []string{}
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			p := strings.TrimPrefix(req.URL.Path, "/.cbfs/backup/restore/")
+			if broken && (p == "b" || p == "d") {
+				http.Error(w, "no", 400)
+				return
+			}
+			restored = append(restored, p)
+			w.WriteHeader(201)
+		}))
+	defer ts.Close()
+
+	fn := writeTestBackup(t, "a", "b", "c", "d")
+	defer os.Remove(fn)
+	dead := filepath.Join(t.TempDir(), "dead.json")
+
+	defer func(d string) { *restoreDeadletter = d }(*restoreDeadletter)
+	*restoreDeadletter = dead
+
+	stats, err := restore(context.Background(), context.Background(),
+		ts.URL, fn)
+	if err != nil || stats.Failed != 2 {
+		t.Fatalf("Expected 2 failures, got %+v (%v)", *stats, err)
+	}
+	b, err := ioutil.ReadFile(dead)
+	if err != nil {
+		t.Fatalf("Error reading deadletter file: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	sort.Strings(lines)
+	exp := []string{
+		`{"path":"b","meta":{"oid":"abc"}}`,
+		`{"path":"d","meta":{"oid":"abc"}}`,
+	}
+	if !reflect.DeepEqual(lines, exp) {
+		t.Errorf("Expected deadletter entries %q, got %q", exp, lines)
+	}
+
+	broken, restored = false, nil
+	*restoreDeadletter = filepath.Join(t.TempDir(), "again.json")
+	stats, err = restore(context.Background(), context.Background(),
+		ts.URL, dead)
+	sort.Strings(restored)
+	if err != nil || !reflect.DeepEqual(restored, []string{"b", "d"}) {
+		t.Errorf("Expected b and d restored from the deadletter file, "+
+			"got %v (%v)", restored, err)
+	}
+	if b, err := ioutil.ReadFile(*restoreDeadletter); err != nil || len(b) != 0 {
+		t.Errorf("Expected an empty deadletter file, got %q (%v)", b, err)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"expvar"
+	"net"
+	"net/http"
+	_ "net/http/pprof"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var restoreDebugAddr = restoreFlags.String("debug-addr", "",
+	"Serve expvar, pprof and /metrics on this address (a bare :port binds localhost)")
+
+var (
+	restoreInflight = &expvar.Int{}
+	// Workers in every pool, which -adaptive and signals change.
+	restoreConcurrency = &expvar.Int{}
+
+	restoreVars = expvar.NewMap("restore")
+)
+
+func init() {
+	restoreVars.Set("inflight", restoreInflight)
+	restoreVars.Set("workers", restoreConcurrency)
+}
+
+// Publish the counters of the restore tracked by stats, to expvar and
+// /metrics.
+func publishStats(stats *restoreStats, start time.Time) {
+	counter := func(p *int64) expvar.Func {
+		return func() interface{} { return atomic.LoadInt64(p) }
+	}
+	metricsMu.Lock()
+	metricsStats = stats
+	metricsMu.Unlock()
+
+	restoreVars.Set("seen", counter(&stats.Seen))
+	restoreVars.Set("restored", counter(&stats.Restored))
+	restoreVars.Set("unchanged", counter(&stats.Unchanged))
+	restoreVars.Set("skipped", counter(&stats.Skipped))
+	restoreVars.Set("failed", counter(&stats.Failed))
+	restoreVars.Set("bytes", counter(&stats.RestoredBytes))
+	restoreVars.Set("decode_ns", counter(&stats.DecodeNanos))
+	restoreVars.Set("blocked_ns", counter(&stats.BlockedNanos))
+	restoreVars.Set("rate", expvar.Func(func() interface{} {
+		done := atomic.LoadInt64(&stats.Restored) +
+			atomic.LoadInt64(&stats.Unchanged) +
+			atomic.LoadInt64(&stats.Skipped) +
+			atomic.LoadInt64(&stats.Failed)
+		return float64(done) / time.Since(start).Seconds()
+	}))
+}
+
+// Serve /debug/vars, /debug/pprof/ and /metrics on addr in the
+// background.
+func serveDebug(addr string) error {
+	if strings.HasPrefix(addr, ":") {
+		addr = "localhost" + addr
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mainLog.Noticef("Serving debug info on http://%v/debug/", l.Addr())
+	go http.Serve(l, nil)
+	return nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+var restoreDedupLatest = restoreFlags.Bool("dedup-latest", false,
+	"Only restore the newest entry for paths backed up more than once "+
+		"(holds every entry in memory until the backup is read)")
+
+// True if b is a newer version of a file than a: a higher revision or,
+// failing that, a later modification time.  Equal versions count as
+// newer, so the last one read wins.
+func newerEntry(a, b restoreWorkItem) bool {
+	am, aerr := parseMeta(a.Meta)
+	bm, berr := parseMeta(b.Meta)
+	switch {
+	case aerr != nil || berr != nil:
+		return berr == nil
+	case am.Revno != bm.Revno:
+		return bm.Revno > am.Revno
+	}
+	return !bm.Modified.Before(am.Modified)
+}
+
+// Read items from in until it's closed, then send out the newest
+// entry for each path, in the order the paths first appeared.  The
+// entries passed over are counted as skipped.
+func dedupLatest(ctx context.Context, in <-chan restoreWorkItem,
+	out chan<- restoreWorkItem, stats *restoreStats) {
+
+	var order []string
+	latest := map[string]restoreWorkItem{}
+	for ob := range in {
+		prev, seen := latest[ob.Path]
+		if !seen {
+			order = append(order, ob.Path)
+		} else if !newerEntry(prev, ob) {
+			prev, ob = ob, prev
+		}
+		latest[ob.Path] = ob
+		if seen {
+			atomic.AddInt64(&stats.Skipped, 1)
+			if prev.size > 0 {
+				atomic.AddInt64(&stats.DoneBytes, prev.size)
+			}
+		}
+	}
+
+	for _, p := range order {
+		select {
+		case out <- latest[p]:
+		case <-ctx.Done():
+			return
+		}
+		delete(latest, p)
+	}
+}
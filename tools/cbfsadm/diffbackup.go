@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/couchbaselabs/cbfs/tools"
+)
+
+var diffFlags = flag.NewFlagSet("diff-backup", flag.ExitOnError)
+var diffPat = diffFlags.String("match", ".*", "Regex for paths to compare")
+var diffExclude = diffFlags.String("exclude", "",
+	"Regex for paths to skip (wins over -match)")
+var diffVerbose = diffFlags.Bool("v", false, "List each changed path")
+var diffJSON = diffFlags.Bool("json", false,
+	"Write changes and the summary as JSON, one object per line")
+var diffKeyfile = diffFlags.String("keyfile", "",
+	"Key for encrypted backups (default $CBFS_BACKUP_KEY)")
+
+// A file's version, as far as diff-backup compares them.
+type backupVersion struct {
+	OID   string `json:"oid"`
+	Revno int    `json:"revno"`
+}
+
+func entryVersion(ob restoreWorkItem) backupVersion {
+	fm, _ := parseMeta(ob.Meta)
+	return backupVersion{fm.OID, fm.Revno}
+}
+
+// A path that differs between two backups.  Old is nil for an added
+// path, New for a removed one.
+type backupChange struct {
+	Change string         `json:"change"`
+	Path   string         `json:"path"`
+	Old    *backupVersion `json:"old,omitempty"`
+	New    *backupVersion `json:"new,omitempty"`
+}
+
+type diffSummary struct {
+	Added     int `json:"added"`
+	Removed   int `json:"removed"`
+	Modified  int `json:"modified"`
+	Unchanged int `json:"unchanged"`
+}
+
+// Reads a backup's entries, checking they're sorted by path.
+type sortedBackup struct {
+	name string
+	ch   <-chan restoreWorkItem
+	cur  *restoreWorkItem
+	last string
+}
+
+// Move to the next entry, leaving cur nil at the end.
+func (b *sortedBackup) next() error {
+	ob, ok := <-b.ch
+	if !ok {
+		b.cur = nil
+		return nil
+	}
+	if b.cur != nil && ob.Path <= b.last {
+		return fmt.Errorf("%v is not sorted by path (%v after %v); "+
+			"export it without -sorted=false", b.name, ob.Path, b.last)
+	}
+	b.cur, b.last = &ob, ob.Path
+	return nil
+}
+
+// Compare two path-sorted streams of backup entries in a single pass,
+// calling report for each path that was added, removed or modified
+// (where its hash or revision changed).
+func diffBackups(oldName string, older <-chan restoreWorkItem,
+	newName string, newer <-chan restoreWorkItem,
+	report func(backupChange) error) (diffSummary, error) {
+
+	sum := diffSummary{}
+	a := &sortedBackup{name: oldName, ch: older}
+	b := &sortedBackup{name: newName, ch: newer}
+	if err := a.next(); err != nil {
+		return sum, err
+	}
+	if err := b.next(); err != nil {
+		return sum, err
+	}
+
+	for a.cur != nil || b.cur != nil {
+		var c backupChange
+		var err error
+		switch {
+		case b.cur == nil || (a.cur != nil && a.cur.Path < b.cur.Path):
+			v := entryVersion(*a.cur)
+			c = backupChange{Change: "removed", Path: a.cur.Path, Old: &v}
+			sum.Removed++
+			err = a.next()
+		case a.cur == nil || b.cur.Path < a.cur.Path:
+			v := entryVersion(*b.cur)
+			c = backupChange{Change: "added", Path: b.cur.Path, New: &v}
+			sum.Added++
+			err = b.next()
+		default:
+			ov, nv := entryVersion(*a.cur), entryVersion(*b.cur)
+			if ov != nv {
+				c = backupChange{Change: "modified", Path: a.cur.Path,
+					Old: &ov, New: &nv}
+				sum.Modified++
+			} else {
+				sum.Unchanged++
+			}
+			if err = a.next(); err == nil {
+				err = b.next()
+			}
+		}
+		if err != nil {
+			return sum, err
+		}
+		if c.Change != "" {
+			if err := report(c); err != nil {
+				return sum, err
+			}
+		}
+	}
+	return sum, nil
+}
+
+// Describe a change as a line of text.
+func (c backupChange) String() string {
+	switch c.Change {
+	case "added":
+		return fmt.Sprintf("A  %v", c.Path)
+	case "removed":
+		return fmt.Sprintf("D  %v", c.Path)
+	}
+	return fmt.Sprintf("M  %v (revision %v -> %v, hash %v -> %v)", c.Path,
+		c.Old.Revno, c.New.Revno, c.Old.OID, c.New.OID)
+}
+
+// Compare the backups oldFn and newFn, writing the changed paths (if
+// verbose) and a summary to w.
+func diffBackupFiles(oldFn, newFn string, key []byte,
+	matches func(string) bool, w io.Writer, verbose, asJSON bool) error {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	older, olderErr := streamBackup(ctx, oldFn, key, matches)
+	newer, newerErr := streamBackup(ctx, newFn, key, matches)
+
+	enc := json.NewEncoder(w)
+	sum, err := diffBackups(oldFn, older, newFn, newer,
+		func(c backupChange) error {
+			switch {
+			case !verbose:
+				return nil
+			case asJSON:
+				return enc.Encode(c)
+			}
+			_, err := fmt.Fprintln(w, c)
+			return err
+		})
+
+	// A backup that couldn't be read ends its stream early, so its
+	// error explains the diff.  After a diff error, the readers are
+	// just stopped.
+	cancel()
+	for range older {
+	}
+	for range newer {
+	}
+	for _, errc := range []<-chan error{olderErr, newerErr} {
+		if rerr := <-errc; err == nil {
+			err = rerr
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if asJSON {
+		return enc.Encode(sum)
+	}
+	_, err = fmt.Fprintf(w, "%v added, %v removed, %v modified, "+
+		"%v unchanged\n", sum.Added, sum.Removed, sum.Modified, sum.Unchanged)
+	return err
+}
+
+func diffBackupCommand(ustr string, args []string) {
+	matches, err := newMatcher(*diffPat, *diffExclude)
+	cbfstool.MaybeFatal(err, "Error parsing match pattern: %v", err)
+
+	key, err := loadBackupKey(*diffKeyfile)
+	cbfstool.MaybeFatal(err, "Error loading backup key: %v", err)
+
+	w := bufio.NewWriter(os.Stdout)
+	err = diffBackupFiles(diffFlags.Arg(0), diffFlags.Arg(1), key, matches,
+		w, *diffVerbose, *diffJSON)
+	if err == nil {
+		err = w.Flush()
+	}
+	cbfstool.MaybeFatal(err, "Error comparing backups: %v", err)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeJSONBackup(t *testing.T, name string, lines ...string) string {
+	fn := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(fn, []byte(strings.Join(lines, "\n")), 0644); err != nil {
+		t.Fatalf("Error writing %v: %v", fn, err)
+	}
+	return fn
+}
+
+func TestDiffBackup(t *testing.T) {
+	old := writeJSONBackup(t, "old.json",
+		`{"path": "a", "meta": {"oid": "a1", "revno": 1}}`,
+		`{"path": "b", "meta": {"oid": "b1", "revno": 1}}`,
+		`{"path": "c", "meta": {"oid": "c1", "revno": 1}}`,
+		`{"path": "d", "meta": {"oid": "d1", "revno": 1}}`)
+	new := writeJSONBackup(t, "new.json",
+		`{"path": "a", "meta": {"oid": "a1", "revno": 1}}`,
+		`{"path": "b", "meta": {"oid": "b2", "revno": 2}}`,
+		`{"path": "bb", "meta": {"oid": "x", "revno": 0}}`,
+		`{"path": "d", "meta": {"oid": "d1", "revno": 3}}`,
+		`{"path": "e", "meta": {"oid": "e1", "revno": 0}}`)
+	all, _ := newMatcher(".*", "")
+
+	tests := []struct {
+		verbose, json bool
+		exp           string
+	}{
+		{false, false, "2 added, 1 removed, 2 modified, 1 unchanged\n"},
+		{true, false, "M  b (revision 1 -> 2, hash b1 -> b2)\n" +
+			"A  bb\n" +
+			"D  c\n" +
+			"M  d (revision 1 -> 3, hash d1 -> d1)\n" +
+			"A  e\n" +
+			"2 added, 1 removed, 2 modified, 1 unchanged\n"},
+		{false, true,
+			`{"added":2,"removed":1,"modified":2,"unchanged":1}` + "\n"},
+		{true, true,
+			`{"change":"modified","path":"b","old":{"oid":"b1","revno":1},"new":{"oid":"b2","revno":2}}` + "\n" +
+				`{"change":"added","path":"bb","new":{"oid":"x","revno":0}}` + "\n" +
+				`{"change":"removed","path":"c","old":{"oid":"c1","revno":1}}` + "\n" +
+				`{"change":"modified","path":"d","old":{"oid":"d1","revno":1},"new":{"oid":"d1","revno":3}}` + "\n" +
+				`{"change":"added","path":"e","new":{"oid":"e1","revno":0}}` + "\n" +
+				`{"added":2,"removed":1,"modified":2,"unchanged":1}` + "\n"},
+	}
+	for _, test := range tests {
+		buf := &bytes.Buffer{}
+		err := diffBackupFiles(old, new, nil, all, buf, test.verbose, test.json)
+		if err != nil {
+			t.Fatalf("Error comparing backups: %v", err)
+		}
+		if buf.String() != test.exp {
+			t.Errorf("Expected with -v=%v -json=%v:\n%v\ngot:\n%v",
+				test.verbose, test.json, test.exp, buf.String())
+		}
+	}
+
+	onlyB, _ := newMatcher("^b", "")
+	buf := &bytes.Buffer{}
+	if err := diffBackupFiles(old, new, nil, onlyB, buf, false, false); err != nil ||
+		buf.String() != "1 added, 0 removed, 1 modified, 0 unchanged\n" {
+		t.Errorf("Expected -match to limit the comparison, got %q (%v)",
+			buf.String(), err)
+	}
+}
+
+func TestDiffBackupErrors(t *testing.T) {
+	good := writeJSONBackup(t, "good.json", `{"path": "a", "meta": {}}`)
+	unsorted := writeJSONBackup(t, "unsorted.json",
+		`{"path": "b", "meta": {}}`, `{"path": "a", "meta": {}}`)
+	truncated := writeJSONBackup(t, "truncated.json",
+		`{"path": "a", "meta": {}}`, `{"path": "b", "me`)
+	all, _ := newMatcher(".*", "")
+
+	tests := []struct {
+		old, new string
+		exp      string
+	}{
+		{good, unsorted, "unsorted.json is not sorted by path (a after b)"},
+		{unsorted, good, "unsorted.json is not sorted by path"},
+		{good, truncated, "truncated.json"},
+		{good, good + ".missing", "no such file"},
+	}
+	for _, test := range tests {
+		err := diffBackupFiles(test.old, test.new, nil, all, &bytes.Buffer{},
+			false, false)
+		if err == nil || !strings.Contains(err.Error(), test.exp) {
+			t.Errorf("Expected %q comparing %v and %v, got %v",
+				test.exp, test.old, test.new, err)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+var restoreWarnDupes = restoreFlags.Bool("warn-dupes", false,
+	"Warn the first time a path appears again in the backup "+
+		"(remembers every path read)")
+
+// A path's first revision in the backup (-1 if unknown), and whether
+// it's been warned about.
+type dupeEntry struct {
+	revno  int
+	warned bool
+}
+
+// The revision recorded in an entry, for logging.
+func entryRevision(ob restoreWorkItem) int {
+	fm, err := parseMeta(ob.Meta)
+	if err != nil {
+		return -1
+	}
+	return fm.Revno
+}
+
+func describeRevision(revno int) string {
+	if revno < 0 {
+		return "unknown"
+	}
+	return fmt.Sprint(revno)
+}
+
+// Pass items from in to out until in is closed (or ctx is done),
+// warning the first time each path repeats.  Returns how many paths
+// did.
+func warnDupes(ctx context.Context, in <-chan restoreWorkItem,
+	out chan<- restoreWorkItem) int {
+
+	seen := map[string]*dupeEntry{}
+	dupes := 0
+	for ob := range in {
+		e, ok := seen[ob.Path]
+		switch {
+		case !ok:
+			seen[ob.Path] = &dupeEntry{revno: entryRevision(ob)}
+		case !e.warned:
+			e.warned = true
+			dupes++
+			mainLog.Printf("WARNING: %v appears more than once in the "+
+				"backup (revisions %v and %v)", ob.Path,
+				describeRevision(e.revno),
+				describeRevision(entryRevision(ob)))
+		}
+		select {
+		case out <- ob:
+		case <-ctx.Done():
+			return dupes
+		}
+	}
+	return dupes
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestWarnDupes(t *testing.T) {
+	item := func(p, meta string) restoreWorkItem {
+		m := json.RawMessage(meta)
+		return restoreWorkItem{Path: p, Meta: &m}
+	}
+	items := []restoreWorkItem{
+		item("a", `{"revno": 1}`),
+		item("b", `{"revno": 1}`),
+		item("a", `{"revno": 3}`),
+		item("a", `{"revno": 4}`),
+		item("b", `junk`),
+	}
+
+	buf := &bytes.Buffer{}
+	restoreLog.SetOutput(buf)
+	defer restoreLog.SetOutput(os.Stderr)
+
+	in := make(chan restoreWorkItem, len(items))
+	out := make(chan restoreWorkItem, len(items))
+	for _, ob := range items {
+		in <- ob
+	}
+	close(in)
+	if n := warnDupes(context.Background(), in, out); n != 2 {
+		t.Errorf("Expected 2 repeated paths, got %v", n)
+	}
+	if len(out) != len(items) {
+		t.Errorf("Expected all %v items passed on, got %v", len(items), len(out))
+	}
+
+	log := buf.String()
+	for _, exp := range []string{
+		"a appears more than once in the backup (revisions 1 and 3)",
+		"b appears more than once in the backup (revisions 1 and unknown)",
+	} {
+		if !strings.Contains(log, exp) {
+			t.Errorf("Expected %q logged, got:\n%v", exp, log)
+		}
+	}
+	if strings.Contains(log, "and 4") {
+		t.Errorf("Expected a warning only the first time, got:\n%v", log)
+	}
+}
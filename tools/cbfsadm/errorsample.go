@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+var restoreRepeatInterval = restoreFlags.Duration("repeat-interval",
+	10*time.Second, "Log failures with the same error once per interval, "+
+		"with how often they repeated (0 to log every one)")
+
+// Collapses failures with the same error, so an outage logs a line
+// per interval for each way it's failing rather than one per file.
+// Only the log is sampled: the deadletter file and report still get
+// every failed path.
+type errorSampler struct {
+	interval time.Duration
+
+	mu      sync.Mutex
+	samples map[string]*errorSample
+}
+
+// Failures logged with an error since started.
+type errorSample struct {
+	started time.Time
+	// How many more failed since the one logged, and the last.
+	repeated int
+	last     logEntry
+	log      workerLog
+}
+
+// The sampler restore's failures are logged through, nil to log them
+// all.
+var restoreErrors *errorSampler
+
+func newErrorSampler(interval time.Duration) *errorSampler {
+	if interval <= 0 {
+		return nil
+	}
+	return &errorSampler{interval: interval,
+		samples: map[string]*errorSample{}}
+}
+
+// What failures have in common when they're alike: their error, less
+// the path, which it often names.
+func errorKey(path string, err error) string {
+	if err == nil {
+		return ""
+	}
+	return strings.Replace(err.Error(), path, "", -1)
+}
+
+// Whether to log the failure e of path with err, counting it instead
+// if one like it has been logged this interval.
+func (s *errorSampler) admit(l workerLog, e logEntry, path string, err error) bool {
+	if s == nil {
+		return true
+	}
+	key := errorKey(path, err)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if es, ok := s.samples[key]; ok {
+		es.repeated++
+		es.last, es.log = e, l
+		return false
+	}
+	s.samples[key] = &errorSample{started: time.Now()}
+	return true
+}
+
+// Log how often each error that's been sampled for an interval (or
+// every one, if all) repeated, and start sampling it afresh.
+func (s *errorSampler) flush(now time.Time, all bool) {
+	s.mu.Lock()
+	var due []*errorSample
+	for key, es := range s.samples {
+		if all || now.Sub(es.started) >= s.interval {
+			delete(s.samples, key)
+			if es.repeated > 0 {
+				due = append(due, es)
+			}
+		}
+	}
+	s.mu.Unlock()
+
+	for _, es := range due {
+		repeatedMsg := fmt.Sprintf("%v (repeated %v times)",
+			strings.TrimRight(es.last.Msg, "\n"), es.repeated)
+		es.last.Msg, es.last.Repeated = repeatedMsg, es.repeated
+		es.log.log(es.last)
+	}
+}
+
+// Flush the sampler every interval until stop is closed.
+func (s *errorSampler) run(stop <-chan bool) {
+	t := time.NewTicker(s.interval)
+	defer t.Stop()
+	for {
+		select {
+		case now := <-t.C:
+			s.flush(now, false)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Set up restoreErrors for -repeat-interval, returning a function
+// that stops it, logging what it was still counting.
+func startErrorSampling() func() {
+	restoreErrors = newErrorSampler(*restoreRepeatInterval)
+	s := restoreErrors
+	if s == nil {
+		return func() {}
+	}
+	stop := make(chan bool)
+	done := make(chan bool)
+	go func() {
+		s.run(stop)
+		close(done)
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(stop)
+			<-done
+			s.flush(time.Now(), true)
+			restoreErrors = nil
+		})
+	}
+}
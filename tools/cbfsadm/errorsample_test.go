@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestErrorSampler(t *testing.T) {
+	buf := &bytes.Buffer{}
+	restoreLog.SetOutput(buf)
+	defer restoreLog.SetOutput(os.Stderr)
+
+	s := newErrorSampler(time.Minute)
+	fail := func(path, msg string) bool {
+		err := errors.New(msg)
+		return s.admit(mainLog, logEntry{Level: "error",
+			Msg: fmt.Sprintf("Error restoring %v: %v", path, err)}, path, err)
+	}
+	tests := []struct {
+		path, msg string
+		logged    bool
+	}{
+		{"dir/a", "error restoring dir/a: 503", true},
+		{"dir/b", "error restoring dir/b: 503", false},
+		{"dir/c", "error restoring dir/c: 503", false},
+		{"dir/d", "error restoring dir/d: 400", true},
+		{"dir/e", "error restoring dir/e: 503", false},
+	}
+	for _, test := range tests {
+		if got := fail(test.path, test.msg); got != test.logged {
+			t.Errorf("Expected logged=%v for %v, got %v",
+				test.logged, test.path, got)
+		}
+	}
+
+	// Not an interval on, nothing is due.
+	start := time.Now()
+	s.flush(start, false)
+	if buf.Len() != 0 {
+		t.Errorf("Expected nothing logged yet, got %q", buf)
+	}
+	s.flush(start.Add(time.Minute), false)
+	if got := buf.String(); strings.Count(got, "\n") != 1 ||
+		!strings.Contains(got, "Error restoring dir/e: error restoring dir/e: 503 "+
+			"(repeated 3 times)") {
+		t.Errorf("Expected the 503s counted, got %q", got)
+	}
+
+	// Then each starts afresh.
+	if !fail("dir/f", "error restoring dir/f: 503") ||
+		!fail("dir/g", "error restoring dir/g: 400") {
+		t.Errorf("Expected failures logged again after the interval")
+	}
+
+	var nilSampler *errorSampler
+	if !nilSampler.admit(mainLog, logEntry{}, "a", errors.New("x")) {
+		t.Errorf("Expected everything logged without a sampler")
+	}
+}
+
+// A restore to a failing cluster logs a line per error, but the
+// deadletter file still gets every path.
+func TestRestoreRepeatInterval(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			http.Error(w, "full", 400)
+		}))
+	defer ts.Close()
+
+	paths := []string{}
+	for i := 0; i < 20; i++ {
+		paths = append(paths, fmt.Sprintf("f%02d", i))
+	}
+	fn := writeTestBackup(t, paths...)
+	defer os.Remove(fn)
+
+	defer func(i time.Duration, d string, q bool) {
+		*restoreRepeatInterval, *restoreDeadletter, *restoreQuiet = i, d, q
+	}(*restoreRepeatInterval, *restoreDeadletter, *restoreQuiet)
+	*restoreQuiet = true
+	defer restoreLog.SetOutput(os.Stderr)
+
+	for _, test := range []struct {
+		interval      time.Duration
+		logged        int
+		repeatedLines int
+	}{
+		{time.Minute, 1, 1},
+		{0, 20, 0},
+	} {
+		buf := &bytes.Buffer{}
+		restoreLog.SetOutput(buf)
+		*restoreRepeatInterval = test.interval
+		*restoreDeadletter = filepath.Join(t.TempDir(), "dead.json")
+
+		stats, err := restore(context.Background(), context.Background(),
+			ts.URL, fn)
+		if err != nil || stats.Failed != 20 {
+			t.Fatalf("Expected 20 failures, got %+v (%v)", *stats, err)
+		}
+		log := buf.String()
+		if n := strings.Count(log, "Error restoring"); n != test.logged+test.repeatedLines {
+			t.Errorf("Expected %v logged and %v repeat lines with "+
+				"-repeat-interval %v, got:\n%s", test.logged,
+				test.repeatedLines, test.interval, log)
+		}
+		if test.repeatedLines > 0 && !strings.Contains(log, "(repeated 19 times)") {
+			t.Errorf("Expected 19 repeats counted, got:\n%s", log)
+		}
+
+		b, err := ioutil.ReadFile(*restoreDeadletter)
+		if n := strings.Count(string(b), "\n"); err != nil || n != 20 {
+			t.Errorf("Expected 20 deadletter entries, got %v (%v)", n, err)
+		}
+	}
+}
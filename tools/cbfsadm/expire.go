@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A -expire-relative lifetime: a duration as time.ParseDuration takes
+// it, or a whole number of days such as "30d".
+type lifetimeFlag time.Duration
+
+func (l *lifetimeFlag) String() string {
+	d := time.Duration(*l)
+	if d > 0 && d%(24*time.Hour) == 0 {
+		return strconv.FormatInt(int64(d/(24*time.Hour)), 10) + "d"
+	}
+	return d.String()
+}
+
+func (l *lifetimeFlag) Set(v string) error {
+	var d time.Duration
+	if n := strings.TrimSuffix(v, "d"); n != v {
+		days, err := strconv.ParseUint(n, 10, 16)
+		if err != nil {
+			return errors.New("days must be a whole number")
+		}
+		d = time.Duration(days) * 24 * time.Hour
+	} else {
+		var err error
+		if d, err = time.ParseDuration(v); err != nil {
+			return err
+		}
+	}
+	if d < 0 {
+		return errors.New("must not be negative")
+	}
+	*l = lifetimeFlag(d)
+	return nil
+}
+
+var restoreExpireRelative lifetimeFlag
+
+func init() {
+	restoreFlags.Var(&restoreExpireRelative, "expire-relative",
+		"Expire each file this long (such as 720h or 30d) after it was "+
+			"first created, where the backup shows when (-expire otherwise)")
+}
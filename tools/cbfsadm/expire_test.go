@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLifetimeFlag(t *testing.T) {
+	tests := []struct {
+		in  string
+		exp time.Duration
+		str string
+	}{
+		{"30d", 30 * 24 * time.Hour, "30d"},
+		{"0d", 0, "0s"},
+		{"36h", 36 * time.Hour, "36h0m0s"},
+		{"48h", 48 * time.Hour, "2d"},
+	}
+	for _, test := range tests {
+		var l lifetimeFlag
+		if err := l.Set(test.in); err != nil {
+			t.Errorf("Error parsing %v: %v", test.in, err)
+			continue
+		}
+		if time.Duration(l) != test.exp || l.String() != test.str {
+			t.Errorf("Expected %v (%v) for %v, got %v (%v)",
+				test.exp, test.str, test.in, time.Duration(l), l.String())
+		}
+	}
+
+	for _, bad := range []string{"", "d", "1.5d", "-2d", "-1h", "soon"} {
+		var l lifetimeFlag
+		if err := l.Set(bad); err == nil {
+			t.Errorf("Expected an error for %q, got %v", bad, l.String())
+		}
+	}
+}
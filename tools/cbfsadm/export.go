@@ -0,0 +1,380 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/couchbaselabs/cbfs/tools"
+	"github.com/dustin/go-humanize"
+	"github.com/dustin/httputil"
+	"github.com/klauspost/compress/zstd"
+)
+
+var exportFlags = flag.NewFlagSet("export", flag.ExitOnError)
+var exportPat = exportFlags.String("match", ".*", "Regex for paths to export")
+var exportExclude = exportFlags.String("exclude", "",
+	"Regex for paths to skip (wins over -match)")
+var exportFormat = exportFlags.String("format", "gzip",
+	"Output compression (gzip, zstd or none)")
+var exportLevel = exportFlags.Int("level", defaultLevel,
+	"Compression level from 0 (fastest) to 9 (smallest), -1 for the format's default")
+var exportKeyfile = exportFlags.String("keyfile", "",
+	"Encrypt the backup with this key (default $CBFS_BACKUP_KEY)")
+var exportSince = exportFlags.String("since", "",
+	"Only export files modified after this time (RFC3339 or a duration ago)")
+var exportSorted = exportFlags.Bool("sorted", true,
+	"Write entries in path order (holding all metadata in memory)")
+var exportSplit = exportFlags.Int64("split", 0,
+	"Start a new numbered segment once one reaches this many bytes")
+var exportReportFile = exportFlags.String("report", "",
+	"Write a JSON summary of the export to this file")
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// Compress with the format's own default level.
+const defaultLevel = -1
+
+// Wrap w in a compressor for the given format and level (0-9, or
+// defaultLevel).  Closing the returned writer flushes the compressor,
+// but doesn't close w.
+func compress(w io.Writer, format string, level int) (io.WriteCloser, error) {
+	if level < defaultLevel || level > 9 {
+		return nil, fmt.Errorf("invalid compression level %v", level)
+	}
+	switch format {
+	case "gzip":
+		// The header's time and name are left empty, so the
+		// same entries always compress to the same bytes.
+		return gzip.NewWriterLevel(w, level)
+	case "zstd":
+		if level == defaultLevel {
+			return zstd.NewWriter(w)
+		}
+		return zstd.NewWriter(w,
+			zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+	case "none":
+		return nopWriteCloser{w}, nil
+	}
+	return nil, fmt.Errorf("unknown format %q", format)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// A local backup file being written, compressed and (if there's a
+// key) encrypted on its way to disk.
+type backupWriter struct {
+	io.Writer
+	size    *countingWriter
+	closers []io.Closer
+}
+
+// Create the local backup file fn ("-" for stdout).
+func createBackup(fn, format string, level int, key []byte) (*backupWriter, error) {
+	var f io.WriteCloser = nopWriteCloser{os.Stdout}
+	if fn != "-" {
+		var err error
+		if f, err = os.Create(fn); err != nil {
+			return nil, err
+		}
+	}
+
+	b := &backupWriter{size: &countingWriter{w: f}}
+	var enc io.WriteCloser = nopWriteCloser{b.size}
+	if key != nil {
+		var err error
+		if enc, err = newEncrypter(b.size, key); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	w, err := compress(enc, format, level)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	b.Writer = w
+	b.closers = []io.Closer{w, enc, f}
+	return b, nil
+}
+
+// Bytes written to the file so far, all of them once closed.
+func (b *backupWriter) written() int64 { return b.size.n }
+
+// Flush the compressor and encrypter and close the file.
+func (b *backupWriter) Close() error {
+	var err error
+	for _, c := range b.closers {
+		if e := c.Close(); err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Writes a backup as numbered segments (base.000, base.001, ...),
+// moving on to the next segment once the current one reaches limit
+// bytes on disk.  Every segment is a complete backup of its own, so
+// each Write must be a whole object.
+type splitWriter struct {
+	base   string
+	limit  int64
+	format string
+	level  int
+	key    []byte
+
+	cur      *backupWriter
+	segments int
+	// Bytes written to the segments before cur.
+	done int64
+}
+
+func segmentName(base string, n int) string {
+	return fmt.Sprintf("%v.%03d", base, n)
+}
+
+func (s *splitWriter) Write(p []byte) (int, error) {
+	if s.cur == nil {
+		b, err := createBackup(segmentName(s.base, s.segments),
+			s.format, s.level, s.key)
+		if err != nil {
+			return 0, err
+		}
+		s.cur = b
+		s.segments++
+	}
+
+	n, err := s.cur.Write(p)
+	if err == nil && s.cur.size.n >= s.limit {
+		err = s.closeSegment()
+	}
+	return n, err
+}
+
+func (s *splitWriter) closeSegment() error {
+	err := s.cur.Close()
+	s.done += s.cur.written()
+	s.cur = nil
+	return err
+}
+
+// Bytes written to all the segments so far, all of them once closed.
+func (s *splitWriter) written() int64 {
+	if s.cur == nil {
+		return s.done
+	}
+	return s.done + s.cur.written()
+}
+
+// Close the current segment.  An empty export still produces a
+// (valid, empty) first segment.
+func (s *splitWriter) Close() error {
+	if s.segments == 0 {
+		if _, err := s.Write(nil); err != nil {
+			return err
+		}
+	}
+	if s.cur == nil {
+		return nil
+	}
+	return s.closeSegment()
+}
+
+// The summary of an export, as written by -report.
+type exportSummary struct {
+	Files int `json:"files"`
+	// The metadata written, before compression (and encryption).
+	RawBytes int64 `json:"raw_bytes"`
+	// What it took on disk.
+	WrittenBytes int64         `json:"written_bytes"`
+	Ratio        float64       `json:"ratio"`
+	Elapsed      time.Duration `json:"elapsed_ns"`
+}
+
+func newExportSummary(files int, raw, written int64,
+	elapsed time.Duration) *exportSummary {
+
+	sum := &exportSummary{Files: files, RawBytes: raw,
+		WrittenBytes: written, Elapsed: elapsed}
+	if written > 0 {
+		sum.Ratio = float64(raw) / float64(written)
+	}
+	return sum
+}
+
+// Parse a -since value, either an RFC3339 time or a duration before now.
+func parseSince(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q", s)
+	}
+	return time.Now().Add(-d), nil
+}
+
+// True if the item was modified after since.  Items whose modification
+// time can't be determined are always included.
+func modifiedSince(ob restoreWorkItem, since time.Time) bool {
+	if since.IsZero() {
+		return true
+	}
+	fm, err := parseMeta(ob.Meta)
+	return err != nil || fm.Modified.IsZero() || fm.Modified.After(since)
+}
+
+// Call fn with the metadata of every file in the cluster at ustr
+// whose path starts with prefix (a directory, as listPrefix gives, or
+// empty for all of them), as the server streams it.  Stops at the
+// first error fn returns.
+func streamMeta(ustr, prefix string, fn func(restoreWorkItem) error) error {
+	if _, err := url.Parse(ustr); err != nil {
+		return err
+	}
+	u := cbfstool.ClusterURL(ustr, "/.cbfs/backup/stream/"+prefix)
+
+	res, err := headerClient.Get(u.String())
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return httputil.HTTPErrorf(res, "error streaming metadata: %S\n%B")
+	}
+
+	d := json.NewDecoder(res.Body)
+	for {
+		ob := restoreWorkItem{}
+		switch err := d.Decode(&ob); err {
+		case nil:
+			if err := fn(ob); err != nil {
+				return err
+			}
+		case io.EOF:
+			return nil
+		default:
+			return err
+		}
+	}
+}
+
+// Stream the metadata of every file in the cluster at ustr under
+// prefix (see streamMeta) matching matches and modified after since
+// (if not zero) to w in the format
+// restore reads.  If sorted, entries are collected and written in
+// path order, so exporting an unchanged cluster produces identical
+// output; otherwise they're written as the server streams them.
+// Each object is written with a single call to w's Write.  Returns
+// the number of files written.
+func export(ustr, prefix string, w io.Writer, matches func(string) bool,
+	since time.Time, sorted bool) (int, error) {
+
+	write := func(ob restoreWorkItem) error {
+		b, err := json.Marshal(&ob)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(append(b, '\n'))
+		return err
+	}
+
+	n := 0
+	var all []restoreWorkItem
+	err := streamMeta(ustr, prefix, func(ob restoreWorkItem) error {
+		if !matches(ob.Path) || !modifiedSince(ob, since) {
+			return nil
+		}
+		n++
+		if sorted {
+			all = append(all, ob)
+			return nil
+		}
+		return write(ob)
+	})
+	if err != nil {
+		return n, err
+	}
+
+	sort.Slice(all, func(i, j int) bool { return all[i].Path < all[j].Path })
+	for _, ob := range all {
+		if err := write(ob); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func exportCommand(ustr string, args []string) {
+	sendHeadersTo(ustr)
+
+	matches, err := newMatcher(*exportPat, *exportExclude)
+	cbfstool.MaybeFatal(err, "Error parsing match pattern: %v", err)
+
+	since, err := parseSince(*exportSince)
+	cbfstool.MaybeFatal(err, "Error parsing -since: %v", err)
+
+	key, err := loadBackupKey(*exportKeyfile)
+	cbfstool.MaybeFatal(err, "Error loading backup key: %v", err)
+
+	fn := exportFlags.Arg(0)
+	if *exportSplit > 0 && fn == "-" {
+		log.Fatalf("-split requires a backup filename")
+	}
+	start := time.Now()
+
+	var w interface {
+		io.WriteCloser
+		written() int64
+	}
+	if *exportSplit > 0 {
+		w = &splitWriter{base: fn, limit: *exportSplit,
+			format: *exportFormat, level: *exportLevel, key: key}
+	} else {
+		w, err = createBackup(fn, *exportFormat, *exportLevel, key)
+		cbfstool.MaybeFatal(err, "Error creating backup file: %v", err)
+	}
+
+	raw := &countingWriter{w: w}
+	n, err := export(ustr, listPrefix(*exportPat), raw, matches, since,
+		*exportSorted)
+	cbfstool.MaybeFatal(err, "Error exporting: %v", err)
+
+	err = w.Close()
+	cbfstool.MaybeFatal(err, "Error writing backup file: %v", err)
+
+	sum := newExportSummary(n, raw.n, w.written(), time.Since(start))
+	log.Printf("Exported %v files to %v in %v: %v of metadata, "+
+		"%v written (%.1fx)", n, fn, sum.Elapsed,
+		humanize.Bytes(uint64(sum.RawBytes)),
+		humanize.Bytes(uint64(sum.WrittenBytes)), sum.Ratio)
+
+	if *exportReportFile != "" {
+		err := writeReport(*exportReportFile, sum)
+		cbfstool.MaybeFatal(err, "Error writing report: %v", err)
+	}
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Metadata as the server's backup stream produces it.
+const testStream = `{"meta":{"oid":"aaa","length":3,"modified":"2014-01-01T00:00:00Z"},"path":"a/x"}
+{"meta":{"oid":"bbb","length":4,"modified":"2014-02-01T00:00:00Z"},"path":"b/y"}
+{"meta":{"oid":"ccc","length":5,"modified":"2014-03-01T00:00:00Z"},"path":"a/z"}
+`
+
+func streamServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			if req.URL.Path != "/.cbfs/backup/stream/" {
+				http.NotFound(w, req)
+				return
+			}
+			fmt.Fprint(w, testStream)
+		}))
+}
+
+func TestExportRoundTrip(t *testing.T) {
+	ts := streamServer()
+	defer ts.Close()
+
+	matches, err := newMatcher("^a/", "")
+	if err != nil {
+		t.Fatalf("Error building matcher: %v", err)
+	}
+
+	buf := &bytes.Buffer{}
+	w, err := compress(buf, "gzip", defaultLevel)
+	if err != nil {
+		t.Fatalf("Error creating compressor: %v", err)
+	}
+	n, err := export(ts.URL, "", w, matches, time.Time{}, false)
+	if err != nil {
+		t.Fatalf("Error exporting: %v", err)
+	}
+	w.Close()
+	if n != 2 {
+		t.Errorf("Expected 2 exported files, got %v", n)
+	}
+
+	r, err := decompress(buf)
+	if err != nil {
+		t.Fatalf("Error decompressing export: %v", err)
+	}
+	ch := make(chan restoreWorkItem, 10)
+	err = decodeBackup(context.Background(), r,
+		func(string) bool { return true }, nil, &restoreStats{}, ch)
+	if err != nil {
+		t.Fatalf("Error decoding export: %v", err)
+	}
+	close(ch)
+
+	got := []string{}
+	for ob := range ch {
+		got = append(got, ob.Path+" "+string(*ob.Meta))
+	}
+	exp := []string{
+		`a/x {"oid":"aaa","length":3,"modified":"2014-01-01T00:00:00Z"}`,
+		`a/z {"oid":"ccc","length":5,"modified":"2014-03-01T00:00:00Z"}`,
+	}
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("Expected %v, got %v", exp, got)
+	}
+}
+
+func TestModifiedSince(t *testing.T) {
+	since, err := parseSince("2014-02-01T00:00:00Z")
+	if err != nil {
+		t.Fatalf("Error parsing since: %v", err)
+	}
+
+	tests := []struct {
+		meta string
+		exp  bool
+	}{
+		{`{"modified":"2014-01-01T00:00:00Z"}`, false},
+		{`{"modified":"2014-02-01T00:00:00Z"}`, false},
+		{`{"modified":"2014-02-01T00:00:01Z"}`, true},
+		{`not json`, true},
+		{`{"oid":"abc"}`, true},
+	}
+	for _, test := range tests {
+		m := json.RawMessage(test.meta)
+		if got := modifiedSince(restoreWorkItem{Path: "x", Meta: &m}, since); got != test.exp {
+			t.Errorf("Expected %v for %s, got %v", test.exp, test.meta, got)
+		}
+	}
+
+	if _, err := parseSince("yesterday"); err == nil {
+		t.Errorf("Expected error parsing an invalid since")
+	}
+}
+
+// Sorted exports of the same files are identical however the server
+// orders them.
+func TestExportSorted(t *testing.T) {
+	lines := strings.SplitAfter(testStream, "\n")
+	orders := [][]string{lines, {lines[2], lines[0], lines[1]}}
+
+	var outputs [][]byte
+	for _, order := range orders {
+		stream := strings.Join(order, "")
+		ts := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, req *http.Request) {
+				fmt.Fprint(w, stream)
+			}))
+
+		buf := &bytes.Buffer{}
+		w, err := compress(buf, "gzip", defaultLevel)
+		if err != nil {
+			t.Fatalf("Error creating compressor: %v", err)
+		}
+		_, err = export(ts.URL, "", w, func(string) bool { return true },
+			time.Time{}, true)
+		ts.Close()
+		if err != nil {
+			t.Fatalf("Error exporting: %v", err)
+		}
+		w.Close()
+		outputs = append(outputs, buf.Bytes())
+	}
+
+	if !bytes.Equal(outputs[0], outputs[1]) {
+		t.Errorf("Expected identical exports, got %x and %x",
+			outputs[0], outputs[1])
+	}
+	r, err := decompress(bytes.NewReader(outputs[0]))
+	if err != nil {
+		t.Fatalf("Error decompressing: %v", err)
+	}
+	ch := make(chan restoreWorkItem, 10)
+	err = decodeBackup(context.Background(), r,
+		func(string) bool { return true }, nil, &restoreStats{}, ch)
+	close(ch)
+	paths := []string{}
+	for ob := range ch {
+		paths = append(paths, ob.Path)
+	}
+	if exp := []string{"a/x", "a/z", "b/y"}; err != nil || !reflect.DeepEqual(paths, exp) {
+		t.Errorf("Expected %v in order, got %v, %v", exp, paths, err)
+	}
+}
+
+func TestExportSplit(t *testing.T) {
+	ts := streamServer()
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "export-split")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Every object overflows a one byte limit, so each gets its own
+	// segment.
+	base := filepath.Join(dir, "backup")
+	w := &splitWriter{base: base, limit: 1, format: "gzip",
+		level: defaultLevel}
+	if _, err := export(ts.URL, "", w, func(string) bool { return true },
+		time.Time{}, false); err != nil {
+		t.Fatalf("Error exporting: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Error closing export: %v", err)
+	}
+
+	// Whatever else is in the directory isn't a segment.
+	for _, fn := range []string{"README", "dead.json", ".backup.003.tmp123"} {
+		err := ioutil.WriteFile(filepath.Join(dir, fn), []byte("junk\n"), 0644)
+		if err != nil {
+			t.Fatalf("Error writing %v: %v", fn, err)
+		}
+	}
+
+	exp := []string{base + ".000", base + ".001", base + ".002"}
+	for _, fn := range []string{dir, base, base + ".*"} {
+		segs, err := backupSegments(fn)
+		if err != nil {
+			t.Fatalf("Error finding segments of %v: %v", fn, err)
+		}
+		if !reflect.DeepEqual(segs, exp) {
+			t.Errorf("Expected segments %v for %v, got %v", exp, fn, segs)
+		}
+	}
+
+	empty := filepath.Join(dir, "empty")
+	if err := os.Mkdir(empty, 0755); err != nil {
+		t.Fatalf("Error creating %v: %v", empty, err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(empty, "README"), nil, 0644); err != nil {
+		t.Fatalf("Error writing README: %v", err)
+	}
+	if _, err := backupSegments(empty); err == nil ||
+		!strings.Contains(err.Error(), "no backup segments") {
+		t.Errorf("Expected no segments in %v, got %v", empty, err)
+	}
+
+	got := []string{}
+	for _, seg := range exp {
+		ch := make(chan restoreWorkItem, 10)
+		err := readBackup(context.Background(), seg, nil,
+			func(string) bool { return true }, nil, &restoreStats{}, ch)
+		if err != nil {
+			t.Fatalf("Error reading %v: %v", seg, err)
+		}
+		close(ch)
+		for ob := range ch {
+			got = append(got, ob.Path)
+		}
+	}
+	if exp := []string{"a/x", "b/y", "a/z"}; !reflect.DeepEqual(got, exp) {
+		t.Errorf("Expected %v from segments, got %v", exp, got)
+	}
+
+	size := int64(0)
+	for _, seg := range exp {
+		st, err := os.Stat(seg)
+		if err != nil {
+			t.Fatalf("Error checking %v: %v", seg, err)
+		}
+		size += st.Size()
+	}
+	if w.written() != size {
+		t.Errorf("Expected %v bytes written, counted %v", size, w.written())
+	}
+}
+
+func TestExportSummary(t *testing.T) {
+	sum := newExportSummary(3, 1000, 250, time.Second)
+	if sum.Ratio != 4 {
+		t.Errorf("Expected a 4x ratio, got %v", sum.Ratio)
+	}
+	b, err := json.Marshal(sum)
+	if err != nil {
+		t.Fatalf("Error encoding summary: %v", err)
+	}
+	exp := `{"files":3,"raw_bytes":1000,"written_bytes":250,"ratio":4,` +
+		`"elapsed_ns":1000000000}`
+	if string(b) != exp {
+		t.Errorf("Expected %v, got %s", exp, b)
+	}
+	if sum := newExportSummary(0, 0, 0, 0); sum.Ratio != 0 {
+		t.Errorf("Expected no ratio for an empty export, got %v", sum.Ratio)
+	}
+}
+
+func TestSegmentOrder(t *testing.T) {
+	segs := []string{"b.1000", "b.999", "b.010", "a.2", "b.x"}
+	sort.Slice(segs, func(i, j int) bool {
+		return segmentLess(segs[i], segs[j])
+	})
+	exp := []string{"a.2", "b.010", "b.999", "b.1000", "b.x"}
+	if !reflect.DeepEqual(segs, exp) {
+		t.Errorf("Expected %v, got %v", exp, segs)
+	}
+}
+
+func TestFind(t *testing.T) {
+	ts := streamServer()
+	defer ts.Close()
+
+	matches, err := newMatcher("^a/", "")
+	if err != nil {
+		t.Fatalf("Error building matcher: %v", err)
+	}
+
+	tests := []struct {
+		long bool
+		exp  string
+	}{
+		{false, "a/x\na/z\n"},
+		{true, "     3 B  aaa     0  a/x\n     5 B  ccc     0  a/z\n"},
+	}
+	for _, test := range tests {
+		buf := &bytes.Buffer{}
+		n, err := find(ts.URL, "", buf, matches, test.long)
+		if err != nil {
+			t.Fatalf("Error finding: %v", err)
+		}
+		if n != 2 || buf.String() != test.exp {
+			t.Errorf("Expected 2 results %q, got %v %q",
+				test.exp, n, buf.String())
+		}
+	}
+}
+
+// Plain NDJSON, as other tools produce it, restores without any
+// compression or flags.
+func TestNDJSONInput(t *testing.T) {
+	in := strings.NewReader(`{"Path": "a", "Meta": {"oid": "aaa"}}
+{"path": "b", "meta": {"oid": "bbb"}}
+`)
+	r, err := decompress(in)
+	if err != nil {
+		t.Fatalf("Error opening NDJSON: %v", err)
+	}
+	ch := make(chan restoreWorkItem, 10)
+	err = decodeBackup(context.Background(), r,
+		func(string) bool { return true }, nil, &restoreStats{}, ch)
+	if err != nil {
+		t.Fatalf("Error decoding NDJSON: %v", err)
+	}
+	close(ch)
+
+	got := []string{}
+	for ob := range ch {
+		got = append(got, ob.Path+" "+string(*ob.Meta))
+	}
+	exp := []string{`a {"oid": "aaa"}`, `b {"oid": "bbb"}`}
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("Expected %v, got %v", exp, got)
+	}
+}
+
+// Backups of any supported format are recognized without being told.
+func TestDecompress(t *testing.T) {
+	for _, format := range []string{"gzip", "zstd", "none"} {
+		buf := &bytes.Buffer{}
+		w, err := compress(buf, format, defaultLevel)
+		if err != nil {
+			t.Fatalf("Error creating %v compressor: %v", format, err)
+		}
+		fmt.Fprint(w, testStream)
+		if err := w.Close(); err != nil {
+			t.Fatalf("Error closing %v compressor: %v", format, err)
+		}
+
+		r, err := decompress(buf)
+		if err != nil {
+			t.Fatalf("Error decompressing %v: %v", format, err)
+		}
+		got, err := ioutil.ReadAll(r)
+		if err != nil || string(got) != testStream {
+			t.Errorf("Expected the stream back from %v, got %q, %v",
+				format, got, err)
+		}
+	}
+}
+
+// Compare the speed and output size of the lowest and highest levels
+// on a backup of many similar files:
+//
+//	go test -bench CompressLevel -run XXX
+func BenchmarkCompressLevel(b *testing.B) {
+	backup := &bytes.Buffer{}
+	for i := 0; i < 5000; i++ {
+		fmt.Fprintf(backup, `{"path":"photos/2014/%04d/IMG_%05d.jpg",`+
+			`"meta":{"oid":"%040x","length":%v,"revno":1,`+
+			`"modified":"2014-06-01T12:%02d:%02dZ",`+
+			`"headers":{"Content-Type":["image/jpeg"]}}}`+"\n",
+			i/100, i, i*7919, 100000+i*37, i/60%60, i%60)
+	}
+
+	for _, format := range []string{"gzip", "zstd"} {
+		for _, level := range []int{1, 9} {
+			b.Run(fmt.Sprintf("%v-%v", format, level), func(b *testing.B) {
+				b.SetBytes(int64(backup.Len()))
+				out := &countingWriter{w: ioutil.Discard}
+				for i := 0; i < b.N; i++ {
+					w, err := compress(out, format, level)
+					if err != nil {
+						b.Fatalf("Error creating compressor: %v", err)
+					}
+					w.Write(backup.Bytes())
+					w.Close()
+				}
+				b.ReportMetric(float64(out.n)/float64(b.N), "out-bytes/op")
+			})
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/couchbaselabs/cbfs/client"
+	"github.com/couchbaselabs/cbfs/tools"
+	"github.com/dustin/httputil"
+)
+
+var restoreFetchFrom = restoreFlags.String("fetch-from", "",
+	"Copy blobs the destination is missing from this cluster")
+var restoreFetchWorkers = restoreFlags.Int("fetch-workers", 2,
+	"Maximum concurrent blob copies from -fetch-from")
+
+// Copies blobs from a source cluster to the destination of a restore.
+// The destination happily restores metadata for blobs it doesn't
+// have, so each blob is checked for (and copied) before its file
+// is restored.
+//
+// All methods are safe to call on a nil blobFetcher and do nothing.
+type blobFetcher struct {
+	src, dest string
+	nodes     map[string]cbfsclient.StorageNode
+	sem       chan bool
+	client    *http.Client
+}
+
+// The fetcher configured by restore, if -fetch-from was given.
+var restoreFetcher *blobFetcher
+
+// Build a fetcher copying from the cluster at src to the one at dest,
+// at most n blobs at a time.
+func newBlobFetcher(src, dest string, n int) (*blobFetcher, error) {
+	if n < 1 {
+		return nil, fmt.Errorf("invalid fetch concurrency: %v", n)
+	}
+	c, err := cbfsclient.New(src)
+	if err != nil {
+		return nil, err
+	}
+	nodes, err := c.Nodes()
+	if err != nil {
+		return nil, fmt.Errorf("error listing source nodes: %v", err)
+	}
+	// Blobs can be arbitrarily large, so copies are only bounded
+	// by the restore's context.
+	return &blobFetcher{src: src, dest: dest, nodes: nodes,
+		sem: make(chan bool, n), client: newHTTPClient(0, n, *restoreHTTP2)}, nil
+}
+
+// Find the nodes in the cluster at base holding oid.
+func blobNodes(ctx context.Context, base, oid string) ([]string, error) {
+	u := cbfstool.ClusterURL(base, "/.cbfs/blob/info/")
+
+	form := url.Values{"blob": []string{oid}}
+	req, err := http.NewRequestWithContext(ctx, "POST", u.String(),
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	res, err := restoreClient.Do(req)
+	if err != nil {
+		return nil, cbfstool.TempError{Err: err}
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return nil, httputil.HTTPErrorf(res, "error fetching blob info: %S\n%B")
+	}
+
+	infos := map[string]cbfsclient.BlobInfo{}
+	if err := json.NewDecoder(res.Body).Decode(&infos); err != nil {
+		return nil, err
+	}
+	nodes := []string{}
+	for n := range infos[oid].Nodes {
+		nodes = append(nodes, n)
+	}
+	return nodes, nil
+}
+
+// Make sure the destination has the blob for the file described by
+// meta, copying it from the source if it doesn't.
+func (f *blobFetcher) ensure(ctx context.Context, meta *json.RawMessage) error {
+	if f == nil {
+		return nil
+	}
+	fm, err := parseMeta(meta)
+	if err != nil || fm.OID == "" {
+		// Let the restore itself complain.
+		return nil
+	}
+	_, err = f.ensureBlob(ctx, fm.OID)
+	return err
+}
+
+// The error when a blob to copy isn't in the source cluster either.
+type noSourceError string
+
+func (e noSourceError) Error() string {
+	return fmt.Sprintf("blob %v is missing from the source too", string(e))
+}
+
+// Make sure the destination has the blob oid, copying it from the
+// source if it doesn't.  Returns whether it was copied.
+func (f *blobFetcher) ensureBlob(ctx context.Context, oid string) (bool, error) {
+	have, err := blobNodes(ctx, f.dest, oid)
+	if err != nil || len(have) > 0 {
+		return false, err
+	}
+
+	select {
+	case f.sem <- true:
+		defer func() { <-f.sem }()
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+
+	owners, err := blobNodes(ctx, f.src, oid)
+	if err != nil {
+		return false, err
+	}
+	if len(owners) == 0 {
+		return false, noSourceError(oid)
+	}
+
+	start := time.Now()
+	for _, name := range owners {
+		node, ok := f.nodes[name]
+		if !ok {
+			continue
+		}
+		var n int64
+		if n, err = f.copy(ctx, node.BlobURL(oid), oid); err == nil {
+			logFor(ctx).Infof("Copied blob %v (%v bytes) in %v",
+				oid, n, time.Since(start))
+			return true, nil
+		}
+		logFor(ctx).Errorf("Error copying blob %v from %v: %v", oid, name, err)
+	}
+	if err == nil {
+		err = fmt.Errorf("no known source node has blob %v", oid)
+	}
+	return false, err
+}
+
+// Stream the blob at srcURL to the destination, returning its length
+// (-1 if the source didn't say).  It goes in a single PUT: the server
+// has no way to take a blob in chunks.
+func (f *blobFetcher) copy(ctx context.Context, srcURL, oid string) (int64, error) {
+	sreq, err := http.NewRequestWithContext(ctx, "GET", srcURL, nil)
+	if err != nil {
+		return 0, err
+	}
+	sres, err := f.client.Do(sreq)
+	if err != nil {
+		return 0, err
+	}
+	defer sres.Body.Close()
+	if sres.StatusCode != 200 {
+		return 0, httputil.HTTPErrorf(sres, "error fetching blob: %S\n%B")
+	}
+
+	u := cbfstool.ClusterURL(f.dest, "/.cbfs/blob/"+oid)
+	dreq, err := http.NewRequestWithContext(ctx, "PUT", u.String(), sres.Body)
+	if err != nil {
+		return 0, err
+	}
+	dreq.ContentLength = sres.ContentLength
+
+	dres, err := f.client.Do(dreq)
+	if err != nil {
+		return 0, err
+	}
+	defer dres.Body.Close()
+	if dres.StatusCode != 201 {
+		return 0, httputil.HTTPErrorf(dres, "error storing blob: %S\n%B")
+	}
+	// The destination refuses a blob whose content doesn't hash to
+	// oid, and says what it hashed to; check that too, in case it
+	// was stored under some other name.
+	if h := dres.Header.Get("X-CBFS-Hash"); h != "" && h != oid {
+		return 0, fmt.Errorf("destination stored blob %v as %v", oid, h)
+	}
+	return sres.ContentLength, nil
+}
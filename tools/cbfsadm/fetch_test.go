@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// A minimal cluster holding the given blobs.
+type testCluster struct {
+	mu    sync.Mutex
+	blobs map[string]string
+	// The hash a PUT blob is said to have, if not its oid.
+	hashAs string
+	*httptest.Server
+}
+
+func newTestCluster(blobs map[string]string) *testCluster {
+	c := &testCluster{blobs: blobs}
+	c.Server = httptest.NewServer(http.HandlerFunc(c.serve))
+	return c
+}
+
+func (c *testCluster) serve(w http.ResponseWriter, req *http.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	oid := strings.TrimPrefix(req.URL.Path, "/.cbfs/blob/")
+	switch {
+	case req.URL.Path == "/.cbfs/nodes/":
+		fmt.Fprintf(w, `{"n1": {"Addr": %q}}`, c.Listener.Addr().String())
+	case req.URL.Path == "/.cbfs/blob/info/":
+		req.ParseForm()
+		res := map[string]interface{}{}
+		for _, b := range req.Form["blob"] {
+			if _, ok := c.blobs[b]; ok {
+				res[b] = map[string]interface{}{
+					"nodes": map[string]string{
+						"n1": "2014-01-01T00:00:00Z"}}
+			}
+		}
+		json.NewEncoder(w).Encode(res)
+	case req.Method == "GET" && c.blobs[oid] != "":
+		fmt.Fprint(w, c.blobs[oid])
+	case req.Method == "PUT":
+		b, _ := ioutil.ReadAll(req.Body)
+		c.blobs[oid] = string(b)
+		h := oid
+		if c.hashAs != "" {
+			h = c.hashAs
+		}
+		w.Header().Set("X-CBFS-Hash", h)
+		w.WriteHeader(201)
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func TestBlobFetcher(t *testing.T) {
+	src := newTestCluster(map[string]string{"aaa": "hello", "bbb": "world"})
+	defer src.Close()
+	dest := newTestCluster(map[string]string{"bbb": "world"})
+	defer dest.Close()
+
+	f, err := newBlobFetcher(src.URL, dest.URL, 1)
+	if err != nil {
+		t.Fatalf("Error creating fetcher: %v", err)
+	}
+
+	for _, oid := range []string{"aaa", "bbb"} {
+		m := json.RawMessage(`{"oid": "` + oid + `", "length": 5}`)
+		if err := f.ensure(context.Background(), &m); err != nil {
+			t.Errorf("Error ensuring %v: %v", oid, err)
+		}
+	}
+	if dest.blobs["aaa"] != "hello" {
+		t.Errorf("Expected aaa to be copied, got %q", dest.blobs["aaa"])
+	}
+
+	m := json.RawMessage(`{"oid": "ccc"}`)
+	if err := f.ensure(context.Background(), &m); err == nil {
+		t.Errorf("Expected error ensuring a blob missing everywhere")
+	}
+
+	// A copy the destination hashed differently isn't the blob.
+	delete(dest.blobs, "aaa")
+	dest.hashAs = "zzz"
+	m = json.RawMessage(`{"oid": "aaa"}`)
+	err = f.ensure(context.Background(), &m)
+	if err == nil || !strings.Contains(err.Error(), "stored blob aaa as zzz") {
+		t.Errorf("Expected the wrong hash caught, got %v", err)
+	}
+}
+
+func TestRestoreOIDs(t *testing.T) {
+	src := newTestCluster(map[string]string{"aaa": "hello", "bbb": "world"})
+	defer src.Close()
+	dest := newTestCluster(map[string]string{"bbb": "world"})
+	defer dest.Close()
+
+	fn := writeJSONBackup(t, "oids.txt",
+		"# blobs to check", "aaa", "", "bbb", "  ccc  ")
+	report := filepath.Join(t.TempDir(), "report.json")
+
+	defer func(from, rep string) {
+		*restoreFetchFrom, *restoreReportFile = from, rep
+	}(*restoreFetchFrom, *restoreReportFile)
+	*restoreReportFile = report
+
+	// Just checking, nothing is copied.
+	stats, err := restoreOIDs(context.Background(), context.Background(),
+		dest.URL, fn)
+	if err != nil || (*stats != oidStats{Seen: 3, Present: 1, Missing: 2}) {
+		t.Errorf("Expected 1 present and 2 missing, got %+v (%v)", *stats, err)
+	}
+
+	*restoreFetchFrom = src.URL
+	stats, err = restoreOIDs(context.Background(), context.Background(),
+		dest.URL, fn)
+	if err != nil || (*stats != oidStats{Seen: 3, Present: 1, Restored: 1,
+		Missing: 1}) {
+		t.Errorf("Expected aaa restored and ccc missing, got %+v (%v)",
+			*stats, err)
+	}
+	if dest.blobs["aaa"] != "hello" {
+		t.Errorf("Expected aaa copied, got %q", dest.blobs["aaa"])
+	}
+
+	b, err := ioutil.ReadFile(report)
+	if err != nil {
+		t.Fatalf("Error reading report: %v", err)
+	}
+	rep := oidReport{}
+	if err := json.Unmarshal(b, &rep); err != nil {
+		t.Fatalf("Error parsing report %s: %v", b, err)
+	}
+	if fmt.Sprint(rep.RestoredOIDs, rep.MissingOIDs, len(rep.Failures)) !=
+		"[aaa] [ccc] 0" {
+		t.Errorf("Expected aaa restored and ccc missing, got %s", b)
+	}
+
+	// With the cluster down, nothing can be checked.
+	dest.Close()
+	*restoreFetchFrom = ""
+	stats, err = restoreOIDs(context.Background(), context.Background(),
+		dest.URL, fn)
+	if err != nil || (*stats != oidStats{Seen: 3, Failed: 3}) {
+		t.Errorf("Expected 3 failures, got %+v (%v)", *stats, err)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/couchbaselabs/cbfs/tools"
+	"github.com/dustin/go-humanize"
+)
+
+var findFlags = flag.NewFlagSet("find", flag.ExitOnError)
+var findPat = findFlags.String("match", ".*", "Regex for paths to list")
+var findExclude = findFlags.String("exclude", "",
+	"Regex for paths to skip (wins over -match)")
+var findLong = findFlags.Bool("l", false,
+	"Long format (size, hash, revision and path)")
+
+// Write the paths of files in the cluster at ustr under prefix (see
+// streamMeta) matching matches to w as they're streamed from the
+// server.  Returns the number of files found.
+func find(ustr, prefix string, w io.Writer, matches func(string) bool,
+	long bool) (int, error) {
+
+	n := 0
+	err := streamMeta(ustr, prefix, func(ob restoreWorkItem) error {
+		if !matches(ob.Path) {
+			return nil
+		}
+		n++
+		return writeEntry(w, ob, long)
+	})
+	return n, err
+}
+
+// Write a line for ob to w: its path, or with long its size, hash,
+// revision and path.
+func writeEntry(w io.Writer, ob restoreWorkItem, long bool) error {
+	if !long {
+		_, err := fmt.Fprintln(w, ob.Path)
+		return err
+	}
+	fm, _ := parseMeta(ob.Meta)
+	_, err := fmt.Fprintf(w, "%8s  %v  %4d  %v\n",
+		humanize.Bytes(uint64(fm.Length)), fm.OID, fm.Revno, ob.Path)
+	return err
+}
+
+func findCommand(ustr string, args []string) {
+	matches, err := newMatcher(*findPat, *findExclude)
+	cbfstool.MaybeFatal(err, "Error parsing match pattern: %v", err)
+
+	w := bufio.NewWriter(os.Stdout)
+	_, err = find(ustr, listPrefix(*findPat), w, matches, *findLong)
+	if err == nil {
+		err = w.Flush()
+	}
+	cbfstool.MaybeFatal(err, "Error listing files: %v", err)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+var restoreGlob = restoreFlags.String("glob", "",
+	"Shell-style glob for paths to match (** spans directories)")
+
+// Translate a shell-style glob into an anchored regular expression.
+// "*" and "?" don't match "/", "**" matches anything (and "**/" any
+// number of whole directories), and [...] is a character class.  A
+// leading "/" is ignored, since backed up paths have none.
+func globRegexp(glob string) (string, error) {
+	glob = strings.TrimLeft(glob, "/")
+	re := &strings.Builder{}
+	re.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			switch {
+			case strings.HasPrefix(glob[i:], "**/"):
+				re.WriteString("(.*/)?")
+				i += 2
+			case strings.HasPrefix(glob[i:], "**"):
+				re.WriteString(".*")
+				i++
+			default:
+				re.WriteString("[^/]*")
+			}
+		case '?':
+			re.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				return "", errors.New("unterminated [ in glob")
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			re.WriteString("[" + class + "]")
+			i += end + 1
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+			}
+			re.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		default:
+			re.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	re.WriteString("$")
+	return re.String(), nil
+}
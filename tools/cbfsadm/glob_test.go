@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestGlob(t *testing.T) {
+	tests := []struct {
+		glob string
+		path string
+		exp  bool
+	}{
+		{"/images/*.jpg", "images/a.jpg", true},
+		{"images/*.jpg", "images/a/b.jpg", false},
+		{"images/*.jpg", "images/a.jpgx", false},
+		{"images/**.jpg", "images/a/b.jpg", true},
+		{"images/**/*.jpg", "images/a.jpg", true},
+		{"images/**/*.jpg", "images/a/b/c.jpg", true},
+		{"**/thumbs/*", "x/y/thumbs/z", true},
+		{"a?c", "abc", true},
+		{"a?c", "a/c", false},
+		{"[ab]x", "bx", true},
+		{"[!ab]x", "bx", false},
+		{"a.b", "axb", false},
+		{`a\*`, "a*", true},
+		{`a\*`, "ab", false},
+	}
+	for _, test := range tests {
+		re, err := globRegexp(test.glob)
+		if err != nil {
+			t.Errorf("Error translating %q: %v", test.glob, err)
+			continue
+		}
+		m, err := newMatcher(re, "")
+		if err != nil {
+			t.Errorf("Error compiling %q (%q): %v", test.glob, re, err)
+			continue
+		}
+		if got := m(test.path); got != test.exp {
+			t.Errorf("Expected %v matching %q against %q (%q)",
+				test.exp, test.path, test.glob, re)
+		}
+	}
+
+	if _, err := globRegexp("[abc"); err == nil {
+		t.Errorf("Expected error on an unterminated class")
+	}
+}
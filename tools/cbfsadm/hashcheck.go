@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"sort"
+	"strings"
+
+	_ "crypto/md5"
+	_ "crypto/sha1"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+
+	"github.com/couchbaselabs/cbfs/config"
+	"github.com/couchbaselabs/cbfs/tools"
+	"github.com/dustin/httputil"
+)
+
+var restoreValidateHash = restoreFlags.Bool("validate-hash-format", false,
+	"Check the backup's hashes suit each cluster's hash algorithm first "+
+		"(refusing a mismatch without -f)")
+
+// How many backed up hashes -validate-hash-format looks at.
+const hashSampleSize = 100
+
+// The length of a hex digest from each hash algorithm the server
+// supports.
+var hashHexLen = map[string]int{
+	"md4":       32,
+	"md5":       32,
+	"sha1":      40,
+	"sha224":    56,
+	"sha256":    64,
+	"sha384":    96,
+	"sha512":    128,
+	"ripemd160": 40,
+}
+
+// The algorithms this tool can compute digests with.  The server also
+// supports md4 and ripemd160, which aren't in the standard library.
+var hashDigests = map[string]crypto.Hash{
+	"md5":    crypto.MD5,
+	"sha1":   crypto.SHA1,
+	"sha224": crypto.SHA224,
+	"sha256": crypto.SHA256,
+	"sha384": crypto.SHA384,
+	"sha512": crypto.SHA512,
+}
+
+// Start a digest with the named algorithm, as the server's config
+// names them.
+func newDigest(alg string) (hash.Hash, error) {
+	h, ok := hashDigests[alg]
+	switch {
+	case ok && h.Available():
+		return h.New(), nil
+	case hashHexLen[alg] > 0:
+		return nil, fmt.Errorf("hash algorithm %q isn't supported by this tool", alg)
+	}
+	return nil, fmt.Errorf("unknown hash algorithm %q", alg)
+}
+
+// Find the hash algorithm the cluster at base is configured with.
+func clusterHash(ctx context.Context, base string) (string, error) {
+	u := cbfstool.ClusterURL(base, "/.cbfs/config/")
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	res, err := restoreClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return "", httputil.HTTPErrorf(res, "error fetching config: %S\n%B")
+	}
+
+	conf := cbfsconfig.CBFSConfig{}
+	if err := json.NewDecoder(res.Body).Decode(&conf); err != nil {
+		return "", err
+	}
+	return conf.Hash, nil
+}
+
+// Collect the hashes of up to n matching files from the start of the
+// first backup segment.
+func sampleOIDs(segs []string, key []byte, matches func(string) bool,
+	n int) ([]string, error) {
+
+	if len(segs) == 0 {
+		return nil, nil
+	}
+	if segs[0] == "-" {
+		return nil, errors.New("can't sample stdin before restoring it")
+	}
+	if restoreQuarantine != nil {
+		defer func(q *quarantine) { restoreQuarantine = q }(restoreQuarantine)
+		restoreQuarantine = &quarantine{}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan restoreWorkItem)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- readBackup(ctx, segs[0], key, matches, nil, &restoreStats{}, ch)
+		close(ch)
+	}()
+
+	var oids []string
+	for ob := range ch {
+		if fm, err := parseMeta(ob.Meta); err == nil && fm.OID != "" {
+			oids = append(oids, fm.OID)
+		}
+		if len(oids) == n {
+			cancel()
+			break
+		}
+	}
+	for range ch {
+	}
+	if err := <-errc; err != nil && ctx.Err() == nil {
+		return oids, err
+	}
+	return oids, nil
+}
+
+// Check that the hashes in oids look like the output of the named
+// algorithm, judging by their length.
+func checkHashFormat(alg string, oids []string) error {
+	want, ok := hashHexLen[alg]
+	if !ok {
+		return fmt.Errorf("unknown hash algorithm %q", alg)
+	}
+	bad := map[int]int{}
+	for _, oid := range oids {
+		if len(oid) != want {
+			bad[len(oid)]++
+		}
+	}
+	if len(bad) == 0 {
+		return nil
+	}
+
+	var algs []string
+	for name, l := range hashHexLen {
+		if _, ok := bad[l]; ok {
+			algs = append(algs, name)
+		}
+	}
+	sort.Strings(algs)
+	n := 0
+	for _, c := range bad {
+		n += c
+	}
+	if len(algs) == 0 {
+		algs = []string{"unknown"}
+	}
+	return fmt.Errorf("%v of %v sampled hashes don't look like %v "+
+		"(they look like %v)", n, len(oids), alg, strings.Join(algs, " or "))
+}
+
+// Compare the hashes at the start of the backup with the hash
+// algorithm of each target.
+func validateHashFormat(ctx context.Context, targets, segs []string,
+	key []byte, matches func(string) bool) error {
+
+	oids, err := sampleOIDs(segs, key, matches, hashSampleSize)
+	if err != nil {
+		return fmt.Errorf("error sampling backup hashes: %v", err)
+	}
+	for _, t := range targets {
+		alg, err := clusterHash(ctx, t)
+		if err != nil {
+			return fmt.Errorf("error checking the hash algorithm of %v: %v",
+				t, err)
+		}
+		if err := checkHashFormat(alg, oids); err != nil {
+			return fmt.Errorf("%v: %v", t, err)
+		}
+	}
+	return nil
+}
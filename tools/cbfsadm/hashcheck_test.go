@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestCheckHashFormat(t *testing.T) {
+	sha1 := strings.Repeat("a", 40)
+	sha256 := strings.Repeat("b", 64)
+	tests := []struct {
+		alg  string
+		oids []string
+		err  string
+	}{
+		{"sha1", []string{sha1, sha1}, ""},
+		{"sha1", nil, ""},
+		{"sha256", []string{sha256, sha1}, "1 of 2 sampled hashes don't look " +
+			"like sha256 (they look like ripemd160 or sha1)"},
+		{"sha1", []string{"abc"}, "(they look like unknown)"},
+		{"whirlpool", []string{sha1}, "unknown hash algorithm"},
+	}
+	for _, test := range tests {
+		err := checkHashFormat(test.alg, test.oids)
+		if (err == nil) != (test.err == "") ||
+			(err != nil && !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("Expected %q for %v %v, got %v",
+				test.err, test.alg, test.oids, err)
+		}
+	}
+}
+
+// A restore into a cluster whose hashes can't match the backup's is
+// refused unless forced.
+func TestRestoreValidateHash(t *testing.T) {
+	posts := int64(0)
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			if req.URL.Path == "/.cbfs/config/" {
+				w.Write([]byte(`{"hash": "sha256"}`))
+				return
+			}
+			atomic.AddInt64(&posts, 1)
+			w.WriteHeader(201)
+		}))
+	defer ts.Close()
+
+	fn := filepath.Join(t.TempDir(), "backup.json")
+	backup := ""
+	for i := 0; i < 3; i++ {
+		backup += fmt.Sprintf(`{"path": "f%v", "meta": {"oid": "%040d"}}`+"\n", i, i)
+	}
+	if err := ioutil.WriteFile(fn, []byte(backup), 0644); err != nil {
+		t.Fatalf("Error writing backup: %v", err)
+	}
+
+	defer func(v, f, q bool) {
+		*restoreValidateHash, *restoreForce, *restoreQuiet = v, f, q
+	}(*restoreValidateHash, *restoreForce, *restoreQuiet)
+	*restoreValidateHash, *restoreQuiet = true, true
+
+	_, err := restore(context.Background(), context.Background(), ts.URL, fn)
+	if err == nil || !strings.Contains(err.Error(), "look like sha256") {
+		t.Errorf("Expected a hash format error, got %v", err)
+	}
+	if posts != 0 {
+		t.Errorf("Expected nothing restored, got %v requests", posts)
+	}
+
+	*restoreForce = true
+	stats, err := restore(context.Background(), context.Background(), ts.URL, fn)
+	if err != nil || stats.Restored != 3 {
+		t.Errorf("Expected 3 files restored with -f, got %v (%v)",
+			stats.Restored, err)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var restoreHook = restoreFlags.String("hook", "",
+	"Shell command to run with the restore's counts in $CBFS_RESTORE_* "+
+		"every -hook-interval files and at the end")
+var restoreHookInterval = restoreFlags.Int64("hook-interval", 0,
+	"Run the -hook after this many files each (0 for only at the end)")
+
+// Runs the -hook command as files are restored.  Runs are one at a
+// time, in the background; if the command is still running when the
+// next interval passes, that run is skipped, so a slow hook never
+// holds up the restore.
+//
+// All methods are safe to call on a nil runner and do nothing.
+type hookRunner struct {
+	cmd   string
+	every int64
+
+	next    int64
+	running sync.WaitGroup
+	busy    int32
+}
+
+// A runner for the -hook command, nil without one.
+func newHookRunner(cmd string, every int64) *hookRunner {
+	if cmd == "" {
+		return nil
+	}
+	return &hookRunner{cmd: cmd, every: every, next: every}
+}
+
+// Note the restore's progress, running the hook in the background if
+// another interval has passed.
+func (h *hookRunner) progress(stats *restoreStats) {
+	if h == nil || h.every <= 0 || doneCount(stats) < h.next {
+		return
+	}
+	for h.next <= doneCount(stats) {
+		h.next += h.every
+	}
+	if !atomic.CompareAndSwapInt32(&h.busy, 0, 1) {
+		mainLog.Infof("Skipping the hook, which is still running")
+		return
+	}
+	env := hookEnv(stats, false)
+	h.running.Add(1)
+	go func() {
+		defer h.running.Done()
+		defer atomic.StoreInt32(&h.busy, 0)
+		h.run(env)
+	}()
+}
+
+// Run the hook a last time, once any run in progress has finished.
+func (h *hookRunner) finish(stats *restoreStats) {
+	if h == nil {
+		return
+	}
+	h.running.Wait()
+	h.run(hookEnv(stats, true))
+}
+
+// The files the restore is done with, however it went.
+func doneCount(stats *restoreStats) int64 {
+	return atomic.LoadInt64(&stats.Restored) +
+		atomic.LoadInt64(&stats.Unchanged) +
+		atomic.LoadInt64(&stats.Skipped) +
+		atomic.LoadInt64(&stats.Failed)
+}
+
+// The environment a hook runs with: this process's, plus the counts.
+func hookEnv(stats *restoreStats, final bool) []string {
+	vars := []struct {
+		name string
+		v    interface{}
+	}{
+		{"DONE", doneCount(stats)},
+		{"SEEN", atomic.LoadInt64(&stats.Seen)},
+		{"MATCHED", atomic.LoadInt64(&stats.Matched)},
+		{"RESTORED", atomic.LoadInt64(&stats.Restored)},
+		{"UNCHANGED", atomic.LoadInt64(&stats.Unchanged)},
+		{"SKIPPED", atomic.LoadInt64(&stats.Skipped)},
+		{"FAILED", atomic.LoadInt64(&stats.Failed)},
+		{"BYTES", atomic.LoadInt64(&stats.RestoredBytes)},
+		{"FINAL", final},
+	}
+	env := os.Environ()
+	for _, v := range vars {
+		env = append(env, fmt.Sprintf("CBFS_RESTORE_%v=%v", v.name, v.v))
+	}
+	return env
+}
+
+// Run the hook command with env, logging its output and how it
+// exited.
+func (h *hookRunner) run(env []string) {
+	var c *exec.Cmd
+	if runtime.GOOS == "windows" {
+		c = exec.Command("cmd", "/C", h.cmd)
+	} else {
+		c = exec.Command("sh", "-c", h.cmd)
+	}
+	c.Env = env
+	out, err := c.CombinedOutput()
+	for _, line := range strings.Split(string(bytes.TrimRight(out, "\n")), "\n") {
+		if line != "" {
+			mainLog.Printf("hook: %v", line)
+		}
+	}
+	if err != nil {
+		mainLog.Printf("Error running hook %q: %v", h.cmd, err)
+	}
+}
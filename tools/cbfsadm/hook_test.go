@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestRestoreHook(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the hook is a sh command")
+	}
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			if strings.HasSuffix(req.URL.Path, "/bad") {
+				http.Error(w, "no", 400)
+				return
+			}
+			w.WriteHeader(201)
+		}))
+	defer ts.Close()
+
+	fn := writeTestBackup(t, "a", "b", "c", "d", "e", "bad")
+	defer os.Remove(fn)
+	out := filepath.Join(t.TempDir(), "hook.out")
+
+	defer func(h string, i int64) {
+		*restoreHook, *restoreHookInterval = h, i
+	}(*restoreHook, *restoreHookInterval)
+	*restoreHook = `echo "$CBFS_RESTORE_DONE $CBFS_RESTORE_RESTORED ` +
+		`$CBFS_RESTORE_FAILED $CBFS_RESTORE_FINAL" >> ` + out +
+		`; echo said hello; exit 3`
+	*restoreHookInterval = 2
+
+	buf := &bytes.Buffer{}
+	restoreLog.SetOutput(buf)
+	defer restoreLog.SetOutput(os.Stderr)
+
+	if _, err := restore(context.Background(), context.Background(),
+		ts.URL, fn); err != nil {
+		t.Fatalf("Error restoring: %v", err)
+	}
+
+	b, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatalf("Expected the hook to have run: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if last := lines[len(lines)-1]; last != "6 5 1 true" {
+		t.Errorf("Expected the last run to have the final counts, got %q", last)
+	}
+	for _, l := range lines[:len(lines)-1] {
+		if !strings.HasSuffix(l, " false") {
+			t.Errorf("Expected only the last run to be final, got %q", l)
+		}
+	}
+
+	log := buf.String()
+	for _, exp := range []string{"hook: said hello", "exit status 3"} {
+		if !strings.Contains(log, exp) {
+			t.Errorf("Expected %q logged, got:\n%v", exp, log)
+		}
+	}
+}
+
+func TestHookRunnerInterval(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the hook is a sh command")
+	}
+	out := filepath.Join(t.TempDir(), "hook.out")
+	h := newHookRunner(`echo "$CBFS_RESTORE_DONE" >> `+out, 5)
+	stats := &restoreStats{}
+	for i := 0; i < 12; i++ {
+		stats.Restored++
+		h.progress(stats)
+		// Let each run finish, so none is skipped.
+		h.running.Wait()
+	}
+	h.finish(stats)
+
+	b, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatalf("Expected the hook to have run: %v", err)
+	}
+	if got := string(b); got != "5\n10\n12\n" {
+		t.Errorf("Expected runs at 5, 10 and the end, got %q", got)
+	}
+
+	var none *hookRunner
+	none.progress(stats)
+	none.finish(stats)
+}
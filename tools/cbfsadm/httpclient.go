@@ -0,0 +1,213 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/couchbaselabs/cbfs/tools"
+)
+
+var restoreHTTP2 = restoreFlags.Bool("http2", true,
+	"Use HTTP/2 with TLS servers that support it")
+
+// Headers sent with every request, from repeated -header flags.
+type headerFlag http.Header
+
+func (h headerFlag) String() string {
+	s := []string{}
+	for k, vs := range h {
+		for _, v := range vs {
+			s = append(s, k+": "+v)
+		}
+	}
+	return strings.Join(s, ", ")
+}
+
+func (h headerFlag) Set(s string) error {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 {
+		return errors.New(`must be of the form "Name: value"`)
+	}
+	name, value := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+	if name == "" || strings.IndexFunc(name, notTokenChar) >= 0 {
+		return fmt.Errorf("invalid header name %q", name)
+	}
+	if strings.ContainsAny(value, "\r\n") {
+		return fmt.Errorf("invalid value for header %v", name)
+	}
+	http.Header(h).Add(name, value)
+	return nil
+}
+
+// True for characters that can't appear in a header name.
+func notTokenChar(r rune) bool {
+	return r <= ' ' || r >= 0x7f || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, r)
+}
+
+var extraHeaders = headerFlag{}
+
+// A -proxy URL.
+type proxyFlag struct {
+	u *url.URL
+}
+
+func (p *proxyFlag) String() string {
+	if p.u == nil {
+		return ""
+	}
+	return p.u.String()
+}
+
+func (p *proxyFlag) Set(s string) error {
+	u, err := url.Parse(s)
+	if err != nil {
+		return err
+	}
+	switch {
+	case u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "socks5":
+		return fmt.Errorf("unsupported proxy scheme in %q", s)
+	case u.Host == "":
+		return fmt.Errorf("no host in proxy URL %q", s)
+	}
+	p.u = u
+	return nil
+}
+
+var proxyOverride proxyFlag
+var noProxy bool
+
+func init() {
+	for _, fs := range []*flag.FlagSet{restoreFlags, exportFlags, backupFlags} {
+		fs.Var(extraHeaders, "header",
+			`Send this "Name: value" header with every request to the `+
+				`cluster (repeatable)`)
+		fs.Var(&proxyOverride, "proxy",
+			"Send requests through this proxy instead of $HTTP_PROXY's")
+		fs.BoolVar(&noProxy, "no-proxy", false,
+			"Connect directly, ignoring -proxy and $HTTP_PROXY")
+	}
+}
+
+// Pick the proxy for req: none with -no-proxy, the -proxy one if
+// given, or else whatever the environment says.
+func proxyFor(req *http.Request) (*url.URL, error) {
+	switch {
+	case noProxy:
+		return nil, nil
+	case proxyOverride.u != nil:
+		return proxyOverride.u, nil
+	}
+	return http.ProxyFromEnvironment(req)
+}
+
+// The hosts of the clusters named on the command line, the only ones
+// sent the -header headers.  Anything else, such as the server a
+// backup is downloaded from, mustn't see a cluster's credentials.
+var headerHosts = struct {
+	sync.Mutex
+	m map[string]bool
+}{m: map[string]bool{}}
+
+// Send the -header headers to the hosts of these cluster URLs.
+func sendHeadersTo(urls ...string) {
+	headerHosts.Lock()
+	defer headerHosts.Unlock()
+	for _, s := range urls {
+		if u, err := url.Parse(s); err == nil && u.Host != "" {
+			headerHosts.m[u.Host] = true
+		}
+	}
+}
+
+func sendsHeadersTo(host string) bool {
+	headerHosts.Lock()
+	defer headerHosts.Unlock()
+	return headerHosts.m[host]
+}
+
+// Adds the -header headers to every request to a cluster given to
+// sendHeadersTo.  A nil rt means defaultTransport().
+type headerTransport struct {
+	rt http.RoundTripper
+}
+
+func (t headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt := t.rt
+	if rt == nil {
+		rt = defaultTransport()
+	}
+	if len(extraHeaders) == 0 || !sendsHeadersTo(req.URL.Host) {
+		return rt.RoundTrip(req)
+	}
+	req = req.Clone(req.Context())
+	for k, vs := range extraHeaders {
+		req.Header[k] = append(req.Header[k], vs...)
+	}
+	return rt.RoundTrip(req)
+}
+
+// A client like http.DefaultClient, but sending the -header headers
+// and using the proxy and TLS flags.
+var headerClient = &http.Client{Transport: headerTransport{}}
+
+// Like headerClient, but never sending the -header headers, for
+// fetching backups from wherever they're served.
+var plainClient = &http.Client{Transport: plainTransport{}}
+
+// defaultTransport(), made on first use.
+type plainTransport struct{}
+
+func (plainTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return defaultTransport().RoundTrip(req)
+}
+
+var defaultTransportOnce sync.Once
+var defaultRT *http.Transport
+
+// http.DefaultTransport, using the proxy flags.  It's made on first
+// use, after the command line (and so any TLS flags) has been parsed.
+func defaultTransport() *http.Transport {
+	defaultTransportOnce.Do(func() {
+		defaultRT = http.DefaultTransport.(*http.Transport).Clone()
+		defaultRT.Proxy = proxyFor
+	})
+	return defaultRT
+}
+
+// The client used for restore requests, configured by restoreCommand.
+var restoreClient = headerClient
+
+// Build an HTTP client that keeps up to conns connections alive for
+// reuse.  A zero timeout means requests never time out.  Unless
+// http2 is false, HTTP/2 is negotiated with TLS servers, multiplexing
+// requests over a single connection.  Requests go through the proxy
+// proxyFor picks, with the TLS settings of the global -cacert, -cert,
+// -key and -insecure flags.
+func newHTTPClient(timeout time.Duration, conns int, http2 bool) *http.Client {
+	t := &http.Transport{
+		Proxy: proxyFor,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:   http2,
+		MaxIdleConns:        conns * 2,
+		MaxIdleConnsPerHost: conns,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+		TLSClientConfig:     cbfstool.TLSConfig().Clone(),
+	}
+	if !http2 {
+		// A non-nil empty map is what turns HTTP/2 off entirely.
+		t.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	return &http.Client{Timeout: timeout, Transport: headerTransport{t}}
+}
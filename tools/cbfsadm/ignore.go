@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+var restoreIgnoreFile = restoreFlags.String("ignore-file", "",
+	"Skip paths matching the gitignore-style patterns in this file")
+
+type ignoreRule struct {
+	re     *regexp.Regexp
+	negate bool
+}
+
+// Parse gitignore-style patterns from r, one per line, into a function
+// reporting whether a path is ignored.  Blank lines and lines starting
+// with "#" are skipped, and the last pattern matching a path decides:
+// a "!" prefix re-includes what earlier patterns ignored.  A pattern
+// without a "/" (other than a trailing one) matches at any depth, and
+// one ending in "/" matches only what's under that directory.
+func parseIgnore(r io.Reader) (func(string) bool, error) {
+	var rules []ignoreRule
+	s := bufio.NewScanner(r)
+	for line := 1; s.Scan(); line++ {
+		p := strings.TrimRight(s.Text(), " \t\r")
+		if p == "" || strings.HasPrefix(p, "#") {
+			continue
+		}
+		rule := ignoreRule{}
+		if strings.HasPrefix(p, "!") {
+			rule.negate, p = true, p[1:]
+		}
+		dirOnly := strings.HasSuffix(p, "/")
+		p = strings.TrimRight(p, "/")
+		if !strings.Contains(p, "/") {
+			p = "**/" + p
+		}
+
+		re, err := globRegexp(p)
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %v", line, err)
+		}
+		// Match the path itself or anything under it.
+		re = strings.TrimSuffix(re, "$")
+		if dirOnly {
+			re += "/.*$"
+		} else {
+			re += "(/.*)?$"
+		}
+		if rule.re, err = regexp.Compile(re); err != nil {
+			return nil, fmt.Errorf("line %v: %v", line, err)
+		}
+		rules = append(rules, rule)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	return func(path string) bool {
+		ignored := false
+		for _, r := range rules {
+			if r.re.MatchString(path) {
+				ignored = !r.negate
+			}
+		}
+		return ignored
+	}, nil
+}
+
+// Read the patterns in fn with parseIgnore.
+func loadIgnoreFile(fn string) (func(string) bool, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseIgnore(f)
+}
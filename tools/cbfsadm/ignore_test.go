@@ -0,0 +1,48 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIgnore(t *testing.T) {
+	ignored, err := parseIgnore(strings.NewReader(`# comments and blank lines
+
+*.tmp
+!keep.tmp
+/build
+cache/
+docs/*.pdf
+\#literal
+`))
+	if err != nil {
+		t.Fatalf("Error parsing patterns: %v", err)
+	}
+
+	tests := []struct {
+		path string
+		exp  bool
+	}{
+		{"a.tmp", true},
+		{"x/y/a.tmp", true},
+		{"x/keep.tmp", false},
+		{"a.tmpx", false},
+		{"build", true},
+		{"build/out", true},
+		{"src/build", false},
+		{"cache", false},
+		{"cache/a", true},
+		{"x/cache/a", true},
+		{"docs/a.pdf", true},
+		{"docs/sub/a.pdf", false},
+		{"x/docs/a.pdf", false},
+		{"#literal", true},
+		{"# comments and blank lines", false},
+		{"src/main.go", false},
+	}
+	for _, test := range tests {
+		if got := ignored(test.path); got != test.exp {
+			t.Errorf("Expected ignored(%q) = %v", test.path, test.exp)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/dustin/httputil"
+	"github.com/klauspost/compress/zstd"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// Open a backup for reading.  "-" reads from stdin and http(s) URLs
+// are streamed straight from the server, without the -header headers
+// meant for the cluster.
+func openBackup(fn string) (io.ReadCloser, error) {
+	switch {
+	case fn == "-":
+		return ioutil.NopCloser(os.Stdin), nil
+	case strings.HasPrefix(fn, "http://"), strings.HasPrefix(fn, "https://"):
+		res, err := plainClient.Get(fn)
+		if err != nil {
+			return nil, err
+		}
+		if res.StatusCode != 200 {
+			defer res.Body.Close()
+			return nil, httputil.HTTPErrorf(res, "error fetching %v: %S\n%B", fn)
+		}
+		return res.Body, nil
+	}
+	return os.Open(fn)
+}
+
+// Expand fn to the backup files it names, in the order they should
+// be read.  The base name of a split backup or a directory holding
+// its segments (files named <base>.NNN, as export -split writes them)
+// read them all, and a glob may name them directly; anything else is
+// a single backup.
+func backupSegments(fn string) ([]string, error) {
+	if fn == "-" || strings.HasPrefix(fn, "http://") ||
+		strings.HasPrefix(fn, "https://") {
+		return []string{fn}, nil
+	}
+
+	var segs []string
+	if fi, err := os.Stat(fn); err == nil {
+		if !fi.IsDir() {
+			return []string{fn}, nil
+		}
+		infos, err := ioutil.ReadDir(fn)
+		if err != nil {
+			return nil, err
+		}
+		// Only numbered segments: not a deadletter file, a README or
+		// the temporary file of an export still being written.
+		for _, fi := range infos {
+			if _, n := splitSegment(fi.Name()); n >= 0 && fi.Mode().IsRegular() {
+				segs = append(segs, filepath.Join(fn, fi.Name()))
+			}
+		}
+		if len(segs) == 0 {
+			return nil, fmt.Errorf("no backup segments in %v", fn)
+		}
+	} else {
+		pattern := fn
+		if _, err := os.Stat(segmentName(fn, 0)); err == nil {
+			// The base name of a split backup.
+			pattern = fn + ".[0-9]*"
+		}
+		segs, err = filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		if len(segs) == 0 {
+			// Not a pattern (or matching nothing); let opening
+			// it report the problem.
+			return []string{fn}, nil
+		}
+	}
+
+	sort.Slice(segs, func(i, j int) bool {
+		return segmentLess(segs[i], segs[j])
+	})
+	return segs, nil
+}
+
+// Order segment names by their numeric suffix so backup.1000 comes
+// after backup.999.
+func segmentLess(a, b string) bool {
+	ab, an := splitSegment(a)
+	bb, bn := splitSegment(b)
+	if ab != bb || an < 0 || bn < 0 {
+		return a < b
+	}
+	return an < bn
+}
+
+func splitSegment(fn string) (string, int) {
+	i := strings.LastIndexByte(fn, '.')
+	if i < 0 {
+		return fn, -1
+	}
+	n, err := strconv.Atoi(fn[i+1:])
+	if err != nil || n < 0 {
+		return fn, -1
+	}
+	return fn[:i], n
+}
+
+// Wrap a backup stream in the decompressor indicated by its magic
+// bytes.  Streams that are neither gzip nor zstd are assumed to be
+// plain JSON.
+func decompress(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(zstdMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		// Concatenated archives (cat a.gz b.gz) are one stream
+		// of every member's records.
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		gz.Multistream(true)
+		return gz, nil
+	case bytes.HasPrefix(magic, zstdMagic):
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	}
+	return ioutil.NopCloser(br), nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import "sync/atomic"
+
+var restoreLimit = restoreFlags.Int64("limit", 0,
+	"Stop reading the backup after this many matching entries "+
+		"(0 for no limit), as a quick check before a full restore")
+
+// Stops a restore's reading after a number of matched entries.  Safe
+// to use from several readers at once.
+//
+// All methods are safe to call on a nil entryLimit, which never
+// stops anything.
+type entryLimit struct {
+	n       int64
+	matched int64
+	stop    func()
+}
+
+// The limit for -limit, calling stop once it's reached.  Nil if
+// there's no limit.
+func newEntryLimit(stop func()) *entryLimit {
+	if *restoreLimit <= 0 {
+		return nil
+	}
+	return &entryLimit{n: *restoreLimit, stop: stop}
+}
+
+// Wrap matches so that nothing matches past the limit.
+func (l *entryLimit) wrap(matches func(string) bool) func(string) bool {
+	if l == nil {
+		return matches
+	}
+	return func(p string) bool {
+		if !matches(p) {
+			return false
+		}
+		if atomic.AddInt64(&l.matched, 1) > l.n {
+			l.stop()
+			return false
+		}
+		return true
+	}
+}
+
+// True if the limit stopped the reading.
+func (l *entryLimit) reached() bool {
+	return l != nil && atomic.LoadInt64(&l.matched) > l.n
+}
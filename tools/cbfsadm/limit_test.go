@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRestoreLimit(t *testing.T) {
+	mu := sync.Mutex{}
+	restored := []string{}
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			restored = append(restored,
+				strings.TrimPrefix(req.URL.Path, "/.cbfs/backup/restore/"))
+			w.WriteHeader(201)
+		}))
+	defer ts.Close()
+
+	paths := []string{}
+	for i := 0; i < 1000; i++ {
+		paths = append(paths, fmt.Sprintf("%v/f%03d", []string{"x", "y"}[i%2], i))
+	}
+	fn := writeTestBackup(t, paths...)
+	defer os.Remove(fn)
+
+	defer func(l int64, m string, n int) {
+		*restoreLimit, *restorePat, *restoreInputWorkers = l, m, n
+	}(*restoreLimit, *restorePat, *restoreInputWorkers)
+	*restoreLimit, *restorePat = 3, "^y/"
+
+	stats, err := restore(context.Background(), context.Background(),
+		ts.URL, fn)
+	if err != nil {
+		t.Fatalf("Error restoring: %v", err)
+	}
+	sort.Strings(restored)
+	if exp := []string{"y/f001", "y/f003", "y/f005"}; !reflect.DeepEqual(restored, exp) {
+		t.Errorf("Expected %v restored, got %v", exp, restored)
+	}
+	if stats.Matched != 3 || stats.Seen > 100 {
+		t.Errorf("Expected reading to stop after 3 matches, got %+v", *stats)
+	}
+
+	*restoreInputWorkers = 2
+	_, err = restore(context.Background(), context.Background(), ts.URL, fn)
+	if err == nil || !strings.Contains(err.Error(), "-input-workers") {
+		t.Errorf("Expected -limit with -input-workers refused, got %v", err)
+	}
+}
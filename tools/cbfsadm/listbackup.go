@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/couchbaselabs/cbfs/tools"
+)
+
+var listFlags = flag.NewFlagSet("list-backup", flag.ExitOnError)
+var listPat = listFlags.String("match", ".*", "Regex for paths to list")
+var listExclude = listFlags.String("exclude", "",
+	"Regex for paths to skip (wins over -match)")
+var listLong = listFlags.Bool("l", false,
+	"Long format (size, hash, revision and path)")
+var listKeyfile = listFlags.String("keyfile", "",
+	"Key for encrypted backups (default $CBFS_BACKUP_KEY)")
+
+// Stream the entries of the backup fn matching matches, until ctx is
+// done.  The error channel gets the outcome once the entries are
+// closed.
+func streamBackup(ctx context.Context, fn string, key []byte,
+	matches func(string) bool) (<-chan restoreWorkItem, <-chan error) {
+
+	ch := make(chan restoreWorkItem, 64)
+	errc := make(chan error, 1)
+	go func() {
+		defer close(ch)
+		segs, err := backupSegments(fn)
+		if err != nil {
+			errc <- fmt.Errorf("Error finding backup files: %v", err)
+			return
+		}
+		for _, seg := range segs {
+			err := readBackup(ctx, seg, key, matches, nil, &restoreStats{}, ch)
+			if err != nil {
+				errc <- err
+				return
+			}
+		}
+		errc <- nil
+	}()
+	return ch, errc
+}
+
+// Write the paths of the files in the backup fn matching matches to
+// w, without contacting any cluster.  Returns the number of files
+// listed.
+func listBackup(fn string, key []byte, w io.Writer,
+	matches func(string) bool, long bool) (int, error) {
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch, errc := streamBackup(ctx, fn, key, matches)
+
+	n := 0
+	var werr error
+	for ob := range ch {
+		if werr != nil {
+			continue
+		}
+		if werr = writeEntry(w, ob, long); werr != nil {
+			cancel()
+			continue
+		}
+		n++
+	}
+	if werr != nil {
+		return n, werr
+	}
+	return n, <-errc
+}
+
+func listBackupCommand(ustr string, args []string) {
+	matches, err := newMatcher(*listPat, *listExclude)
+	cbfstool.MaybeFatal(err, "Error parsing match pattern: %v", err)
+
+	key, err := loadBackupKey(*listKeyfile)
+	cbfstool.MaybeFatal(err, "Error loading backup key: %v", err)
+
+	w := bufio.NewWriter(os.Stdout)
+	_, err = listBackup(listFlags.Arg(0), key, w, matches, *listLong)
+	if err == nil {
+		err = w.Flush()
+	}
+	cbfstool.MaybeFatal(err, "Error listing backup: %v", err)
+}
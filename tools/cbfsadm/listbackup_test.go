@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func TestListBackup(t *testing.T) {
+	fn := writeTestBackup(t, "a/x", "b/y", "a/z")
+	defer os.Remove(fn)
+
+	matches, err := newMatcher("^a/", "")
+	if err != nil {
+		t.Fatalf("Error building matcher: %v", err)
+	}
+
+	tests := []struct {
+		long bool
+		exp  string
+	}{
+		{false, "a/x\na/z\n"},
+		{true, "     0 B  abc     0  a/x\n     0 B  abc     0  a/z\n"},
+	}
+	for _, test := range tests {
+		buf := &bytes.Buffer{}
+		n, err := listBackup(fn, nil, buf, matches, test.long)
+		if err != nil {
+			t.Fatalf("Error listing: %v", err)
+		}
+		if n != 2 || buf.String() != test.exp {
+			t.Errorf("Expected 2 results %q, got %v %q",
+				test.exp, n, buf.String())
+		}
+	}
+
+	if _, err := listBackup(fn+".missing", nil, &bytes.Buffer{}, matches,
+		false); err == nil {
+		t.Errorf("Expected an error listing a missing backup")
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var restoreQuiet = restoreFlags.Bool("quiet", false,
+	"Only log warnings, errors and the final summary")
+var restoreLogJSON = restoreFlags.Bool("log-json", false,
+	"Log each event as a single line JSON object")
+
+// All restore output goes through restoreLog, which serializes lines
+// from concurrent workers.
+var restoreLog = log.New(os.Stderr, "", log.LstdFlags|log.Lmicroseconds)
+
+// Serializes -log-json lines, which bypass restoreLog's formatting.
+var jsonLogMu sync.Mutex
+
+// A line of -log-json output.
+type logEntry struct {
+	TS     time.Time `json:"ts"`
+	Level  string    `json:"level"`
+	Worker string    `json:"worker,omitempty"`
+	Path   string    `json:"path,omitempty"`
+	Status string    `json:"status,omitempty"`
+	Error  string    `json:"error,omitempty"`
+	Msg    string    `json:"msg,omitempty"`
+	// How many failures like this one weren't logged.
+	Repeated int           `json:"repeated,omitempty"`
+	Summary  *restoreStats `json:"summary,omitempty"`
+}
+
+// Logs lines for one restore worker, prefixed with its id.
+type workerLog string
+
+// The log for anything not done by a worker.
+const mainLog workerLog = ""
+
+type workerLogKey struct{}
+
+// Attach the log for worker id to ctx.
+func withWorkerLog(ctx context.Context, id int) context.Context {
+	return withLogPrefix(ctx, fmt.Sprintf("[w%d] ", id))
+}
+
+// Attach a log whose lines are prefixed with the name of a target
+// cluster, for restores to more than one.
+func withTargetLog(ctx context.Context, name string) context.Context {
+	return withLogPrefix(ctx, fmt.Sprintf("[%v] ", name))
+}
+
+func withLogPrefix(ctx context.Context, prefix string) context.Context {
+	return context.WithValue(ctx, workerLogKey{}, logFor(ctx)+workerLog(prefix))
+}
+
+// The log of the worker handling ctx, unprefixed outside a worker.
+func logFor(ctx context.Context) workerLog {
+	l, _ := ctx.Value(workerLogKey{}).(workerLog)
+	return l
+}
+
+// Write e, either as JSON or as a line of text.
+func (l workerLog) log(e logEntry) {
+	if !*restoreLogJSON {
+		restoreLog.Output(3, string(l)+e.Msg)
+		return
+	}
+	e.TS = time.Now().UTC()
+	e.Worker = strings.TrimSpace(string(l))
+	b, err := json.Marshal(e)
+	if err != nil {
+		b, _ = json.Marshal(logEntry{TS: e.TS, Level: "error", Msg: err.Error()})
+	}
+	jsonLogMu.Lock()
+	defer jsonLogMu.Unlock()
+	restoreLog.Writer().Write(append(b, '\n'))
+}
+
+// Log an error.
+func (l workerLog) Errorf(format string, args ...interface{}) {
+	l.log(logEntry{Level: "error", Msg: fmt.Sprintf(format, args...)})
+}
+
+// Log a warning.
+func (l workerLog) Printf(format string, args ...interface{}) {
+	l.log(logEntry{Level: "warn", Msg: fmt.Sprintf(format, args...)})
+}
+
+// Log something worth seeing even with -quiet.
+func (l workerLog) Noticef(format string, args ...interface{}) {
+	l.log(logEntry{Level: "info", Msg: fmt.Sprintf(format, args...)})
+}
+
+// Log per-file progress, unless -quiet.
+func (l workerLog) Infof(format string, args ...interface{}) {
+	if !*restoreQuiet {
+		l.log(logEntry{Level: "info", Msg: fmt.Sprintf(format, args...)})
+	}
+}
+
+// Log what happened to path ("restored", "unchanged", "skipped" or
+// "failed").
+// Failures are always logged (or counted, by -repeat-interval), the
+// rest unless -quiet.
+func (l workerLog) Event(status, path string, err error) {
+	e := logEntry{Level: "info", Path: path, Status: status}
+	switch status {
+	case "restored":
+		e.Msg = "Restored " + path
+	case "unchanged":
+		e.Msg = "Unchanged " + path + ", the cluster has it as backed up"
+	case "skipped":
+		e.Msg = "Skipped " + path + ", it exists"
+	default:
+		e.Level, e.Msg = "error", fmt.Sprintf("Error restoring %v: %v", path, err)
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	if e.Level == "info" && *restoreQuiet {
+		return
+	}
+	if e.Level == "error" && !restoreErrors.admit(l, e, path, err) {
+		return
+	}
+	l.log(e)
+}
+
+// Log the final summary of a restore.  As JSON, the full stats are
+// included.
+func (l workerLog) Summary(stats *restoreStats, format string, args ...interface{}) {
+	l.log(logEntry{Level: "info", Status: "summary",
+		Msg: fmt.Sprintf(format, args...), Summary: stats})
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A histogram of durations, safe for concurrent use.
+type latencyHistogram struct {
+	// Upper bounds of the buckets, in seconds, ascending.  There's
+	// a final bucket for anything longer.
+	bounds   []float64
+	counts   []int64
+	sumNanos int64
+}
+
+func newLatencyHistogram(bounds ...float64) *latencyHistogram {
+	return &latencyHistogram{bounds: bounds,
+		counts: make([]int64, len(bounds)+1)}
+}
+
+func (h *latencyHistogram) observe(d time.Duration) {
+	i := 0
+	for i < len(h.bounds) && d.Seconds() > h.bounds[i] {
+		i++
+	}
+	atomic.AddInt64(&h.counts[i], 1)
+	atomic.AddInt64(&h.sumNanos, int64(d))
+}
+
+// Write h as the OpenMetrics histogram name.
+func (h *latencyHistogram) write(w io.Writer, name, help string) {
+	fmt.Fprintf(w, "# TYPE %v histogram\n# HELP %v %v\n", name, name, help)
+	n := int64(0)
+	for i := range h.counts {
+		n += atomic.LoadInt64(&h.counts[i])
+		le := "+Inf"
+		if i < len(h.bounds) {
+			le = strconv.FormatFloat(h.bounds[i], 'g', -1, 64)
+		}
+		fmt.Fprintf(w, "%v_bucket{le=\"%v\"} %v\n", name, le, n)
+	}
+	fmt.Fprintf(w, "%v_sum %v\n%v_count %v\n", name,
+		time.Duration(atomic.LoadInt64(&h.sumNanos)).Seconds(), name, n)
+}
+
+// How long each file took to restore.
+var restoreLatency = newLatencyHistogram(.005, .01, .025, .05, .1, .25,
+	.5, 1, 2.5, 5, 10)
+
+var (
+	metricsMu    sync.Mutex
+	metricsStats *restoreStats
+)
+
+func init() {
+	http.HandleFunc("/metrics", serveMetrics)
+}
+
+// Write the restore's metrics in OpenMetrics text format.  stats may
+// be nil before a restore starts.
+func writeMetrics(w io.Writer, stats *restoreStats) {
+	if stats == nil {
+		stats = &restoreStats{}
+	}
+	fmt.Fprintf(w, "# TYPE cbfs_restore_files counter\n"+
+		"# HELP cbfs_restore_files Files processed, by outcome.\n")
+	for _, s := range []struct {
+		status string
+		count  *int64
+	}{
+		{"restored", &stats.Restored},
+		{"failed", &stats.Failed},
+		{"unchanged", &stats.Unchanged},
+		{"skipped", &stats.Skipped},
+	} {
+		fmt.Fprintf(w, "cbfs_restore_files_total{status=%q} %v\n",
+			s.status, atomic.LoadInt64(s.count))
+	}
+	fmt.Fprintf(w, "# TYPE cbfs_restore_in_flight gauge\n"+
+		"# HELP cbfs_restore_in_flight Requests in progress.\n"+
+		"cbfs_restore_in_flight %v\n", restoreInflight.Value())
+	restoreLatency.write(w, "cbfs_restore_latency_seconds",
+		"Time taken to restore each file.")
+	fmt.Fprintf(w, "# EOF\n")
+}
+
+func serveMetrics(w http.ResponseWriter, req *http.Request) {
+	metricsMu.Lock()
+	stats := metricsStats
+	metricsMu.Unlock()
+
+	w.Header().Set("Content-Type",
+		"application/openmetrics-text; version=1.0.0; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	writeMetrics(bw, stats)
+	bw.Flush()
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	defer func(h *latencyHistogram) { restoreLatency = h }(restoreLatency)
+	restoreLatency = newLatencyHistogram(.1, 1)
+	for _, d := range []time.Duration{50 * time.Millisecond,
+		100 * time.Millisecond, 500 * time.Millisecond, 3 * time.Second} {
+		restoreLatency.observe(d)
+	}
+
+	buf := &bytes.Buffer{}
+	writeMetrics(buf, &restoreStats{Restored: 5, Failed: 1, Unchanged: 3,
+		Skipped: 2})
+	exp := `# TYPE cbfs_restore_files counter
+# HELP cbfs_restore_files Files processed, by outcome.
+cbfs_restore_files_total{status="restored"} 5
+cbfs_restore_files_total{status="failed"} 1
+cbfs_restore_files_total{status="unchanged"} 3
+cbfs_restore_files_total{status="skipped"} 2
+# TYPE cbfs_restore_in_flight gauge
+# HELP cbfs_restore_in_flight Requests in progress.
+cbfs_restore_in_flight 0
+# TYPE cbfs_restore_latency_seconds histogram
+# HELP cbfs_restore_latency_seconds Time taken to restore each file.
+cbfs_restore_latency_seconds_bucket{le="0.1"} 2
+cbfs_restore_latency_seconds_bucket{le="1"} 3
+cbfs_restore_latency_seconds_bucket{le="+Inf"} 4
+cbfs_restore_latency_seconds_sum 3.65
+cbfs_restore_latency_seconds_count 4
+# EOF
+`
+	if buf.String() != exp {
+		t.Errorf("Expected:\n%v\ngot:\n%v", exp, buf)
+	}
+}
+
+func TestServeMetrics(t *testing.T) {
+	w := httptest.NewRecorder()
+	serveMetrics(w, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct,
+		"application/openmetrics-text") {
+		t.Errorf("Expected OpenMetrics, got %v", ct)
+	}
+	body := w.Body.String()
+	if !strings.Contains(body, `cbfs_restore_files_total{status="restored"}`) ||
+		!strings.HasSuffix(body, "# EOF\n") {
+		t.Errorf("Expected the restore metrics, got %v", body)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+var restoreOnlyMissing = restoreFlags.Bool("only-missing", false,
+	"Only list the paths the cluster doesn't have (no restore is done)")
+var restoreMissingOut = restoreFlags.String("missing-out", "",
+	"Write -only-missing paths to this file instead of stdout")
+
+// The paths found missing by -only-missing, written one per line as
+// the workers find them.
+type missingList struct {
+	mu sync.Mutex
+	w  *bufio.Writer
+	c  io.Closer
+}
+
+// The list written by restore, if -only-missing was given.
+var restoreMissing *missingList
+
+// Start a list written to fn, or stdout if fn is empty.
+func createMissingList(fn string) (*missingList, error) {
+	if fn == "" {
+		return &missingList{w: bufio.NewWriter(os.Stdout),
+			c: nopWriteCloser{}}, nil
+	}
+	f, err := os.Create(fn)
+	if err != nil {
+		return nil, err
+	}
+	return &missingList{w: bufio.NewWriter(f), c: f}, nil
+}
+
+func (m *missingList) add(path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, err := fmt.Fprintln(m.w, path)
+	return err
+}
+
+func (m *missingList) Close() error {
+	err := m.w.Flush()
+	if e := m.c.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// Add path to the missing list if the cluster at base doesn't have
+// it.  Returns errExists if it does.
+func checkMissing(ctx context.Context, base, path string) error {
+	_, err := clusterOID(ctx, base, path)
+	switch err {
+	case nil:
+		return errExists
+	case errNotFound:
+		return restoreMissing.add(path)
+	}
+	return err
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+var restoreOIDOnly = restoreFlags.Bool("oid-only", false,
+	"Read a list of blob OIDs, one per line, instead of a backup, and "+
+		"make sure the cluster has each blob (copying any it's missing "+
+		"from -fetch-from)")
+
+// How the blobs -oid-only was given fared.  Present blobs were
+// already in the cluster, restored ones were copied from -fetch-from,
+// and missing ones are in neither (or there was no -fetch-from).
+type oidStats struct {
+	Seen     int64 `json:"seen"`
+	Present  int64 `json:"present"`
+	Restored int64 `json:"restored"`
+	Missing  int64 `json:"missing"`
+	Failed   int64 `json:"failed"`
+}
+
+type oidFailure struct {
+	OID   string `json:"oid"`
+	Error string `json:"error"`
+}
+
+// The document written by -report for -oid-only.
+type oidReport struct {
+	oidStats
+	RestoredOIDs []string     `json:"restored_oids"`
+	MissingOIDs  []string     `json:"missing_oids"`
+	Failures     []oidFailure `json:"failures"`
+}
+
+// The outcome for one OID.
+type oidResult struct {
+	oid    string
+	status string
+	err    error
+}
+
+// Read the OIDs listed in fn (one per line; blank lines and #
+// comments are ignored), sending them to ch until the list ends or
+// ctx is cancelled.
+func readOIDs(ctx context.Context, fn string, ch chan<- string) error {
+	f, err := openBackup(fn)
+	if err != nil {
+		return fmt.Errorf("Error opening OID list: %v", err)
+	}
+	defer f.Close()
+	r, err := decompress(f)
+	if err != nil {
+		return fmt.Errorf("Error uncompressing %v: %v", fn, err)
+	}
+	defer r.Close()
+
+	s := bufio.NewScanner(r)
+	for s.Scan() && ctx.Err() == nil {
+		oid := strings.TrimSpace(s.Text())
+		if oid == "" || strings.HasPrefix(oid, "#") {
+			continue
+		}
+		select {
+		case ch <- oid:
+		case <-ctx.Done():
+		}
+	}
+	if err := s.Err(); err != nil {
+		return fmt.Errorf("Error reading %v: %v", fn, err)
+	}
+	return nil
+}
+
+// Check the cluster at base for oid, copying it with f (if not nil)
+// when it's missing.
+func restoreOID(ctx context.Context, base string, f *blobFetcher,
+	oid string) oidResult {
+
+	if f == nil {
+		nodes, err := blobNodes(ctx, base, oid)
+		switch {
+		case err != nil:
+			return oidResult{oid, "failed", err}
+		case len(nodes) == 0:
+			return oidResult{oid, "missing", nil}
+		}
+		return oidResult{oid, "present", nil}
+	}
+
+	copied, err := f.ensureBlob(ctx, oid)
+	if _, ok := err.(noSourceError); ok {
+		return oidResult{oid, "missing", nil}
+	}
+	switch {
+	case err != nil:
+		return oidResult{oid, "failed", err}
+	case copied:
+		return oidResult{oid, "restored", nil}
+	}
+	return oidResult{oid, "present", nil}
+}
+
+// Make sure the cluster at ustr has the blob of each OID listed in
+// fn, below any file's metadata.  Cancelling ctx stops reading the
+// list, and cancelling reqCtx aborts requests in flight.
+//
+// The returned stats are valid even if an error is returned.
+func restoreOIDs(ctx, reqCtx context.Context, ustr, fn string) (*oidStats, error) {
+	stats := &oidStats{}
+	start := time.Now()
+
+	restoreClient = newHTTPClient(*restoreTimeout, *restoreWorkers,
+		*restoreHTTP2)
+	var f *blobFetcher
+	if *restoreFetchFrom != "" {
+		var err error
+		f, err = newBlobFetcher(*restoreFetchFrom, ustr, *restoreFetchWorkers)
+		if err != nil {
+			return stats, fmt.Errorf("Error setting up -fetch-from: %v", err)
+		}
+	}
+
+	oids := make(chan string, *restoreBuffer)
+	results := make(chan oidResult)
+	wg := sync.WaitGroup{}
+	for i := 0; i < *restoreWorkers; i++ {
+		wg.Add(1)
+		go func(ctx context.Context) {
+			defer wg.Done()
+			for oid := range oids {
+				results <- restoreOID(ctx, ustr, f, oid)
+			}
+		}(withWorkerLog(reqCtx, i))
+	}
+
+	readErr := make(chan error, 1)
+	go func() {
+		readErr <- readOIDs(ctx, fn, oids)
+		close(oids)
+		wg.Wait()
+		close(results)
+	}()
+
+	rep := &oidReport{RestoredOIDs: []string{}, MissingOIDs: []string{},
+		Failures: []oidFailure{}}
+	for res := range results {
+		stats.Seen++
+		switch res.status {
+		case "present":
+			stats.Present++
+			mainLog.Infof("Blob %v is present", res.oid)
+		case "restored":
+			stats.Restored++
+			rep.RestoredOIDs = append(rep.RestoredOIDs, res.oid)
+		case "missing":
+			stats.Missing++
+			rep.MissingOIDs = append(rep.MissingOIDs, res.oid)
+			mainLog.Printf("Blob %v is missing", res.oid)
+		default:
+			stats.Failed++
+			rep.Failures = append(rep.Failures,
+				oidFailure{res.oid, res.err.Error()})
+			mainLog.Errorf("Error restoring blob %v: %v", res.oid, res.err)
+		}
+	}
+	rep.oidStats = *stats
+
+	mainLog.Noticef("Checked %v blobs in %v: %v present, %v restored, "+
+		"%v missing, %v failed", stats.Seen, time.Since(start),
+		stats.Present, stats.Restored, stats.Missing, stats.Failed)
+
+	if *restoreReportFile != "" {
+		if err := writeReport(*restoreReportFile, rep); err != nil {
+			return stats, fmt.Errorf("Error writing report: %v", err)
+		}
+	}
+
+	if err := <-readErr; err != nil {
+		return stats, err
+	}
+	if ctx.Err() != nil {
+		return stats, errors.New("Restore was interrupted before " +
+			"every blob was checked")
+	}
+	return stats, nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"strings"
+)
+
+var restorePathsFile = restoreFlags.String("paths-file", "",
+	"Only restore the paths listed in this file, one per line "+
+		"(a trailing / lists everything under it)")
+
+// A set of exact paths and of directory prefixes, looked up in time
+// proportional to a path's length however many there are.
+type pathList struct {
+	paths    map[string]bool
+	prefixes map[string]bool
+}
+
+// Parse a list of paths from r, one per line.  Blank lines and lines
+// starting with "#" are skipped, and a line ending in "/" lists
+// everything under that directory.  Leading slashes don't matter.
+func parsePathList(r io.Reader) (*pathList, error) {
+	l := &pathList{paths: map[string]bool{}, prefixes: map[string]bool{}}
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		p := strings.TrimLeft(strings.TrimRight(s.Text(), "\r"), "/")
+		switch {
+		case p == "" || strings.HasPrefix(p, "#"):
+		case strings.HasSuffix(p, "/"):
+			l.prefixes[p] = true
+		default:
+			l.paths[p] = true
+		}
+	}
+	return l, s.Err()
+}
+
+// Read the list in fn with parsePathList.
+func loadPathList(fn string) (*pathList, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parsePathList(f)
+}
+
+// True if p is listed, or under a listed directory.
+func (l *pathList) has(p string) bool {
+	p = strings.TrimLeft(p, "/")
+	if l.paths[p] {
+		return true
+	}
+	if len(l.prefixes) == 0 {
+		return false
+	}
+	for i := 0; i < len(p); i++ {
+		if p[i] == '/' && l.prefixes[p[:i+1]] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestPathList(t *testing.T) {
+	l, err := parsePathList(strings.NewReader(
+		"# wanted\nimages/a.jpg\r\n\n/docs/\nlogs/2024/\n"))
+	if err != nil {
+		t.Fatalf("Error parsing list: %v", err)
+	}
+	tests := []struct {
+		path string
+		exp  bool
+	}{
+		{"images/a.jpg", true},
+		{"/images/a.jpg", true},
+		{"images/a.jpg/x", false},
+		{"images/b.jpg", false},
+		{"images", false},
+		{"docs/x", true},
+		{"docs/sub/y", true},
+		{"docs", false},
+		{"docsx/y", false},
+		{"logs/2024/jan", true},
+		{"logs/2023/jan", false},
+		{"# wanted", false},
+	}
+	for _, test := range tests {
+		if got := l.has(test.path); got != test.exp {
+			t.Errorf("Expected %v for %q, got %v", test.exp, test.path, got)
+		}
+	}
+}
+
+func TestRestoreMatcherPathsFile(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "paths")
+	if err := ioutil.WriteFile(fn, []byte("a\nb\ndir/\n"), 0644); err != nil {
+		t.Fatalf("Error writing list: %v", err)
+	}
+	defer func(f, e, m string) {
+		*restorePathsFile, *restoreExclude, *restorePat = f, e, m
+	}(*restorePathsFile, *restoreExclude, *restorePat)
+	*restorePathsFile, *restoreExclude = fn, "^b$|\\.tmp$"
+
+	matches, err := restoreMatcher()
+	if err != nil {
+		t.Fatalf("Error building matcher: %v", err)
+	}
+	for p, exp := range map[string]bool{"a": true, "b": false, "c": false,
+		"dir/x": true, "dir/x.tmp": false} {
+		if matches(p) != exp {
+			t.Errorf("Expected %v for %v", exp, p)
+		}
+	}
+
+	*restorePat = "^a"
+	if _, err := restoreMatcher(); err == nil ||
+		!strings.Contains(err.Error(), "only one of") {
+		t.Errorf("Expected -match with -paths-file refused, got %v", err)
+	}
+}
+
+// Compare a list of a few thousand paths with the equivalent regexp:
+//
+//	go test -bench PathList -run XXX
+func BenchmarkPathList(b *testing.B) {
+	var paths, quoted []string
+	for i := 0; i < 5000; i++ {
+		p := fmt.Sprintf("photos/%03d/IMG_%05d.jpg", i%100, i)
+		paths = append(paths, p)
+		quoted = append(quoted, regexp.QuoteMeta(p))
+	}
+	l, err := parsePathList(strings.NewReader(strings.Join(paths, "\n")))
+	if err != nil {
+		b.Fatalf("Error parsing list: %v", err)
+	}
+	re := regexp.MustCompile("^(" + strings.Join(quoted, "|") + ")$")
+	probe := "photos/042/IMG_99999.jpg"
+
+	b.Run("list", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			l.has(probe)
+		}
+	})
+	b.Run("regexp", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			re.MatchString(probe)
+		}
+	})
+}
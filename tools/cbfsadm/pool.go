@@ -0,0 +1,119 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+)
+
+// Bounds on how far the restore worker pool can be resized.
+const (
+	minWorkers = 1
+	maxWorkers = 256
+)
+
+// Restores wait on the network far more than the CPU, so -workers
+// defaults to this many per CPU the process may use, up to
+// maxDefaultWorkers.
+const (
+	workersPerCPU     = 4
+	maxDefaultWorkers = 64
+)
+
+// The default -workers for a process using procs CPUs.
+func defaultWorkers(procs int) int {
+	n := workersPerCPU * procs
+	if n < minWorkers {
+		return minWorkers
+	}
+	if n > maxDefaultWorkers {
+		return maxDefaultWorkers
+	}
+	return n
+}
+
+// A resizable group of workers.  Each is started with an id and a
+// channel closed to ask it to exit.
+type workerPool struct {
+	start func(id int, wg *sync.WaitGroup, quit <-chan bool)
+
+	mu    sync.Mutex
+	wg    sync.WaitGroup
+	quits []chan bool
+	next  int
+}
+
+func newWorkerPool(n int,
+	start func(id int, wg *sync.WaitGroup, quit <-chan bool)) *workerPool {
+
+	p := &workerPool{start: start}
+	p.resize(n)
+	return p
+}
+
+// Grow or shrink the pool to n workers (clamped to the pool's
+// bounds), returning the new size.  Removed workers finish the item
+// they're working on first.
+func (p *workerPool) resize(n int) int {
+	if n < minWorkers {
+		n = minWorkers
+	}
+	if n > maxWorkers {
+		n = maxWorkers
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	restoreConcurrency.Add(int64(n - len(p.quits)))
+	for len(p.quits) < n {
+		q := make(chan bool)
+		p.quits = append(p.quits, q)
+		p.wg.Add(1)
+		go p.start(p.next, &p.wg, q)
+		p.next++
+	}
+	for len(p.quits) > n {
+		last := len(p.quits) - 1
+		close(p.quits[last])
+		p.quits = p.quits[:last]
+	}
+	return n
+}
+
+func (p *workerPool) size() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.quits)
+}
+
+// Wait for all workers to exit, leaving the pool empty.
+func (p *workerPool) wait() {
+	p.wg.Wait()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	restoreConcurrency.Add(-int64(len(p.quits)))
+	p.quits = nil
+}
+
+// Resize the pool by one worker on each of the signals in grow and
+// shrink (see resizeSignals) until stop is closed.
+func resizeOnSignal(p *workerPool, stop <-chan bool) {
+	if len(resizeSignals) == 0 {
+		return
+	}
+	sigch := make(chan os.Signal, 1)
+	signal.Notify(sigch, resizeSignals...)
+	defer signal.Stop(sigch)
+	for {
+		select {
+		case sig := <-sigch:
+			n := p.size() - 1
+			if sig == resizeSignals[0] {
+				n += 2
+			}
+			mainLog.Noticef("Now running %v workers", p.resize(n))
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestWorkerPool(t *testing.T) {
+	var running int64
+	p := newWorkerPool(2, func(id int, wg *sync.WaitGroup, quit <-chan bool) {
+		defer wg.Done()
+		atomic.AddInt64(&running, 1)
+		<-quit
+		atomic.AddInt64(&running, -1)
+	})
+
+	tests := []struct{ to, exp int }{
+		{5, 5},
+		{3, 3},
+		{0, minWorkers},
+		{maxWorkers + 10, maxWorkers},
+		{0, minWorkers},
+	}
+	for _, test := range tests {
+		if got := p.resize(test.to); got != test.exp || p.size() != test.exp {
+			t.Errorf("Expected %v workers resizing to %v, got %v (%v)",
+				test.exp, test.to, got, p.size())
+		}
+	}
+
+	// resize never goes below minWorkers, so quit the last one by
+	// hand.  Every removed worker must have exited by then.
+	p.mu.Lock()
+	close(p.quits[0])
+	p.quits = nil
+	p.mu.Unlock()
+	p.wait()
+	if n := atomic.LoadInt64(&running); n != 0 {
+		t.Errorf("Expected all workers to exit, %v still running", n)
+	}
+}
+
+func TestDefaultWorkers(t *testing.T) {
+	tests := []struct{ procs, exp int }{
+		{1, 4},
+		{2, 8},
+		{8, 32},
+		{16, 64},
+		{96, 64},
+		{0, minWorkers},
+	}
+	for _, test := range tests {
+		if got := defaultWorkers(test.procs); got != test.exp {
+			t.Errorf("Expected %v workers for %v CPUs, got %v",
+				test.exp, test.procs, got)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/couchbaselabs/cbfs/tools"
+)
+
+var restoreProbe = restoreFlags.Bool("probe", true,
+	"Check each target answers like a cbfs cluster before restoring")
+
+// Ping the cluster at base, so that a mistyped URL or a cluster
+// that's down fails once, up front, rather than once for every file.
+// Only an unreachable server or a missing API root is an error; any
+// other answer is left for the restore itself to deal with.
+func probeCluster(ctx context.Context, base string) error {
+	u := cbfstool.ClusterURL(base, "/.cbfs/ping/")
+	name := cbfstool.ParseURL(base).Redacted()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	res, err := restoreClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("cannot reach cbfs at %v: %v", name, err)
+	}
+	res.Body.Close()
+	switch {
+	case res.StatusCode == 404:
+		return fmt.Errorf("cannot reach cbfs at %v: %v not found "+
+			"(is that the cluster's URL?)", name, u.Path)
+	case res.StatusCode >= 300:
+		mainLog.Printf("WARNING: %v answered %v to %v", name, res.Status,
+			u.Path)
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func init() {
+	// The fake clusters in the other tests only answer what they're
+	// testing; TestRestoreProbe turns the probe back on.
+	*restoreProbe = false
+}
+
+func TestRestoreProbe(t *testing.T) {
+	defer func(p bool) { *restoreProbe = p }(*restoreProbe)
+	*restoreProbe = true
+
+	fn := writeTestBackup(t, "a", "b")
+	defer os.Remove(fn)
+
+	posts := int64(0)
+	ping := 204
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			if strings.HasSuffix(req.URL.Path, "/.cbfs/ping/") {
+				w.WriteHeader(ping)
+				return
+			}
+			atomic.AddInt64(&posts, 1)
+			w.WriteHeader(201)
+		}))
+	defer ts.Close()
+
+	stats, err := restore(context.Background(), context.Background(),
+		ts.URL, fn)
+	if err != nil || stats.Restored != 2 {
+		t.Errorf("Expected 2 restored after a good probe, got %+v (%v)",
+			*stats, err)
+	}
+
+	atomic.StoreInt64(&posts, 0)
+	ping = 404
+	_, err = restore(context.Background(), context.Background(),
+		ts.URL+"/wrong/", fn)
+	if err == nil || !strings.Contains(err.Error(), "cannot reach cbfs at") ||
+		!strings.Contains(err.Error(), "/wrong/.cbfs/ping/ not found") {
+		t.Errorf("Expected a not found probe to stop the restore, got %v", err)
+	}
+
+	// Nothing listening.
+	ts2 := httptest.NewServer(http.NotFoundHandler())
+	ts2.Close()
+	_, err = restore(context.Background(), context.Background(),
+		"http://user:secret@"+strings.TrimPrefix(ts2.URL, "http://"), fn)
+	if err == nil || !strings.Contains(err.Error(), "cannot reach cbfs at") ||
+		strings.Contains(err.Error(), "secret") {
+		t.Errorf("Expected an unreachable cluster refused without its "+
+			"password, got %v", err)
+	}
+	if n := atomic.LoadInt64(&posts); n != 0 {
+		t.Errorf("Expected nothing restored after failed probes, got %v", n)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+const progressInterval = 5 * time.Second
+
+func isTerminal(f *os.File) bool {
+	st, err := f.Stat()
+	return err == nil && st.Mode()&os.ModeCharDevice != 0
+}
+
+// Describe how far along a restore of total files and totalBytes
+// (either 0 if unknown) is.  The ETA is based on bytes if their total
+// is known, since a few large files can dominate a backup.
+func progressLine(stats *restoreStats, total, totalBytes int64,
+	elapsed time.Duration) string {
+
+	restored := atomic.LoadInt64(&stats.Restored)
+	failed := atomic.LoadInt64(&stats.Failed)
+	done := restored + failed + atomic.LoadInt64(&stats.Skipped) +
+		atomic.LoadInt64(&stats.Unchanged)
+	rate := float64(done) / elapsed.Seconds()
+
+	s := fmt.Sprintf("%v files done (%v restored, %v failed), %.1f files/s",
+		humanize.Comma(done), humanize.Comma(restored),
+		humanize.Comma(failed), rate)
+
+	doneBytes := atomic.LoadInt64(&stats.DoneBytes)
+	if rb := atomic.LoadInt64(&stats.RestoredBytes); rb > 0 {
+		s += fmt.Sprintf(", %v restored (%.1f MB/s)",
+			humanize.Bytes(uint64(rb)), float64(rb)/1e6/elapsed.Seconds())
+	}
+	if n := atomic.LoadInt64(&stats.UnknownSize); n > 0 {
+		s += fmt.Sprintf(", %v of unknown size", humanize.Comma(n))
+	}
+	if *restoreAdaptive {
+		s += fmt.Sprintf(", %v workers", restoreConcurrency.Value())
+	}
+	if b := blockedFraction(stats); b >= 0 {
+		s += fmt.Sprintf(", decoder %.0f%% blocked", b*100)
+	}
+
+	byteRate := float64(doneBytes) / elapsed.Seconds()
+	switch {
+	case totalBytes > 0 && byteRate > 0:
+		s += eta(float64(doneBytes), float64(totalBytes), byteRate)
+	case total > 0 && rate > 0:
+		s += eta(float64(done), float64(total), rate)
+	}
+	return s
+}
+
+// The fraction of its time the decoder has spent waiting on the
+// workers, or -1 before it's done anything.
+func blockedFraction(stats *restoreStats) float64 {
+	blocked := atomic.LoadInt64(&stats.BlockedNanos)
+	busy := blocked + atomic.LoadInt64(&stats.DecodeNanos)
+	if busy == 0 {
+		return -1
+	}
+	return float64(blocked) / float64(busy)
+}
+
+func eta(done, total, rate float64) string {
+	left := total - done
+	if left < 0 {
+		left = 0
+	}
+	return fmt.Sprintf(", %.1f%% - ETA %v", done*100/total,
+		time.Duration(left/rate)*time.Second)
+}
+
+// Report progress every few seconds until done is closed.  On a
+// terminal the report is updated in place.
+func showProgress(stats *restoreStats, total, totalBytes int64,
+	done <-chan bool) {
+
+	tty := isTerminal(os.Stderr)
+	start := time.Now()
+
+	t := time.NewTicker(progressInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			msg := progressLine(stats, total, totalBytes, time.Since(start))
+			if tty {
+				fmt.Fprintf(os.Stderr, "\r%-79s", msg)
+			} else {
+				mainLog.Noticef("%v", msg)
+			}
+		case <-done:
+			if tty {
+				fmt.Fprintf(os.Stderr, "\r%79s\r", "")
+			}
+			return
+		}
+	}
+}
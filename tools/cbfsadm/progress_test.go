@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestProgressLine(t *testing.T) {
+	stats := &restoreStats{Restored: 9, Skipped: 1, Bytes: 4e6,
+		DoneBytes: 1e6, RestoredBytes: 1e6, UnknownSize: 2}
+
+	tests := []struct {
+		total, totalBytes int64
+		exp               string
+	}{
+		{0, 0, "10 files done (9 restored, 0 failed), 1.0 files/s, " +
+			"1.0 MB restored (0.1 MB/s), 2 of unknown size"},
+		{20, 0, "10 files done (9 restored, 0 failed), 1.0 files/s, " +
+			"1.0 MB restored (0.1 MB/s), 2 of unknown size, " +
+			"50.0% - ETA 10s"},
+		// A total size makes the ETA follow the bytes instead.
+		{20, 4e6, "10 files done (9 restored, 0 failed), 1.0 files/s, " +
+			"1.0 MB restored (0.1 MB/s), 2 of unknown size, " +
+			"25.0% - ETA 30s"},
+	}
+	for _, test := range tests {
+		got := progressLine(stats, test.total, test.totalBytes,
+			10*time.Second)
+		if got != test.exp {
+			t.Errorf("Expected %q, got %q", test.exp, got)
+		}
+	}
+}
+
+func TestProgressBlocked(t *testing.T) {
+	stats := &restoreStats{Restored: 10, DecodeNanos: 1e9, BlockedNanos: 3e9}
+	exp := "10 files done (10 restored, 0 failed), 1.0 files/s, " +
+		"decoder 75% blocked"
+	if got := progressLine(stats, 0, 0, 10*time.Second); got != exp {
+		t.Errorf("Expected %q, got %q", exp, got)
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"regexp/syntax"
+	"strings"
+)
+
+// The directory every path matching the regexp pat must be under,
+// such as "images/" for "^images/.*\.jpg$", so the server need only
+// list that part of the cluster.  Empty if there's no such directory.
+//
+// Only a literal at the very start of an anchored, case-sensitive
+// pattern counts, and it's cut back to its last "/": the server's
+// listing keeps each whole directory together, but not a partial name
+// like "images/ph", whose entries may be listed among others.
+func listPrefix(pat string) string {
+	re, err := syntax.Parse(pat, syntax.Perl)
+	if err != nil {
+		return ""
+	}
+	re = re.Simplify()
+	subs := []*syntax.Regexp{re}
+	if re.Op == syntax.OpConcat {
+		subs = re.Sub
+	}
+	if len(subs) == 0 || subs[0].Op != syntax.OpBeginText {
+		return ""
+	}
+
+	lit := &strings.Builder{}
+	for _, sub := range subs[1:] {
+		if sub.Op != syntax.OpLiteral || sub.Flags&syntax.FoldCase != 0 {
+			break
+		}
+		lit.WriteString(string(sub.Rune))
+	}
+	s := lit.String()
+	return s[:strings.LastIndex(s, "/")+1]
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestListPrefix(t *testing.T) {
+	tests := []struct {
+		pat, exp string
+	}{
+		{".*", ""},
+		{"^images/", "images/"},
+		{`^images/2024/.*\.jpg$`, "images/2024/"},
+		{"^images/ph", "images/"},
+		{"^images", ""},
+		{"^images/(a|b)", "images/"},
+		{"^images/a|^images/b", ""},
+		{"^(images|docs)/", ""},
+		{"images/", ""},
+		{"(?i)^images/", ""},
+		{"(?m)^images/", ""},
+		{"^images/?x", ""},
+		{"^a/b+/", "a/"},
+		{"^a\\.b/", "a.b/"},
+		{"[", ""},
+	}
+	for _, test := range tests {
+		if got := listPrefix(test.pat); got != test.exp {
+			t.Errorf("Expected %q for %q, got %q", test.exp, test.pat, got)
+		}
+	}
+
+	glob, err := globRegexp("/photos/2024/*.jpg")
+	if err != nil {
+		t.Fatalf("Error translating glob: %v", err)
+	}
+	if got := listPrefix(glob); got != "photos/2024/" {
+		t.Errorf("Expected photos/2024/ for the glob's regexp, got %q", got)
+	}
+}
+
+// The prefix is sent to the server, and the pattern still applied to
+// whatever it streams back.
+func TestExportPrefix(t *testing.T) {
+	var got string
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			got = req.URL.Path
+			w.Write([]byte(testStream))
+		}))
+	defer ts.Close()
+
+	matches, err := newMatcher("^a/z", "")
+	if err != nil {
+		t.Fatalf("Error building matcher: %v", err)
+	}
+	buf := &bytes.Buffer{}
+	n, err := export(ts.URL, listPrefix("^a/z"), buf, matches, time.Time{}, true)
+	if err != nil {
+		t.Fatalf("Error exporting: %v", err)
+	}
+	if exp := "/.cbfs/backup/stream/a/"; got != exp {
+		t.Errorf("Expected a request for %v, got %v", exp, got)
+	}
+	if n != 1 {
+		t.Errorf("Expected 1 file exported, got %v:\n%s", n, buf)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+	"unicode"
+)
+
+var restoreContinue = restoreFlags.Bool("continue-on-decode-error", false,
+	"Skip malformed backup records instead of stopping at the first")
+var restoreQuarantineFile = restoreFlags.String("quarantine", "",
+	"Save records skipped by -continue-on-decode-error to this file")
+
+// Where malformed backup records go when they're skipped.  Records
+// are only counted if w is nil.
+type quarantine struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// The quarantine used by restore with -continue-on-decode-error.
+// Without one, decoding stops at the first malformed record.
+var restoreQuarantine *quarantine
+
+// Record a malformed record and why it couldn't be decoded.
+func (q *quarantine) add(stats *restoreStats, raw []byte, err error) error {
+	atomic.AddInt64(&stats.Quarantined, 1)
+	mainLog.Printf("Skipping malformed record (%v): %.80q", err, raw)
+	if q.w == nil {
+		return nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	_, werr := q.w.Write(append(raw, '\n'))
+	return werr
+}
+
+// Decodes the records of a backup stream, setting aside the ones that
+// can't be decoded in q (if not nil) instead of failing.
+type recordDecoder struct {
+	r     io.Reader
+	d     *json.Decoder
+	q     *quarantine
+	stats *restoreStats
+}
+
+func newRecordDecoder(r io.Reader, q *quarantine,
+	stats *restoreStats) *recordDecoder {
+
+	return &recordDecoder{r: r, d: json.NewDecoder(r), q: q, stats: stats}
+}
+
+// Decode the next good record into ob, returning io.EOF at the end of
+// the stream.
+func (rd *recordDecoder) decode(ob *restoreWorkItem) error {
+	if rd.q == nil {
+		return rd.d.Decode(ob)
+	}
+	for {
+		var raw json.RawMessage
+		err := rd.d.Decode(&raw)
+		switch err.(type) {
+		case nil:
+			if err := json.Unmarshal(raw, ob); err == nil {
+				return nil
+			} else if err := rd.q.add(rd.stats, raw, err); err != nil {
+				return err
+			}
+			continue
+		case *json.SyntaxError:
+			// The decoder is stuck on the bad record, but what
+			// it hasn't consumed starts with it.  Set the rest
+			// of its line aside and carry on from the next.
+			bad, rest, rerr := skipLine(io.MultiReader(rd.d.Buffered(), rd.r))
+			if rerr != nil {
+				return rerr
+			}
+			if err := rd.q.add(rd.stats, bad, err); err != nil {
+				return err
+			}
+			rd.r, rd.d = rest, json.NewDecoder(rest)
+			continue
+		}
+		if err == io.ErrUnexpectedEOF {
+			// A truncated final record.
+			bad, _ := ioutil.ReadAll(rd.d.Buffered())
+			if err := rd.q.add(rd.stats, bytes.TrimSpace(bad), err); err != nil {
+				return err
+			}
+			return io.EOF
+		}
+		return err
+	}
+}
+
+// Read past the next line of r (after any leading whitespace),
+// returning it and a reader of what follows.  Backups hold one record
+// per line, so this resynchronizes after a malformed one.
+func skipLine(r io.Reader) ([]byte, io.Reader, error) {
+	br := bufio.NewReader(r)
+	for {
+		c, _, err := br.ReadRune()
+		if err == io.EOF {
+			return nil, br, nil
+		} else if err != nil {
+			return nil, br, err
+		}
+		if !unicode.IsSpace(c) {
+			br.UnreadRune()
+			break
+		}
+	}
+	line, err := br.ReadBytes('\n')
+	if err == io.EOF {
+		err = nil
+	}
+	if n := len(line); n > 0 && line[n-1] == '\n' {
+		line = line[:n-1]
+	}
+	return line, br, err
+}
+
+// Set up the quarantine for -continue-on-decode-error, returning a
+// function closing it.
+func openQuarantine() (func() error, error) {
+	restoreQuarantine = nil
+	if !*restoreContinue {
+		return func() error { return nil }, nil
+	}
+	if *restoreQuarantineFile == "" {
+		restoreQuarantine = &quarantine{}
+		return func() error { return nil }, nil
+	}
+	f, err := os.Create(*restoreQuarantineFile)
+	if err != nil {
+		return nil, err
+	}
+	restoreQuarantine = &quarantine{w: f}
+	return f.Close, nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+var restorePrefix = restoreFlags.String("prefix", "",
+	"Restore every path under this one, after any -remap "+
+		"(such as snapshots/2024-06-01)")
+
+type pathMapping struct {
+	from, to string
+}
+
+// Leading path rewrites given by repeated -remap old=new flags.
+type pathRemap []pathMapping
+
+func (r pathRemap) String() string {
+	s := []string{}
+	for _, m := range r {
+		s = append(s, m.from+"="+m.to)
+	}
+	return strings.Join(s, ",")
+}
+
+func (r *pathRemap) Set(s string) error {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 || strings.Trim(parts[0], "/") == "" {
+		return fmt.Errorf("must be of the form old=new")
+	}
+	*r = append(*r, pathMapping{
+		strings.Trim(parts[0], "/"),
+		strings.Trim(parts[1], "/"),
+	})
+	return nil
+}
+
+// Rewrite p using the first mapping whose old prefix matches p's
+// leading path segments.
+func (r pathRemap) apply(p string) string {
+	for _, m := range r {
+		switch {
+		case p == m.from:
+			return m.to
+		case strings.HasPrefix(p, m.from+"/"):
+			rest := p[len(m.from)+1:]
+			if m.to == "" {
+				return rest
+			}
+			return m.to + "/" + rest
+		}
+	}
+	return p
+}
+
+// Where to restore the backed up path p: remapped, cleaned, and put
+// under -prefix.  Cleaning first means a path can't climb out of the
+// prefix with "..".
+func restoreDest(p string) (string, error) {
+	dest, err := cleanPath(restoreRemap.apply(p))
+	if err != nil || *restorePrefix == "" {
+		return dest, err
+	}
+	prefix, err := cleanPath(*restorePrefix)
+	if err != nil {
+		return "", fmt.Errorf("invalid -prefix: %v", err)
+	}
+	return prefix + "/" + dest, nil
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync/atomic"
+
+	"github.com/couchbaselabs/cbfs/tools"
+)
+
+// Returned from restoreFile when a file exists and wasn't overwritten.
+var errExists = cbfstool.ErrExists
+
+// Returned from restoreFile when the cluster already has the file just
+// as backed up.
+var errUnchanged = cbfstool.ErrUnchanged
+
+// Running totals for a restore.  Fields are updated atomically.
+type restoreStats struct {
+	Seen       int64 `json:"seen"`
+	Matched    int64 `json:"matched"`
+	Restored   int64 `json:"restored"`
+	Skipped    int64 `json:"skipped"`
+	Unchanged  int64 `json:"unchanged"`
+	Failed     int64 `json:"failed"`
+	Mismatched int64 `json:"mismatched"`
+
+	// Total length of the matched files whose length is known,
+	// of those that have been processed, and of those restored.
+	Bytes         int64 `json:"bytes"`
+	DoneBytes     int64 `json:"done_bytes"`
+	RestoredBytes int64 `json:"restored_bytes"`
+	// Matched files whose length isn't recorded.
+	UnknownSize int64 `json:"unknown_size"`
+	// Malformed records skipped by -continue-on-decode-error.
+	Quarantined int64 `json:"quarantined"`
+	// Entries skipped for having more than -max-meta-bytes of
+	// metadata.
+	Oversized int64 `json:"oversized"`
+
+	// Time spent decoding the backup, and waiting for the workers
+	// to take what was decoded.  Mostly waiting means the restore
+	// is bound by the cluster, not by reading the backup.
+	DecodeNanos  int64 `json:"decode_ns"`
+	BlockedNanos int64 `json:"blocked_ns"`
+
+	// How the server answered the final request for each file.
+	Responses statusCounts `json:"responses"`
+}
+
+// Counts of restore outcomes by the class of the server's response.
+type statusCounts struct {
+	Created     int64 `json:"201"`
+	NotModified int64 `json:"304"`
+	Exists      int64 `json:"409"`
+	ClientError int64 `json:"4xx"`
+	ServerError int64 `json:"5xx"`
+	Network     int64 `json:"network"`
+	Other       int64 `json:"other"`
+}
+
+// Count a restore that ended with err.
+func (c *statusCounts) add(err error) {
+	code := cbfstool.StatusCode(err)
+	n := &c.Other
+	switch {
+	case err == nil:
+		n = &c.Created
+	case code == 304:
+		n = &c.NotModified
+	case code == 409:
+		n = &c.Exists
+	case code >= 500:
+		n = &c.ServerError
+	case code >= 400:
+		n = &c.ClientError
+	case code == 0 && cbfstool.IsTemporary(err):
+		n = &c.Network
+	}
+	atomic.AddInt64(n, 1)
+}
+
+func (c *statusCounts) total() int64 {
+	return atomic.LoadInt64(&c.Created) + atomic.LoadInt64(&c.NotModified) +
+		atomic.LoadInt64(&c.Exists) +
+		atomic.LoadInt64(&c.ClientError) + atomic.LoadInt64(&c.ServerError) +
+		atomic.LoadInt64(&c.Network) + atomic.LoadInt64(&c.Other)
+}
+
+// The counts as table rows, largest first.
+func (c *statusCounts) rows() []string {
+	rows := []struct {
+		name string
+		n    int64
+	}{
+		{"201 restored", atomic.LoadInt64(&c.Created)},
+		{"304 unchanged", atomic.LoadInt64(&c.NotModified)},
+		{"409 exists", atomic.LoadInt64(&c.Exists)},
+		{"4xx rejected", atomic.LoadInt64(&c.ClientError)},
+		{"5xx server error", atomic.LoadInt64(&c.ServerError)},
+		{"network error", atomic.LoadInt64(&c.Network)},
+		{"other error", atomic.LoadInt64(&c.Other)},
+	}
+	sort.SliceStable(rows, func(i, j int) bool { return rows[i].n > rows[j].n })
+	total := c.total()
+	var out []string
+	for _, r := range rows {
+		if r.n > 0 {
+			out = append(out, fmt.Sprintf("%-16s %10d %5.1f%%", r.name, r.n,
+				100*float64(r.n)/float64(total)))
+		}
+	}
+	return out
+}
+
+// Count a matched file of the given length (-1 if unknown).
+func (s *restoreStats) addMatched(length int64) {
+	atomic.AddInt64(&s.Matched, 1)
+	if length < 0 {
+		atomic.AddInt64(&s.UnknownSize, 1)
+	} else {
+		atomic.AddInt64(&s.Bytes, length)
+	}
+}
+
+// The outcome of restoring a single path, sent from the workers.
+type restoreResult struct {
+	Target    string // the cluster restored to
+	Path      string
+	Length    int64 // -1 if unknown
+	Err       error
+	VerifyErr error
+	// True if Err came from a restore request, to be counted in
+	// Responses.
+	Requested bool
+	// The backed up meta, for -deadletter.
+	Meta *json.RawMessage
+}
+
+type restoreFailure struct {
+	Path   string `json:"path"`
+	Target string `json:"target,omitempty"`
+	Error  string `json:"error"`
+}
+
+// The document written by -report.
+type restoreReport struct {
+	restoreStats
+	Failures []restoreFailure `json:"failures"`
+	// Results for each cluster, when restoring to more than one.
+	Targets map[string]*restoreStats `json:"targets,omitempty"`
+}
+
+// Tally results until the channel is closed.  Failures are recorded
+// in rep and dl (if not nil), and trip is called once if they reach
+// maxFailures (if not zero).  If targets isn't nil, results are also
+// tallied in the stats of the target they came from.
+func collectResults(results <-chan restoreResult, stats *restoreStats,
+	targets map[string]*restoreStats, rep *restoreReport, dl *deadletter,
+	hook *hookRunner, maxFailures int64, trip func(), done chan<- bool) {
+
+	defer close(done)
+	for r := range results {
+		tally(stats, r)
+		target := ""
+		if ts := targets[r.Target]; ts != nil {
+			tally(ts, r)
+			target = r.Target
+		}
+		hook.progress(stats)
+		if r.Err != nil && r.Err != errExists && r.Err != errUnchanged {
+			if maxFailures > 0 && atomic.LoadInt64(&stats.Failed) == maxFailures {
+				trip()
+			}
+			if rep != nil {
+				rep.Failures = append(rep.Failures,
+					restoreFailure{r.Path, target, r.Err.Error()})
+			}
+			dl.add(r.Path, r.Meta)
+		}
+		if r.VerifyErr != nil && rep != nil {
+			rep.Failures = append(rep.Failures,
+				restoreFailure{r.Path, target, r.VerifyErr.Error()})
+		}
+	}
+}
+
+// Count a single result in stats.
+func tally(stats *restoreStats, r restoreResult) {
+	if r.Length > 0 {
+		atomic.AddInt64(&stats.DoneBytes, r.Length)
+	}
+	switch r.Err {
+	case nil:
+		atomic.AddInt64(&stats.Restored, 1)
+		if r.Length > 0 {
+			atomic.AddInt64(&stats.RestoredBytes, r.Length)
+		}
+	case errExists:
+		atomic.AddInt64(&stats.Skipped, 1)
+	case errUnchanged:
+		atomic.AddInt64(&stats.Unchanged, 1)
+	default:
+		atomic.AddInt64(&stats.Failed, 1)
+	}
+	if r.VerifyErr != nil {
+		atomic.AddInt64(&stats.Mismatched, 1)
+	}
+	if r.Requested {
+		stats.Responses.add(r.Err)
+	}
+}
+
+// Write rep to fn as indented JSON.
+func writeReport(fn string, rep interface{}) error {
+	f, err := createAtomic(fn)
+	if err != nil {
+		return err
+	}
+	e := json.NewEncoder(f)
+	e.SetIndent("", "  ")
+	if err := e.Encode(rep); err != nil {
+		f.Abort()
+		return err
+	}
+	return f.Commit()
+}
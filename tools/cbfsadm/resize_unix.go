@@ -0,0 +1,12 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// SIGUSR1 adds a restore worker and SIGUSR2 removes one.
+var resizeSignals = []os.Signal{syscall.SIGUSR1, syscall.SIGUSR2}
@@ -0,0 +1,8 @@
+package main
+
+import (
+	"os"
+)
+
+// There are no spare signals to resize the worker pool with.
+var resizeSignals []os.Signal
@@ -1,23 +1,28 @@
 package main
 
 import (
-	"bytes"
-	"compress/gzip"
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
-	"log"
-	"net/http"
+	"math"
+	"net/url"
 	"os"
+	"os/signal"
+	"path"
 	"regexp"
+	"runtime"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"strconv"
+	"strings"
 
 	"github.com/couchbaselabs/cbfs/tools"
-	"github.com/dustin/httputil"
 )
 
 var restoreFlags = flag.NewFlagSet("restore", flag.ExitOnError)
@@ -25,111 +30,1208 @@ var restoreForce = restoreFlags.Bool("f", false, "Overwrite existing")
 var restoreNoop = restoreFlags.Bool("n", false, "Noop")
 var restoreVerbose = restoreFlags.Bool("v", false, "Verbose restore")
 var restorePat = restoreFlags.String("match", ".*", "Regex for paths to match")
-var restoreWorkers = restoreFlags.Int("workers", 4, "Number of restore workers")
-var restoreExpire = restoreFlags.Int("expire", -1,
-	"Override expiration time (in seconds, or abs unix time)")
+var restoreExclude = restoreFlags.String("exclude", "",
+	"Regex for paths to skip (wins over -match)")
+var restoreExpire = restoreFlags.String("expire", "-1",
+	"Override expiration time (in seconds, or abs unix time, or keep)")
+var restoreWorkers = restoreFlags.Int("workers",
+	defaultWorkers(runtime.GOMAXPROCS(0)),
+	"Number of restore workers (by default 4 per CPU, up to 64)")
+var restoreMaxMetaBytes = restoreFlags.Int64("max-meta-bytes", 64<<20,
+	"Skip entries with more metadata than this, rather than queue them")
+var restoreInputWorkers = restoreFlags.Int("input-workers", 1,
+	"Number of backup segments to read at once")
+var restoreDeadline = restoreFlags.Duration("deadline", 0,
+	"Stop dispatching new work this long after starting (0 for no limit)")
+var restoreForceExpire = restoreFlags.Bool("force-expire", false,
+	"Use an -expire value even if it looks like a mistake")
+var restoreRetries = restoreFlags.Int("retries", 3,
+	"Number of times to retry a failed restore")
+var restoreRetryBase = restoreFlags.Duration("retry-base",
+	500*time.Millisecond, "Delay before the first retry (doubles each time)")
+var restoreCheckpoint = restoreFlags.String("checkpoint", "",
+	"File recording restored paths")
+var restoreResume = restoreFlags.Bool("resume", false,
+	"Skip paths already recorded in the checkpoint")
+var restoreRate = restoreFlags.Float64("rate", 0,
+	"Maximum files restored per second, across all targets (0 for unlimited)")
+var restoreVerify = restoreFlags.Bool("verify", false,
+	"Check each restored file's hash against the backup")
+var restoreTimeout = restoreFlags.Duration("timeout", 30*time.Second,
+	"Timeout for each request (0 for none, e.g. for huge files)")
+var restoreReportFile = restoreFlags.String("report", "",
+	"Write a JSON summary of the restore to this file")
+var restoreDiff = restoreFlags.Bool("diff", false,
+	"Only log the paths a restore would change (no restore is done)")
+var restoreProgress = restoreFlags.Bool("progress", false,
+	"Periodically report progress")
+var restoreTotal = restoreFlags.Int64("total", 0,
+	"Number of files expected, for -progress ETA")
+var restoreKeyfile = restoreFlags.String("keyfile", "",
+	"Key for encrypted backups (default $CBFS_BACKUP_KEY)")
+var restoreMaxFailures = restoreFlags.Int64("max-failures", 0,
+	"Abort the restore after this many failures (0 for unlimited)")
+var restoreFailFast = restoreFlags.Bool("fail-fast", false,
+	"Abort the restore at the first failure, cancelling requests in "+
+		"flight (the default is to log failures and carry on)")
+var restorePrecheck = restoreFlags.Bool("precheck", false,
+	"Read the whole backup once before restoring anything (not with stdin)")
+var restoreBuffer = restoreFlags.Int("buffer", 256,
+	"Number of decoded items to queue ahead of the workers")
+var restoreSlowThreshold = restoreFlags.Duration("slow-threshold", 0,
+	"Warn about any file taking longer than this to restore (0 to never)")
+var restoreSkipExisting = restoreFlags.Bool("skip-existing", false,
+	"HEAD each file first and skip it if the cluster has the same hash")
+var restoreNoDowngrade = restoreFlags.Bool("no-downgrade", false,
+	"With -f, don't overwrite files the cluster has a newer revision of")
 
+var restoreMultipart = restoreFlags.Bool("multipart", false,
+	"Send each file's meta as a multipart/form-data part, for servers "+
+		"that stream it")
+
+var restoreRemap pathRemap
+
+func init() {
+	restoreFlags.Var(&restoreRemap, "remap",
+		"Restore paths under old to new instead (old=new, repeatable)")
+}
+
+// A single entry in a backup stream.
 type restoreWorkItem struct {
-	Path string
-	Meta *json.RawMessage
+	Path string           `json:"path"`
+	Meta *json.RawMessage `json:"meta"`
+	// What kind of entry this is.  Backups predating the field
+	// (and the server's own) only hold files.
+	Type string `json:"type,omitempty"`
+
+	// The file's length from Meta, -1 if it isn't recorded.  Set
+	// by decodeBackup.
+	size int64
+}
+
+// The size of an entry's metadata as backed up.
+func metaBytes(meta *json.RawMessage) int64 {
+	if meta == nil {
+		return 0
+	}
+	return int64(len(*meta))
+}
+
+// The length recorded in a file's meta, or -1 if there isn't one.
+func metaLength(meta *json.RawMessage) int64 {
+	m := struct {
+		Length int64 `json:"length"`
+	}{-1}
+	if meta == nil || json.Unmarshal(*meta, &m) != nil {
+		return -1
+	}
+	return m.Length
+}
+
+// The kind of entry, "file" if not recorded.
+func (ob restoreWorkItem) kind() string {
+	if ob.Type == "" {
+		return "file"
+	}
+	return ob.Type
+}
+
+// Relative expirations shorter than this are probably a mistake.
+const minPlausibleExpiration = 5 * 60
+
+// Check an -expire value for likely mistakes: an absolute time that
+// has already passed, or a relative one so short files will expire
+// almost as soon as they're restored.  Zero and negative values mean
+// no expiration.
+func checkExpiration(exp int, now time.Time) error {
+	switch {
+	case exp <= 0:
+	case exp < minPlausibleExpiration:
+		return fmt.Errorf("files would expire %v seconds after being restored", exp)
+	case exp >= cbfstool.MaxRelativeExpiration && int64(exp) <= now.Unix():
+		return fmt.Errorf("%v is an absolute time in the past (%v)",
+			exp, time.Unix(int64(exp), 0).UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// The time between files restored at rate files per second, 0 for no
+// limit.  Rates too high or too low for a time.Ticker are refused.
+func rateInterval(rate float64) (time.Duration, error) {
+	if rate == 0 {
+		return 0, nil
+	}
+	every := float64(time.Second) / rate
+	if !(rate > 0) || every < 1 || every > math.MaxInt64 {
+		return 0, fmt.Errorf("-rate must be 0 (unlimited) or from %.3g to "+
+			"%.3g files per second", float64(time.Second)/math.MaxInt64,
+			float64(time.Second))
+	}
+	return time.Duration(every), nil
 }
 
-func restoreFile(base, path string, data interface{}) error {
+// Restore path with rc, returning whether a restore request was sent
+// (and so whether the error is the cluster's answer).  Files skipped
+// after checking the cluster's copy return errExists without one.
+func restoreFile(ctx context.Context, rc *cbfstool.RestoreClient, path string,
+	data *json.RawMessage) (bool, error) {
+	base := rc.Base
 	if *restoreNoop {
-		log.Printf("NOOP would restore %v", path)
-		return nil
+		logFor(ctx).Infof("NOOP would restore %v", path)
+		return false, nil
 	}
 
-	fileMetaBytes, err := json.Marshal(data)
-	if err != nil {
-		return err
+	if *restoreSkipExisting && !*restoreForce && hasVersion(ctx, base, path, data) {
+		return false, errExists
 	}
 
-	u := cbfstool.ParseURL(base)
-	u.Path = fmt.Sprintf("/.cbfs/backup/restore/%v", path)
+	if *restoreNoDowngrade && *restoreForce {
+		newer, err := clusterNewer(ctx, base, path, data)
+		if err != nil {
+			return false, fmt.Errorf("error checking existing revision: %v", err)
+		}
+		if newer {
+			logFor(ctx).Infof("Not downgrading %v, the cluster's copy is newer",
+				path)
+			return false, errExists
+		}
+	}
 
-	req, err := http.NewRequest("POST", u.String(),
-		bytes.NewReader(fileMetaBytes))
-	if err != nil {
-		return err
+	if err := restoreFetcher.ensure(ctx, data); err != nil {
+		return false, fmt.Errorf("error copying blob: %v", err)
+	}
+
+	return true, rc.RestoreContext(ctx, path, rawMeta(data))
+}
+
+// A client restoring into the cluster at base as the flags ask.  Each
+// worker makes one and uses it for every file.
+func newRestoreClient(base string) *cbfstool.RestoreClient {
+	return &cbfstool.RestoreClient{
+		Base:                base,
+		Client:              restoreClient,
+		Force:               *restoreForce,
+		Expiration:          *restoreExpire,
+		Retries:             *restoreRetries,
+		RetryBase:           *restoreRetryBase,
+		Multipart:           *restoreMultipart,
+		ExpireAfterCreation: time.Duration(restoreExpireRelative),
+		Logf: func(ctx context.Context, format string, args ...interface{}) {
+			logFor(ctx).Printf(format, args...)
+		},
 	}
+}
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("X-CBFS-Expiration", strconv.Itoa(*restoreExpire))
+// The backed up meta, nil if there isn't any.
+func rawMeta(meta *json.RawMessage) json.RawMessage {
+	if meta == nil {
+		return nil
+	}
+	return *meta
+}
 
-	res, err := http.DefaultClient.Do(req)
-	cbfstool.MaybeFatal(err, "Error executing POST to %v - %v", u, err)
+// True if the cluster already serves path with the hash recorded in
+// meta.  Any error checking is left for the restore to deal with.
+func hasVersion(ctx context.Context, base, path string,
+	meta *json.RawMessage) bool {
 
-	defer res.Body.Close()
+	fm, err := parseMeta(meta)
+	if err != nil || fm.OID == "" {
+		return false
+	}
+	got, err := clusterOID(ctx, base, path)
+	return err == nil && got == fm.OID
+}
+
+// True if the cluster has a newer version of path (by revision, then
+// modification time) than the backed up meta.
+func clusterNewer(ctx context.Context, base, path string,
+	meta *json.RawMessage) (bool, error) {
+
+	data, err := fileInfo(ctx, base, path)
 	switch {
-	case res.StatusCode == 201:
-		log.Printf("Restored %v", path)
-		// OK
-	case res.StatusCode == 409 && !*restoreForce:
-		// OK
-	default:
-		return httputil.HTTPErrorf(res, "restore error on %v - %Sv\n%B", path)
+	case err == errNotFound:
+		return false, nil
+	case err != nil:
+		return false, err
+	}
+	cur := restoreWorkItem{}
+	if err := json.Unmarshal(data, &cur); err != nil {
+		return false, err
 	}
+	return !newerEntry(cur, restoreWorkItem{Path: path, Meta: meta}), nil
+}
 
-	return nil
+// Tidy up a backed up path (leading or doubled slashes, "." and ".."
+// elements) as older backups may have them, refusing any that would
+// end up outside the cluster's namespace.
+func cleanPath(p string) (string, error) {
+	c := strings.TrimLeft(path.Clean(p), "/")
+	if c == "" || c == "." || c == ".." || strings.HasPrefix(c, "../") {
+		return "", fmt.Errorf("invalid path %q", p)
+	}
+	return c, nil
 }
 
-func restoreWorker(wg *sync.WaitGroup, base string, ch <-chan restoreWorkItem) {
+// Restore a file, warning if it takes longer than -slow-threshold.
+func restoreTimed(ctx context.Context, rc *cbfstool.RestoreClient, path string,
+	data *json.RawMessage) (bool, error) {
+
+	start := time.Now()
+	requested, err := restoreFile(ctx, rc, path, data)
+	d := time.Since(start)
+	restoreLatency.observe(d)
+	adaptiveFor(ctx).observe(d, err)
+	if *restoreSlowThreshold > 0 && d > *restoreSlowThreshold {
+		logFor(ctx).Printf("Slow restore of %v: took %v", path, d)
+	}
+	return requested, err
+}
+
+// Restore items from ch until it's closed or quit is.  Once halt is
+// closed, or ctx is cancelled, what's left in ch is drained without
+// being tried.
+func restoreWorker(ctx context.Context, wg *sync.WaitGroup,
+	quit <-chan bool, halt <-chan struct{}, base string,
+	ch <-chan restoreWorkItem, results chan<- restoreResult,
+	cp *checkpoint, throttle <-chan time.Time) {
+
 	defer wg.Done()
-	for ob := range ch {
-		err := restoreFile(base, ob.Path, ob.Meta)
+	wlog := logFor(ctx)
+	rc := newRestoreClient(base)
+	for {
+		var ob restoreWorkItem
+		select {
+		case <-quit:
+			return
+		case o, ok := <-ch:
+			if !ok {
+				return
+			}
+			ob = o
+		}
+		select {
+		case <-halt:
+			continue
+		default:
+		}
+		if ctx.Err() != nil {
+			continue
+		}
+		if throttle != nil {
+			<-throttle
+		}
+		res := restoreResult{Target: base, Path: ob.Path, Length: ob.size,
+			Meta: ob.Meta}
+		dest, err := restoreDest(ob.Path)
 		if err != nil {
-			log.Printf("Error restoring %v: %v",
-				ob.Path, err)
+			res.Err = err
+			wlog.Event("failed", ob.Path, err)
+			results <- res
+			continue
 		}
+		if restoreScriptOut != nil {
+			res.Err = restoreScriptOut.add(base, dest, ob.Meta)
+			if res.Err != nil {
+				wlog.Errorf("Error scripting %v: %v", dest, res.Err)
+			}
+			results <- res
+			continue
+		}
+		if *restoreDiff || *restoreOnlyMissing {
+			restoreInflight.Add(1)
+			if *restoreDiff {
+				res.Err = diffFile(ctx, base, dest, ob.Meta)
+			} else {
+				res.Err = checkMissing(ctx, base, dest)
+			}
+			restoreInflight.Add(-1)
+			if res.Err != nil && res.Err != errExists {
+				wlog.Errorf("Error checking %v: %v", dest, res.Err)
+			}
+			results <- res
+			continue
+		}
+		restoreInflight.Add(1)
+		res.Requested, res.Err = restoreTimed(ctx, rc, dest, ob.Meta)
+		restoreInflight.Add(-1)
+		switch {
+		case res.Err == errExists:
+			wlog.Event("skipped", dest, nil)
+		case res.Err == errUnchanged:
+			wlog.Event("unchanged", dest, nil)
+			cp.add(ob.Path)
+		case res.Err != nil:
+			wlog.Event("failed", ob.Path, res.Err)
+		case !*restoreNoop:
+			wlog.Event("restored", dest, nil)
+			cp.add(ob.Path)
+			if *restoreVerify {
+				res.VerifyErr = verifyFile(ctx, base, dest, ob.Meta)
+				if res.VerifyErr != nil {
+					wlog.Errorf("Error verifying %v: %v",
+						dest, res.VerifyErr)
+				}
+			}
+		}
+		results <- res
 	}
 }
 
-func restoreCommand(ustr string, args []string) {
-	regex, err := regexp.Compile(*restorePat)
-	cbfstool.MaybeFatal(err, "Error parsing match pattern: %v", err)
-
-	fn := restoreFlags.Arg(0)
+// Build a function matching paths against the include regex but not
+// the exclude regex (if not empty).
+func newMatcher(include, exclude string) (func(string) bool, error) {
+	inc, err := regexp.Compile(include)
+	if err != nil {
+		return nil, err
+	}
+	if exclude == "" {
+		return inc.MatchString, nil
+	}
+	exc, err := regexp.Compile(exclude)
+	if err != nil {
+		return nil, err
+	}
+	return func(p string) bool {
+		return inc.MatchString(p) && !exc.MatchString(p)
+	}, nil
+}
 
-	start := time.Now()
+// Build the function deciding which backup paths get restored, from
+// one of -match, -glob or -paths-file, less anything in the
+// -ignore-file.
+func restoreMatcher() (func(string) bool, error) {
+	matches, err := restoreIncludes()
+	if err != nil {
+		return nil, err
+	}
+	if *restoreIgnoreFile != "" {
+		ignored, err := loadIgnoreFile(*restoreIgnoreFile)
+		if err != nil {
+			return nil, err
+		}
+		included := matches
+		matches = func(p string) bool {
+			return included(p) && !ignored(p)
+		}
+	}
+	return restoreShard.wrap(matches), nil
+}
 
-	f, err := os.Open(fn)
-	cbfstool.MaybeFatal(err, "Error opening restore file: %v", err)
+func restoreIncludes() (func(string) bool, error) {
+	given := 0
+	for _, b := range []bool{*restorePat != ".*", *restoreGlob != "",
+		*restorePathsFile != ""} {
+		if b {
+			given++
+		}
+	}
+	if given > 1 {
+		return nil, errors.New("only one of -match, -glob and -paths-file " +
+			"may be given")
+	}
 
-	defer f.Close()
-	gz, err := gzip.NewReader(f)
-	cbfstool.MaybeFatal(err, "Error uncompressing restore file: %v", err)
+	if *restorePathsFile != "" {
+		l, err := loadPathList(*restorePathsFile)
+		if err != nil {
+			return nil, err
+		}
+		if *restoreExclude == "" {
+			return l.has, nil
+		}
+		notExcluded, err := newMatcher(".*", *restoreExclude)
+		if err != nil {
+			return nil, err
+		}
+		return func(p string) bool {
+			return l.has(p) && notExcluded(p)
+		}, nil
+	}
+	if *restoreGlob == "" {
+		return newMatcher(*restorePat, *restoreExclude)
+	}
+	re, err := globRegexp(*restoreGlob)
+	if err != nil {
+		return nil, err
+	}
+	return newMatcher(re, *restoreExclude)
+}
 
-	wg := &sync.WaitGroup{}
+// Decode items from a backup stream (in any -format), sending those
+// that should be restored to ch until the stream ends or ctx is
+// cancelled.  The time spent decoding and blocked sending to ch is
+// added to stats.
+func decodeBackup(ctx context.Context, r io.Reader, matches func(string) bool,
+	cp *checkpoint, stats *restoreStats, ch chan<- restoreWorkItem) error {
 
-	ch := make(chan restoreWorkItem)
-	for i := 0; i < *restoreWorkers; i++ {
-		wg.Add(1)
-		go restoreWorker(wg, ustr, ch)
+	d, err := newBackupDecoder(r, *restoreFormat, restoreQuarantine, stats)
+	if err != nil {
+		return err
 	}
-
-	d := json.NewDecoder(gz)
-	nfiles := 0
-	done := false
-	for !done {
+	for ctx.Err() == nil {
 		ob := restoreWorkItem{}
 
-		err := d.Decode(&ob)
+		t := time.Now()
+		err := d.decode(&ob)
+		atomic.AddInt64(&stats.DecodeNanos, int64(time.Since(t)))
 		switch err {
 		case nil:
-			if regex.MatchString(ob.Path) {
-				nfiles++
-				ch <- ob
+			atomic.AddInt64(&stats.Seen, 1)
+			if !matches(ob.Path) {
+				break
+			}
+			if k := ob.kind(); k != "file" {
+				// The server has nowhere to restore anything
+				// else (directories are derived from the
+				// files in them), so don't pass it off as a
+				// file.
+				logFor(ctx).Infof("Skipping %v entry %v", k, ob.Path)
+				atomic.AddInt64(&stats.Matched, 1)
+				atomic.AddInt64(&stats.Skipped, 1)
+				break
 			}
+			if n := metaBytes(ob.Meta); n > *restoreMaxMetaBytes {
+				logFor(ctx).Printf("Skipping %v: its metadata is %v bytes, "+
+					"over -max-meta-bytes", ob.Path, n)
+				atomic.AddInt64(&stats.Matched, 1)
+				atomic.AddInt64(&stats.Skipped, 1)
+				atomic.AddInt64(&stats.Oversized, 1)
+				break
+			}
+			if !restoreSince.admit(ob) {
+				// Restored by an earlier -since-checkpoint run.
+				break
+			}
+			ob.size = metaLength(ob.Meta)
+			if cp.has(ob.Path) {
+				stats.addMatched(ob.size)
+				atomic.AddInt64(&stats.Skipped, 1)
+				if ob.size > 0 {
+					atomic.AddInt64(&stats.DoneBytes, ob.size)
+				}
+				break
+			}
+			t = time.Now()
+			select {
+			case ch <- ob:
+				stats.addMatched(ob.size)
+			case <-ctx.Done():
+			}
+			atomic.AddInt64(&stats.BlockedNanos, int64(time.Since(t)))
 		case io.EOF:
-			done = true
-			break
+			return nil
 		default:
-			log.Fatalf("Error reading backup file: %v", err)
+			return err
 		}
 	}
-	close(ch)
+	return nil
+}
+
+// Open the backup file fn (decrypting it with key if necessary) and
+// send its matching entries to ch.
+func readBackup(ctx context.Context, fn string, key []byte,
+	matches func(string) bool, cp *checkpoint, stats *restoreStats,
+	ch chan<- restoreWorkItem) error {
+
+	f, err := openBackup(fn)
+	if err != nil {
+		return fmt.Errorf("Error opening restore file: %v", err)
+	}
+	defer f.Close()
+
+	dr, err := decrypt(f, key)
+	if err != nil {
+		return fmt.Errorf("Error decrypting %v: %v", fn, err)
+	}
+
+	r, err := decompress(dr)
+	if err != nil {
+		return fmt.Errorf("Error uncompressing %v: %v", fn, err)
+	}
+	defer r.Close()
+
+	if err := decodeBackup(ctx, r, matches, cp, stats, ch); err != nil {
+		return fmt.Errorf("Error reading %v: %v", fn, err)
+	}
+	return nil
+}
+
+// Describe how many of the total files expected (0 if unknown) for
+// each of n targets weren't processed.
+func unprocessed(stats *restoreStats, total int64, n int) string {
+	done := stats.Restored + stats.Unchanged + stats.Skipped + stats.Failed
+	if total > 0 {
+		return fmt.Sprintf("%v files unprocessed", total*int64(n)-done)
+	}
+	return fmt.Sprintf("%v files unprocessed (more if the backup "+
+		"wasn't read to the end)", stats.Matched*int64(n)-done)
+}
+
+// Call read for each segment, n at a time (in order if n is 1), until
+// one fails or ctx is cancelled.  Returns the first error.
+func readSegments(ctx context.Context, segs []string, n int,
+	read func(context.Context, string) error) error {
+
+	if n <= 1 {
+		for _, seg := range segs {
+			if ctx.Err() != nil {
+				break
+			}
+			if err := read(ctx, seg); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	todo := make(chan string, len(segs))
+	for _, seg := range segs {
+		todo <- seg
+	}
+	close(todo)
+
+	var once sync.Once
+	var firstErr error
+	wg := sync.WaitGroup{}
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for seg := range todo {
+				if ctx.Err() != nil {
+					return
+				}
+				if err := read(ctx, seg); err != nil {
+					once.Do(func() {
+						firstErr = err
+						cancel()
+					})
+					return
+				}
+			}
+		}()
+	}
 	wg.Wait()
+	return firstErr
+}
+
+// Decode every segment of a backup ahead of restoring it, which
+// can't be done when reading stdin.
+func precheckBackup(segs []string, key []byte,
+	matches func(string) bool) (*restoreStats, error) {
+
+	for _, seg := range segs {
+		if seg == "-" {
+			return &restoreStats{}, errors.New("-precheck can't read " +
+				"stdin twice; restore from a file")
+		}
+	}
+	return scanBackup(segs, key, matches)
+}
+
+// Decode every segment of a backup without restoring anything,
+// returning the number of entries seen and matched.
+func scanBackup(segs []string, key []byte,
+	matches func(string) bool) (*restoreStats, error) {
+
+	if restoreQuarantine != nil {
+		// Count malformed records, but leave saving them to the
+		// restore itself.
+		defer func(q *quarantine) { restoreQuarantine = q }(restoreQuarantine)
+		restoreQuarantine = &quarantine{}
+	}
+
+	stats := &restoreStats{}
+	ch := make(chan restoreWorkItem, 64)
+	drained := make(chan bool)
+	go func() {
+		for range ch {
+		}
+		close(drained)
+	}()
+	defer func() {
+		close(ch)
+		<-drained
+	}()
+
+	for _, seg := range segs {
+		err := readBackup(context.Background(), seg, key, matches, nil,
+			stats, ch)
+		if err != nil {
+			return stats, err
+		}
+	}
+	return stats, nil
+}
+
+// Restore the backup fn into the cluster at ustr (and any -target).
+// fn may also be a directory or glob of backup segments, read in
+// order.  Cancelling ctx stops dispatching new work, and cancelling
+// reqCtx aborts requests already in flight.
+//
+// The returned stats are valid even if an error is returned.
+func restore(ctx, reqCtx context.Context, ustr, fn string) (*restoreStats, error) {
+	stats := &restoreStats{}
+
+	// Reaching the deadline is like the first interrupt: requests
+	// in flight get to finish.
+	if *restoreDeadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *restoreDeadline)
+		defer cancel()
+	}
+
+	targets := restoreTargets(ustr)
+	for _, t := range targets {
+		if _, err := url.Parse(t); err != nil {
+			return stats, fmt.Errorf("Error parsing URL: %v", err)
+		}
+	}
+	if len(targets) > 1 && (*restoreCheckpoint != "" ||
+		*restoreFetchFrom != "" || *restoreOnlyMissing) {
+		return stats, errors.New("-checkpoint, -fetch-from and " +
+			"-only-missing only work with a single target")
+	}
+	modes := 0
+	for _, b := range []bool{*restoreDiff, *restoreOnlyMissing, *restoreEmitScript != ""} {
+		if b {
+			modes++
+		}
+	}
+	if modes > 1 {
+		return stats, errors.New("only one of -diff, -only-missing " +
+			"and -emit-script may be given")
+	}
+
+	matches, err := restoreMatcher()
+	if err != nil {
+		return stats, fmt.Errorf("Error parsing match pattern: %v", err)
+	}
+	if *restoreFailFast && *restoreMaxFailures > 1 {
+		return stats, errors.New("-fail-fast and -max-failures " +
+			"can't both be given")
+	}
+	if (*restoreResumeFrom != "" || *restoreLimit > 0) &&
+		*restoreInputWorkers > 1 {
+		return stats, errors.New("-resume-from and -limit need the " +
+			"backup read in order (-input-workers 1)")
+	}
+	if *restoreAdaptive &&
+		(*restoreAdaptiveMax < minWorkers || *restoreAdaptiveMax > maxWorkers) {
+		return stats, fmt.Errorf("-adaptive-max must be from %v to %v",
+			minWorkers, maxWorkers)
+	}
+	if *restorePrefix != "" {
+		if _, err := cleanPath(*restorePrefix); err != nil {
+			return stats, fmt.Errorf("Error parsing -prefix: %v", err)
+		}
+	}
+
+	if *restoreExpire != "keep" {
+		exp, err := strconv.Atoi(*restoreExpire)
+		if err != nil {
+			return stats, fmt.Errorf("Error parsing expiration: %v", err)
+		}
+		if err := checkExpiration(exp, time.Now()); err != nil {
+			if !*restoreForceExpire {
+				return stats, fmt.Errorf("Suspicious -expire: %v "+
+					"(give -force-expire if that's intended)", err)
+			}
+			mainLog.Printf("Warning: %v", err)
+		}
+	}
+
+	switch *restoreFormat {
+	case "auto", "json", "tar":
+	default:
+		return stats, fmt.Errorf("Unknown -format %q (want json, tar or auto)",
+			*restoreFormat)
+	}
+
+	rateEvery, err := rateInterval(*restoreRate)
+	if err != nil {
+		return stats, err
+	}
+
+	if *restoreHookInterval < 0 {
+		return stats, errors.New("-hook-interval can't be negative")
+	}
+
+	if *restoreResume && *restoreCheckpoint == "" {
+		return stats, errors.New("-resume requires -checkpoint")
+	}
+
+	var cp *checkpoint
+	if *restoreCheckpoint != "" {
+		cp, err = openCheckpoint(*restoreCheckpoint, *restoreResume)
+		if err != nil {
+			return stats, fmt.Errorf("Error loading checkpoint: %v", err)
+		}
+
+		quit := make(chan bool)
+		defer close(quit)
+		go func() {
+			t := time.NewTicker(checkpointInterval)
+			defer t.Stop()
+			for {
+				select {
+				case <-t.C:
+					if err := cp.save(); err != nil {
+						mainLog.Errorf("Error saving checkpoint: %v", err)
+					}
+				case <-quit:
+					return
+				}
+			}
+		}()
+	}
+
+	restoreSince = nil
+	if *restoreSinceCheckpoint != "" {
+		restoreSince, err = openSinceCheckpoint(*restoreSinceCheckpoint)
+		if err != nil {
+			return stats, fmt.Errorf("Error loading -since-checkpoint: %v", err)
+		}
+		defer func() { restoreSince = nil }()
+		if !restoreSince.since.IsZero() {
+			mainLog.Noticef("Restoring entries modified after %v",
+				restoreSince.since.Format(time.RFC3339Nano))
+		}
+	}
+
+	key, err := loadBackupKey(*restoreKeyfile)
+	if err != nil {
+		return stats, fmt.Errorf("Error loading backup key: %v", err)
+	}
+
+	segs, err := backupSegments(fn)
+	if err != nil {
+		return stats, fmt.Errorf("Error finding backup files: %v", err)
+	}
+
+	closeQuarantine, err := openQuarantine()
+	if err != nil {
+		return stats, fmt.Errorf("Error creating quarantine: %v", err)
+	}
+	defer closeQuarantine()
+
+	stopSampling := startErrorSampling()
+	defer stopSampling()
+
+	total, totalBytes := *restoreTotal, int64(0)
+	if *restorePrecheck {
+		pre, err := precheckBackup(segs, key, newResumePoint().wrap(matches))
+		if err != nil {
+			return stats, fmt.Errorf("Precheck failed: %v", err)
+		}
+		mainLog.Noticef("Precheck passed: %v entries, %v matching, %v malformed",
+			pre.Seen, pre.Matched, pre.Quarantined)
+		if total == 0 {
+			total = pre.Matched
+		}
+		if pre.UnknownSize == 0 {
+			totalBytes = pre.Bytes
+		}
+	}
+
+	start := time.Now()
+
+	if *restoreDebugAddr != "" {
+		if err := serveDebug(*restoreDebugAddr); err != nil {
+			return stats, fmt.Errorf("Error serving debug info: %v", err)
+		}
+		publishStats(stats, start)
+	}
+
+	conns := *restoreWorkers
+	if *restoreAdaptive {
+		conns = *restoreAdaptiveMax
+	}
+	restoreClient = newHTTPClient(*restoreTimeout, conns*len(targets),
+		*restoreHTTP2)
+
+	// Scripts and -n runs only need the cluster when they're used.
+	if *restoreProbe && *restoreEmitScript == "" && !*restoreNoop {
+		for _, t := range targets {
+			if err := probeCluster(ctx, t); err != nil {
+				return stats, err
+			}
+		}
+	}
+
+	if *restoreValidateHash {
+		err := validateHashFormat(ctx, targets, segs, key, matches)
+		if err != nil && !*restoreForce {
+			return stats, fmt.Errorf("Hash format check failed: %v "+
+				"(give -f to restore anyway)", err)
+		}
+		if err != nil {
+			mainLog.Printf("WARNING: %v", err)
+		}
+	}
+
+	restoreFetcher = nil
+	if *restoreFetchFrom != "" {
+		restoreFetcher, err = newBlobFetcher(*restoreFetchFrom, ustr,
+			*restoreFetchWorkers)
+		if err != nil {
+			return stats, fmt.Errorf("Error setting up -fetch-from: %v", err)
+		}
+	}
+
+	// A script is written by a single worker, in backup order.
+	workers := *restoreWorkers
+	if *restoreAdaptive {
+		workers = adaptiveStart
+	}
+	restoreScriptOut = nil
+	if *restoreEmitScript != "" {
+		workers = 1
+		restoreScriptOut, err = createRestoreScript(*restoreEmitScript)
+		if err != nil {
+			return stats, fmt.Errorf("Error creating script: %v", err)
+		}
+	}
+
+	restoreMissing = nil
+	if *restoreOnlyMissing {
+		restoreMissing, err = createMissingList(*restoreMissingOut)
+		if err != nil {
+			return stats, fmt.Errorf("Error creating missing list: %v", err)
+		}
+	}
+
+	// Too many failures stop everything, as if interrupted twice.
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+	reqCtx, abort := context.WithCancel(reqCtx)
+	defer abort()
 
-	log.Printf("Restored %v files in %v", nfiles, time.Since(start))
+	// With -fail-fast, the first failure (a file that couldn't be
+	// restored even after retries) is enough.  No more entries are
+	// decoded or sent, and requests in flight are cancelled; each of
+	// those may or may not have been applied by the server.
+	maxFailures := *restoreMaxFailures
+	if *restoreFailFast {
+		maxFailures = 1
+	}
+	tripped := false
+	trip := func() {
+		if *restoreFailFast {
+			mainLog.Printf("Aborting at the first failure")
+		} else {
+			mainLog.Printf("Aborting after %v failures", maxFailures)
+		}
+		tripped = true
+		stop()
+		abort()
+	}
+
+	var rep *restoreReport
+	if *restoreReportFile != "" {
+		rep = &restoreReport{}
+	}
+	var targetStats map[string]*restoreStats
+	if len(targets) > 1 {
+		targetStats = map[string]*restoreStats{}
+		for _, t := range targets {
+			targetStats[t] = &restoreStats{}
+		}
+		if rep != nil {
+			rep.Targets = targetStats
+		}
+	}
+	results := make(chan restoreResult)
+	collected := make(chan bool)
+	dl, err := createDeadletter(*restoreDeadletter)
+	if err != nil {
+		return stats, fmt.Errorf("Error creating deadletter file: %v", err)
+	}
+	hook := newHookRunner(*restoreHook, *restoreHookInterval)
+	go collectResults(results, stats, targetStats, rep, dl, hook,
+		maxFailures, trip, collected)
+
+	progressDone := make(chan bool)
+	if *restoreProgress {
+		n := int64(len(targets))
+		go showProgress(stats, total*n, totalBytes*n, progressDone)
+	}
+
+	// Every worker, whatever its target, waits on the same ticker, so
+	// -rate limits the restore as a whole.
+	var throttle <-chan time.Time
+	if rateEvery > 0 {
+		t := time.NewTicker(rateEvery)
+		defer t.Stop()
+		throttle = t.C
+	}
+
+	// Each target gets its own workers, fed from its own queue.
+	// Buffer decoded items so a burst of slow requests doesn't stall
+	// decoding (and vice versa) on backups of many small files.
+	var pools []*workerPool
+	queues := make([]chan restoreWorkItem, len(targets))
+	stopResizing := make(chan bool)
+	resizing := &sync.WaitGroup{}
+	for i, target := range targets {
+		target, q := target, make(chan restoreWorkItem, *restoreBuffer)
+		queues[i] = q
+
+		tctx := reqCtx
+		if len(targets) > 1 {
+			tctx = withTargetLog(reqCtx, cbfstool.ParseURL(target).Host)
+		}
+		var ctl *adaptiveController
+		if *restoreAdaptive && restoreScriptOut == nil {
+			ctl = &adaptiveController{max: *restoreAdaptiveMax}
+			tctx = withAdaptive(tctx, ctl)
+		}
+		pool := newWorkerPool(workers,
+			func(id int, wg *sync.WaitGroup, quit <-chan bool) {
+				restoreWorker(withWorkerLog(tctx, id), wg, quit, ctx.Done(),
+					target, q, results, cp, throttle)
+			})
+		pools = append(pools, pool)
+
+		resizing.Add(1)
+		go func() {
+			resizeOnSignal(pool, stopResizing)
+			resizing.Done()
+		}()
+		if ctl != nil {
+			ctl.pool = pool
+			resizing.Add(1)
+			go func() {
+				ctl.run(stopResizing)
+				resizing.Done()
+			}()
+		}
+	}
+
+	ch := queues[0]
+	if len(targets) > 1 {
+		ch = make(chan restoreWorkItem, *restoreBuffer)
+		go fanOut(ch, queues)
+	}
+
+	// With -dedup-latest, everything is read before any of it is
+	// restored.
+	input, deduped := ch, make(chan bool)
+	if *restoreDedupLatest {
+		input = make(chan restoreWorkItem, *restoreBuffer)
+		go func() {
+			dedupLatest(ctx, input, ch, stats)
+			close(deduped)
+		}()
+	}
+
+	// With -warn-dupes, every path read passes a single watcher.
+	readInput, dupes := input, make(chan int, 1)
+	if *restoreWarnDupes {
+		readInput = make(chan restoreWorkItem, *restoreBuffer)
+		go func() { dupes <- warnDupes(ctx, readInput, input) }()
+	}
+
+	// Reaching the -limit stops just the reading, leaving the workers
+	// to finish what was read.
+	readCtx, stopReading := context.WithCancel(ctx)
+	defer stopReading()
+	limit := newEntryLimit(stopReading)
+
+	resume := newResumePoint()
+	readMatches := limit.wrap(resume.wrap(matches))
+	readErr := readSegments(readCtx, segs, *restoreInputWorkers,
+		func(ctx context.Context, seg string) error {
+			return readBackup(ctx, seg, key, readMatches, cp, stats, readInput)
+		})
+	if *restoreWarnDupes {
+		close(readInput)
+		if n := <-dupes; n > 0 {
+			mainLog.Printf("WARNING: %v paths appear more than once in the "+
+				"backup", n)
+		}
+	}
+	if *restoreDedupLatest {
+		close(input)
+		<-deduped
+	}
+	close(stopResizing)
+	resizing.Wait()
+	if *restoreAdaptive {
+		mainLog.Noticef("-adaptive settled on %v workers",
+			restoreConcurrency.Value())
+	}
+	close(ch)
+	for _, pool := range pools {
+		pool.wait()
+	}
+	close(results)
+	<-collected
+	close(progressDone)
+	stopSampling()
+
+	if err := dl.Close(); err != nil {
+		return stats, fmt.Errorf("Error writing deadletter file: %v", err)
+	}
+
+	if err := closeQuarantine(); err != nil {
+		return stats, fmt.Errorf("Error writing quarantine: %v", err)
+	}
+
+	if restoreScriptOut != nil {
+		if err := restoreScriptOut.Close(); err != nil {
+			return stats, fmt.Errorf("Error writing script: %v", err)
+		}
+	}
+
+	if restoreMissing != nil {
+		if err := restoreMissing.Close(); err != nil {
+			return stats, fmt.Errorf("Error writing missing list: %v", err)
+		}
+	}
+
+	if err := cp.save(); err != nil {
+		return stats, fmt.Errorf("Error saving checkpoint: %v", err)
+	}
+
+	if rep != nil {
+		rep.restoreStats = *stats
+		if err := writeReport(*restoreReportFile, rep); err != nil {
+			return stats, fmt.Errorf("Error writing report: %v", err)
+		}
+	}
+
+	switch {
+	case restoreScriptOut != nil:
+		mainLog.Summary(stats, "Matched %v of %v files in %v: %v scripted, %v failed",
+			stats.Matched, stats.Seen, time.Since(start), stats.Restored,
+			stats.Failed)
+	case *restoreOnlyMissing:
+		mainLog.Summary(stats, "Matched %v of %v files in %v: %v missing, %v present, %v failed",
+			stats.Matched, stats.Seen, time.Since(start), stats.Restored,
+			stats.Skipped, stats.Failed)
+	case *restoreDiff:
+		mainLog.Summary(stats, "Matched %v of %v files in %v: %v differ, %v unchanged, %v failed",
+			stats.Matched, stats.Seen, time.Since(start), stats.Restored,
+			stats.Skipped, stats.Failed)
+	default:
+		if stats.Responses.total() > 0 {
+			mainLog.Noticef("Responses:")
+			for _, row := range stats.Responses.rows() {
+				mainLog.Noticef("  %v", row)
+			}
+		}
+		mainLog.Summary(stats, "Matched %v of %v files in %v: %v restored, %v unchanged, %v skipped, %v failed",
+			stats.Matched, stats.Seen, time.Since(start), stats.Restored,
+			stats.Unchanged, stats.Skipped, stats.Failed)
+	}
+	for _, t := range targets {
+		if ts := targetStats[t]; ts != nil {
+			mainLog.Noticef("%v: %v restored, %v unchanged, %v skipped, %v failed",
+				t, ts.Restored, ts.Unchanged, ts.Skipped, ts.Failed)
+		}
+	}
+	if *restoreVerify {
+		mainLog.Noticef("%v restored files failed verification", stats.Mismatched)
+	}
+	if stats.Quarantined > 0 {
+		mainLog.Noticef("%v malformed records were skipped", stats.Quarantined)
+	}
+	if stats.Oversized > 0 {
+		mainLog.Noticef("%v entries with over %v bytes of metadata were "+
+			"skipped", stats.Oversized, *restoreMaxMetaBytes)
+	}
+	if limit.reached() {
+		mainLog.Noticef("Stopped reading the backup after %v matching "+
+			"entries (-limit)", *restoreLimit)
+	}
+	hook.finish(stats)
+
+	switch {
+	case tripped && *restoreFailFast:
+		return stats, fmt.Errorf("Restore aborted at the first failure, "+
+			"with %v restored and %v failed (counting cancelled requests)",
+			stats.Restored, stats.Failed)
+	case tripped:
+		return stats, fmt.Errorf("Restore aborted after %v failures",
+			stats.Failed)
+	case readErr != nil:
+		return stats, readErr
+	case ctx.Err() == context.DeadlineExceeded:
+		return stats, fmt.Errorf("Restore stopped at the %v deadline, "+
+			"leaving %v", *restoreDeadline, unprocessed(stats, total, len(targets)))
+	case ctx.Err() != nil:
+		return stats, fmt.Errorf("Restore was interrupted before completion, "+
+			"leaving %v", unprocessed(stats, total, len(targets)))
+	case !resume.done():
+		return stats, fmt.Errorf("-resume-from path %v isn't in the backup, "+
+			"so nothing was restored", *restoreResumeFrom)
+	}
+
+	// Only a run that restored everything after the saved time can
+	// move it on; otherwise the next one tries again.
+	clean := stats.Failed == 0 && stats.Mismatched == 0 && !limit.reached()
+	changed := !*restoreNoop && !*restoreDiff && !*restoreOnlyMissing &&
+		*restoreEmitScript == ""
+	if clean && changed {
+		if err := restoreSince.save(); err != nil {
+			return stats, fmt.Errorf("Error saving -since-checkpoint: %v", err)
+		}
+	}
+	return stats, nil
+}
+
+func restoreCommand(ustr string, args []string) {
+	// The first interrupt stops dispatching new work and lets
+	// in-flight restores finish.  A second aborts those as well.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reqCtx, abort := context.WithCancel(context.Background())
+	defer abort()
+
+	sigch := make(chan os.Signal, 2)
+	signal.Notify(sigch, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigch
+		mainLog.Printf("Interrupted, waiting for in-flight restores " +
+			"(interrupt again to abort)")
+		cancel()
+		<-sigch
+		mainLog.Printf("Aborting in-flight restores")
+		abort()
+	}()
+
+	sendHeadersTo(append(restoreTargets(ustr), *restoreFetchFrom)...)
+
+	if *restoreDryRunCount {
+		_, err := countBackup(os.Stdout, restoreFlags.Arg(0))
+		cbfstool.MaybeFatal(err, "%v", err)
+		return
+	}
+
+	if *restoreOIDOnly {
+		stats, err := restoreOIDs(ctx, reqCtx, ustr, restoreFlags.Arg(0))
+		cbfstool.MaybeFatal(err, "%v", err)
+		if stats.Missing > 0 || stats.Failed > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	stats, err := restore(ctx, reqCtx, ustr, restoreFlags.Arg(0))
+	cbfstool.MaybeFatal(err, "%v", err)
+	if status := restoreStatus(stats); status != 0 {
+		os.Exit(status)
+	}
+}
+
+// The exit status for a restore that finished with stats: 1 if any
+// file failed or (with -verify) came back with the wrong hash.
+func restoreStatus(stats *restoreStats) int {
+	if stats.Failed > 0 || stats.Mismatched > 0 {
+		return 1
+	}
+	return 0
 }
@@ -0,0 +1,1489 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/couchbaselabs/cbfs/client"
+	"github.com/couchbaselabs/cbfs/tools"
+)
+
+func TestRestoreErrorMessage(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			http.Error(w, "the disk is on fire", 500)
+		}))
+	defer ts.Close()
+
+	defer func(r int) { *restoreRetries = r }(*restoreRetries)
+	*restoreRetries = 0
+
+	meta := json.RawMessage(`{"oid": "abc"}`)
+	_, err := restoreFile(context.Background(), newRestoreClient(ts.URL),
+		"some/file.txt", &meta)
+	if err == nil {
+		t.Fatalf("Expected error restoring against a failing server")
+	}
+	for _, exp := range []string{"some/file.txt", "500", "the disk is on fire"} {
+		if !strings.Contains(err.Error(), exp) {
+			t.Errorf("Expected %q in error, got %q", exp, err)
+		}
+	}
+}
+
+// A cluster behind a proxy under a subpath keeps its prefix.
+func TestRestorePathPrefix(t *testing.T) {
+	var got string
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			got = req.URL.Path
+			w.WriteHeader(201)
+		}))
+	defer ts.Close()
+
+	meta := json.RawMessage(`{"oid": "abc"}`)
+	_, err := restoreFile(context.Background(), newRestoreClient(ts.URL+"/cbfs/"),
+		"a/b.txt", &meta)
+	if err != nil {
+		t.Fatalf("Error restoring: %v", err)
+	}
+	if exp := "/cbfs/.cbfs/backup/restore/a/b.txt"; got != exp {
+		t.Errorf("Expected a request for %v, got %v", exp, got)
+	}
+}
+
+// -no-downgrade leaves files alone where the cluster's revision is
+// newer than the backup's.
+func TestRestoreNoDowngrade(t *testing.T) {
+	defer func(f, d bool) {
+		*restoreForce, *restoreNoDowngrade = f, d
+	}(*restoreForce, *restoreNoDowngrade)
+	*restoreForce, *restoreNoDowngrade = true, true
+
+	posts := 0
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			switch req.URL.Path {
+			case "/.cbfs/backup/restore/newer", "/.cbfs/backup/restore/older",
+				"/.cbfs/backup/restore/missing":
+				posts++
+				w.WriteHeader(201)
+			case "/.cbfs/info/file/newer":
+				w.Write([]byte(`{"path": "newer", "meta": {"revno": 5}}`))
+			case "/.cbfs/info/file/older":
+				w.Write([]byte(`{"path": "older", "meta": {"revno": 1}}`))
+			case "/.cbfs/info/file/broken":
+				http.Error(w, "no", 500)
+			default:
+				w.WriteHeader(404)
+			}
+		}))
+	defer ts.Close()
+
+	meta := json.RawMessage(`{"oid": "abc", "revno": 3}`)
+	tests := []struct {
+		path  string
+		err   bool
+		posts int
+	}{
+		{"newer", true, 0},
+		{"older", false, 1},
+		{"missing", false, 2},
+		{"broken", true, 2},
+	}
+	for _, test := range tests {
+		_, err := restoreFile(context.Background(), newRestoreClient(ts.URL),
+			test.path, &meta)
+		if (err != nil) != test.err || posts != test.posts {
+			t.Errorf("On %v, expected error=%v after %v posts, got %v after %v",
+				test.path, test.err, test.posts, err, posts)
+		}
+	}
+	if _, err := restoreFile(context.Background(), newRestoreClient(ts.URL),
+		"newer", &meta); err != errExists {
+		t.Errorf("Expected a newer file to be skipped, got %v", err)
+	}
+}
+
+// -skip-existing only POSTs files the cluster doesn't have.
+func TestRestoreSkipExisting(t *testing.T) {
+	defer func(v bool) { *restoreSkipExisting = v }(*restoreSkipExisting)
+	*restoreSkipExisting = true
+
+	var posts int64
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			switch {
+			case req.Method == "POST":
+				atomic.AddInt64(&posts, 1)
+				w.WriteHeader(201)
+			case req.URL.Path == "/same":
+				w.Header().Set("Etag", `"abc"`)
+			case req.URL.Path == "/other":
+				w.Header().Set("Etag", `"def"`)
+			default:
+				w.WriteHeader(404)
+			}
+		}))
+	defer ts.Close()
+
+	meta := json.RawMessage(`{"oid": "abc"}`)
+	tests := []struct {
+		path  string
+		err   error
+		posts int64
+	}{
+		{"same", errExists, 0},
+		{"other", nil, 1},
+		{"missing", nil, 2},
+	}
+	for _, test := range tests {
+		requested, err := restoreFile(context.Background(), newRestoreClient(ts.URL),
+			test.path, &meta)
+		if n := atomic.LoadInt64(&posts); err != test.err || n != test.posts {
+			t.Errorf("On %v, expected %v after %v posts, got %v after %v",
+				test.path, test.err, test.posts, err, n)
+		}
+		if requested != (test.err == nil) {
+			t.Errorf("On %v, expected requested=%v, got %v",
+				test.path, test.err == nil, requested)
+		}
+	}
+
+	// Files skipped are counted as skipped, not as 409 responses the
+	// cluster never sent.
+	fn := writeTestBackup(t, "same", "other", "missing")
+	defer os.Remove(fn)
+	stats, err := restore(context.Background(), context.Background(),
+		ts.URL, fn)
+	if err != nil {
+		t.Fatalf("Error restoring: %v", err)
+	}
+	exp := restoreStats{Seen: 3, Matched: 3, Restored: 2, Skipped: 1,
+		UnknownSize: 3, Responses: statusCounts{Created: 2}}
+	if withoutTimes(*stats) != exp {
+		t.Errorf("Expected %+v, got %+v", exp, *stats)
+	}
+}
+
+func TestSlowThreshold(t *testing.T) {
+	defer func(d time.Duration) { *restoreSlowThreshold = d }(*restoreSlowThreshold)
+	defer restoreLog.SetOutput(os.Stderr)
+
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			if strings.HasSuffix(req.URL.Path, "/slow") {
+				time.Sleep(50 * time.Millisecond)
+			}
+			w.WriteHeader(201)
+		}))
+	defer ts.Close()
+
+	meta := json.RawMessage(`{"oid": "abc"}`)
+	tests := []struct {
+		path      string
+		threshold time.Duration
+		warned    bool
+	}{
+		{"fast", 20 * time.Millisecond, false},
+		{"slow", 20 * time.Millisecond, true},
+		{"slow", 0, false},
+	}
+	for _, test := range tests {
+		buf := &bytes.Buffer{}
+		restoreLog.SetOutput(buf)
+		*restoreSlowThreshold = test.threshold
+
+		if _, err := restoreTimed(context.Background(), newRestoreClient(ts.URL),
+			test.path, &meta); err != nil {
+			t.Fatalf("Error restoring %v: %v", test.path, err)
+		}
+		warned := strings.Contains(buf.String(), "Slow restore of "+test.path)
+		if warned != test.warned {
+			t.Errorf("Expected warning=%v for %v with threshold %v, got %q",
+				test.warned, test.path, test.threshold, buf.String())
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	calls := 0
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			calls++
+			if calls == 1 {
+				w.Header().Set("Retry-After", "1")
+				http.Error(w, "rebalancing", 503)
+				return
+			}
+			w.WriteHeader(201)
+		}))
+	defer ts.Close()
+
+	defer func(d time.Duration) { *restoreRetryBase = d }(*restoreRetryBase)
+	*restoreRetryBase = time.Millisecond
+
+	start := time.Now()
+	meta := json.RawMessage(`{"oid": "abc"}`)
+	if _, err := restoreFile(context.Background(), newRestoreClient(ts.URL),
+		"f", &meta); err != nil {
+		t.Fatalf("Error restoring: %v", err)
+	}
+	if d := time.Since(start); calls != 2 || d < time.Second {
+		t.Errorf("Expected a second attempt after 1s, got %v calls in %v",
+			calls, d)
+	}
+
+}
+
+func TestRestoreContentType(t *testing.T) {
+	// Stores restored headers and serves them back the way the
+	// server does.
+	stored := map[string]http.Header{}
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			if p := strings.TrimPrefix(req.URL.Path,
+				"/.cbfs/backup/restore/"); p != req.URL.Path {
+				fm := struct{ Headers http.Header }{}
+				json.NewDecoder(req.Body).Decode(&fm)
+				stored[p] = fm.Headers
+				w.WriteHeader(201)
+				return
+			}
+			for k, v := range stored[req.URL.Path[1:]] {
+				if strings.ToLower(k) == "content-type" {
+					w.Header()[k] = v
+				}
+			}
+			w.Write([]byte("not really a png"))
+		}))
+	defer ts.Close()
+
+	tests := map[string]string{
+		"headers":   `{"oid": "a", "headers": {"Content-Type": ["image/png"]}}`,
+		"lowercase": `{"oid": "a", "headers": {"content-type": ["image/png"]}}`,
+		"ctype":     `{"oid": "a", "ctype": "image/png"}`,
+	}
+	for path, meta := range tests {
+		m := json.RawMessage(meta)
+		if _, err := restoreFile(context.Background(), newRestoreClient(ts.URL),
+			path, &m); err != nil {
+			t.Fatalf("Error restoring %v: %v", path, err)
+		}
+		res, err := http.Get(ts.URL + "/" + path)
+		if err != nil {
+			t.Fatalf("Error fetching %v: %v", path, err)
+		}
+		res.Body.Close()
+		if got := res.Header["Content-Type"]; !reflect.DeepEqual(got,
+			[]string{"image/png"}) {
+			t.Errorf("Expected image/png for %v, got %v", path, got)
+		}
+	}
+}
+
+// Typed entries survive a round trip through export, and only files
+// are handed to the workers.
+func TestMixedEntryTypes(t *testing.T) {
+	const stream = `{"path":"d","meta":{},"type":"dir"}
+{"path":"d/old","meta":{"oid":"aaa"}}
+{"path":"d/new","meta":{"oid":"bbb"},"type":"file"}
+`
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			fmt.Fprint(w, stream)
+		}))
+	defer ts.Close()
+
+	buf := &bytes.Buffer{}
+	if _, err := export(ts.URL, "", buf, func(string) bool { return true },
+		time.Time{}, false); err != nil {
+		t.Fatalf("Error exporting: %v", err)
+	}
+	if buf.String() != stream {
+		t.Errorf("Expected export of\n%s\ngot\n%s", stream, buf)
+	}
+
+	stats := &restoreStats{}
+	ch := make(chan restoreWorkItem, 10)
+	err := decodeBackup(context.Background(), buf,
+		func(string) bool { return true }, nil, stats, ch)
+	if err != nil {
+		t.Fatalf("Error decoding: %v", err)
+	}
+	close(ch)
+
+	got := []string{}
+	for ob := range ch {
+		got = append(got, ob.kind()+" "+ob.Path)
+	}
+	exp := []string{"file d/old", "file d/new"}
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("Expected %v, got %v", exp, got)
+	}
+	if (withoutTimes(*stats) != restoreStats{Seen: 3, Matched: 3, Skipped: 1,
+		UnknownSize: 2}) {
+		t.Errorf("Expected one skipped directory, got %+v", *stats)
+	}
+}
+
+// The counts of stats, without the timings that vary run to run.
+func withoutTimes(stats restoreStats) restoreStats {
+	stats.DecodeNanos, stats.BlockedNanos = 0, 0
+	return stats
+}
+
+// Decoding a backup of small files, one per op.  Run with
+// -benchtime 1000000x for a million file backup.
+func BenchmarkDecodeBackup(b *testing.B) {
+	b.ReportAllocs()
+	buf := &bytes.Buffer{}
+	e := json.NewEncoder(buf)
+	for i := 0; i < b.N; i++ {
+		e.Encode(map[string]interface{}{
+			"path": fmt.Sprintf("some/dir/file%d.txt", i),
+			"meta": map[string]interface{}{"oid": "abc", "length": i},
+		})
+	}
+	b.SetBytes(int64(buf.Len() / b.N))
+	b.ResetTimer()
+
+	ch := make(chan restoreWorkItem, *restoreBuffer)
+	go func() {
+		for range ch {
+		}
+	}()
+	err := decodeBackup(context.Background(), buf,
+		func(string) bool { return true }, nil, &restoreStats{}, ch)
+	close(ch)
+	if err != nil {
+		b.Fatalf("Error decoding: %v", err)
+	}
+}
+
+// Write a gzipped backup containing the given paths.
+func writeTestBackup(t *testing.T, paths ...string) string {
+	f, err := ioutil.TempFile("", "restore-test")
+	if err != nil {
+		t.Fatalf("Error creating backup file: %v", err)
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	e := json.NewEncoder(gz)
+	for _, p := range paths {
+		e.Encode(map[string]interface{}{
+			"path": p,
+			"meta": map[string]interface{}{"oid": "abc"},
+		})
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatalf("Error writing backup file: %v", err)
+	}
+	return f.Name()
+}
+
+func TestRestore(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			switch req.URL.Path {
+			case "/.cbfs/backup/restore/exists":
+				http.Error(w, "exists", 409)
+			case "/.cbfs/backup/restore/same":
+				w.WriteHeader(304)
+			case "/.cbfs/backup/restore/broken":
+				http.Error(w, "bad request", 400)
+			default:
+				w.WriteHeader(201)
+			}
+		}))
+	defer ts.Close()
+
+	fn := writeTestBackup(t, "a", "b", "exists", "same", "broken", "x/c")
+	defer os.Remove(fn)
+
+	tests := []struct {
+		match string
+		exp   restoreStats
+	}{
+		{".*", restoreStats{Seen: 6, Matched: 6, Restored: 3,
+			Skipped: 1, Unchanged: 1, Failed: 1, UnknownSize: 6,
+			Responses: statusCounts{Created: 3, NotModified: 1, Exists: 1,
+				ClientError: 1}}},
+		{"^x/", restoreStats{Seen: 6, Matched: 1, Restored: 1,
+			UnknownSize: 1, Responses: statusCounts{Created: 1}}},
+		{"^nothing", restoreStats{Seen: 6}},
+	}
+
+	defer func(m string) { *restorePat = m }(*restorePat)
+	for _, test := range tests {
+		*restorePat = test.match
+		stats, err := restore(context.Background(), context.Background(),
+			ts.URL, fn)
+		if err != nil {
+			t.Errorf("Error restoring %v: %v", test.match, err)
+			continue
+		}
+		if withoutTimes(*stats) != test.exp {
+			t.Errorf("Expected %+v for %v, got %+v",
+				test.exp, test.match, *stats)
+		}
+	}
+}
+
+// Compare restoring small files with the default client and the one
+// restore configures, with as many concurrent workers as restore
+// uses by default.  "conns/op" is new connections per file.
+//
+// The default client keeps only two idle connections per host, so
+// the other workers keep opening (and throwing away) connections.
+func BenchmarkRestoreClient(b *testing.B) {
+	var conns int64
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			// Enough latency for requests to overlap.
+			time.Sleep(100 * time.Microsecond)
+			w.WriteHeader(201)
+		}))
+	ts.Config.ConnState = func(c net.Conn, s http.ConnState) {
+		if s == http.StateNew {
+			atomic.AddInt64(&conns, 1)
+		}
+	}
+	ts.Start()
+	defer ts.Close()
+
+	meta := json.RawMessage(`{"oid": "abc"}`)
+	for _, test := range []struct {
+		name   string
+		client *http.Client
+	}{
+		{"default", http.DefaultClient},
+		{"tuned", newHTTPClient(0, 4, true)},
+	} {
+		b.Run(test.name, func(b *testing.B) {
+			c := &cbfstool.RestoreClient{Base: ts.URL, Client: test.client}
+			atomic.StoreInt64(&conns, 0)
+			wg := sync.WaitGroup{}
+			work := make(chan bool)
+			for i := 0; i < 4; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for range work {
+						err := c.Restore("f", meta)
+						if err != nil {
+							b.Errorf("Error restoring: %v", err)
+						}
+					}
+				}()
+			}
+			for i := 0; i < b.N; i++ {
+				work <- true
+			}
+			close(work)
+			wg.Wait()
+			b.ReportMetric(float64(atomic.LoadInt64(&conns))/float64(b.N),
+				"conns/op")
+		})
+	}
+}
+
+func TestRestoreMaxFailures(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			http.Error(w, "no", 400)
+		}))
+	defer ts.Close()
+
+	paths := []string{}
+	for i := 0; i < 100; i++ {
+		paths = append(paths, fmt.Sprintf("f%v", i))
+	}
+	fn := writeTestBackup(t, paths...)
+	defer os.Remove(fn)
+
+	defer func(n int64) { *restoreMaxFailures = n }(*restoreMaxFailures)
+	*restoreMaxFailures = 5
+
+	stats, err := restore(context.Background(), context.Background(),
+		ts.URL, fn)
+	if err == nil {
+		t.Fatalf("Expected the restore to be aborted")
+	}
+	// Workers may each finish one more request after the limit trips.
+	if limit := 5 + int64(*restoreWorkers); stats.Failed < 5 || stats.Failed > limit {
+		t.Errorf("Expected 5-%v failures, got %+v", limit, *stats)
+	}
+}
+
+// With -fail-fast, one failure stops the restore, cancelling what's in
+// flight.
+func TestRestoreFailFast(t *testing.T) {
+	posts := int64(0)
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			atomic.AddInt64(&posts, 1)
+			if strings.HasSuffix(req.URL.Path, "/f3") {
+				http.Error(w, "no", 400)
+				return
+			}
+			select {
+			case <-time.After(10 * time.Millisecond):
+			case <-req.Context().Done():
+			}
+			w.WriteHeader(201)
+		}))
+	defer ts.Close()
+
+	paths := []string{}
+	for i := 0; i < 100; i++ {
+		paths = append(paths, fmt.Sprintf("f%v", i))
+	}
+	fn := writeTestBackup(t, paths...)
+	defer os.Remove(fn)
+
+	defer func(f bool, n int64) {
+		*restoreFailFast, *restoreMaxFailures = f, n
+	}(*restoreFailFast, *restoreMaxFailures)
+	*restoreFailFast = true
+
+	stats, err := restore(context.Background(), context.Background(),
+		ts.URL, fn)
+	if err == nil || !strings.Contains(err.Error(), "at the first failure") {
+		t.Fatalf("Expected the restore to fail fast, got %v", err)
+	}
+	if stats.Failed < 1 || stats.Restored+stats.Failed >= 100 {
+		t.Errorf("Expected a failure to stop the restore early, got %+v",
+			*stats)
+	}
+	if n := atomic.LoadInt64(&posts); n >= 100 {
+		t.Errorf("Expected requests to stop, got %v", n)
+	}
+
+	*restoreMaxFailures = 5
+	_, err = restore(context.Background(), context.Background(), ts.URL, fn)
+	if err == nil || !strings.Contains(err.Error(), "can't both be given") {
+		t.Errorf("Expected -fail-fast with -max-failures refused, got %v", err)
+	}
+}
+
+func TestRestorePrecheck(t *testing.T) {
+	posts := int64(0)
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			atomic.AddInt64(&posts, 1)
+			w.WriteHeader(201)
+		}))
+	defer ts.Close()
+
+	paths := []string{}
+	for i := 0; i < 1000; i++ {
+		paths = append(paths, fmt.Sprintf("some/longish/path/%v", i))
+	}
+	fn := writeTestBackup(t, paths...)
+	defer os.Remove(fn)
+	st, err := os.Stat(fn)
+	if err != nil {
+		t.Fatalf("Error checking backup: %v", err)
+	}
+	if err := os.Truncate(fn, st.Size()/2); err != nil {
+		t.Fatalf("Error truncating backup: %v", err)
+	}
+
+	defer func(p bool) { *restorePrecheck = p }(*restorePrecheck)
+	*restorePrecheck = true
+
+	_, err = restore(context.Background(), context.Background(), ts.URL, fn)
+	if err == nil || !strings.Contains(err.Error(), "Precheck") {
+		t.Errorf("Expected precheck failure, got %v", err)
+	}
+	if posts != 0 {
+		t.Errorf("Expected nothing restored, got %v requests", posts)
+	}
+}
+
+// Every entry goes to every target, and each target's results are
+// tallied separately.
+func TestRestoreTargets(t *testing.T) {
+	good := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			w.WriteHeader(201)
+		}))
+	defer good.Close()
+	bad := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			http.Error(w, "no", 400)
+		}))
+	defer bad.Close()
+
+	fn := writeTestBackup(t, "a", "b", "c")
+	defer os.Remove(fn)
+
+	defer func(l targetList) { restoreExtraTargets = l }(restoreExtraTargets)
+	restoreExtraTargets = targetList{bad.URL, good.URL}
+
+	repfn := fn + ".report"
+	defer os.Remove(repfn)
+	defer func(s string) { *restoreReportFile = s }(*restoreReportFile)
+	*restoreReportFile = repfn
+
+	stats, err := restore(context.Background(), context.Background(),
+		good.URL, fn)
+	if err != nil {
+		t.Fatalf("Error restoring: %v", err)
+	}
+	if stats.Matched != 3 || stats.Restored != 3 || stats.Failed != 3 {
+		t.Errorf("Expected 3 matched, 3 restored and 3 failed, got %+v", *stats)
+	}
+
+	data, err := ioutil.ReadFile(repfn)
+	if err != nil {
+		t.Fatalf("Error reading report: %v", err)
+	}
+	rep := restoreReport{}
+	if err := json.Unmarshal(data, &rep); err != nil {
+		t.Fatalf("Error parsing report: %v", err)
+	}
+	g, b := rep.Targets[good.URL], rep.Targets[bad.URL]
+	if len(rep.Targets) != 2 || g == nil || b == nil ||
+		g.Restored != 3 || g.Failed != 0 || b.Restored != 0 || b.Failed != 3 {
+		t.Errorf("Expected 3 restored on %v and 3 failed on %v, got %s",
+			good.URL, bad.URL, data)
+	}
+	for _, f := range rep.Failures {
+		if f.Target != bad.URL {
+			t.Errorf("Expected failures on %v, got %+v", bad.URL, f)
+		}
+	}
+}
+
+func TestTargetList(t *testing.T) {
+	l := targetList{}
+	for _, s := range []string{"http://a/", "http://b/, http://c/"} {
+		if err := l.Set(s); err != nil {
+			t.Fatalf("Error setting %q: %v", s, err)
+		}
+	}
+	if err := l.Set("http://d/,"); err == nil {
+		t.Errorf("Expected an error on an empty target")
+	}
+	if exp := "http://a/,http://b/,http://c/"; l.String() != exp {
+		t.Errorf("Expected %v, got %v", exp, l.String())
+	}
+}
+
+// -only-missing lists what the cluster lacks without restoring it.
+func TestRestoreOnlyMissing(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			switch {
+			case req.Method != "HEAD":
+				t.Errorf("Unexpected %v of %v", req.Method, req.URL.Path)
+			case strings.HasPrefix(req.URL.Path, "/here"):
+				w.Header().Set("Etag", `"abc"`)
+			default:
+				w.WriteHeader(404)
+			}
+		}))
+	defer ts.Close()
+
+	fn := writeTestBackup(t, "here/a", "gone/b", "here/c", "gone/d")
+	defer os.Remove(fn)
+	out := fn + ".missing"
+	defer os.Remove(out)
+
+	defer func(b bool, s string) {
+		*restoreOnlyMissing, *restoreMissingOut = b, s
+	}(*restoreOnlyMissing, *restoreMissingOut)
+	*restoreOnlyMissing, *restoreMissingOut = true, out
+
+	stats, err := restore(context.Background(), context.Background(),
+		ts.URL, fn)
+	if err != nil {
+		t.Fatalf("Error checking: %v", err)
+	}
+	if stats.Restored != 2 || stats.Skipped != 2 || stats.Failed != 0 {
+		t.Errorf("Expected 2 missing and 2 present, got %+v", *stats)
+	}
+
+	data, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatalf("Error reading missing list: %v", err)
+	}
+	lines := strings.Fields(string(data))
+	sort.Strings(lines)
+	if exp := []string{"gone/b", "gone/d"}; !reflect.DeepEqual(lines, exp) {
+		t.Errorf("Expected %v missing, got %v", exp, lines)
+	}
+}
+
+// With -continue-on-decode-error, malformed records are set aside and
+// the rest are restored.
+func TestContinueOnDecodeError(t *testing.T) {
+	var mu sync.Mutex
+	restored := []string{}
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			mu.Lock()
+			restored = append(restored, req.URL.Path)
+			mu.Unlock()
+			w.WriteHeader(201)
+		}))
+	defer ts.Close()
+
+	f, err := ioutil.TempFile("", "corrupt")
+	if err != nil {
+		t.Fatalf("Error creating backup: %v", err)
+	}
+	defer os.Remove(f.Name())
+	fmt.Fprint(f, `{"path": "a", "meta": {"oid": "aaa"}}
+{"path": "b", "meta": {"oid": "bb
+{"path": 5, "meta": {}}
+{"path": "c", "meta": {"oid": "ccc"}}
+{"path": "d", "meta"`)
+	f.Close()
+
+	qfn := f.Name() + ".quarantine"
+	defer os.Remove(qfn)
+	defer func(b bool, s string) {
+		*restoreContinue, *restoreQuarantineFile = b, s
+		restoreQuarantine = nil
+	}(*restoreContinue, *restoreQuarantineFile)
+	*restoreContinue, *restoreQuarantineFile = true, qfn
+
+	stats, err := restore(context.Background(), context.Background(),
+		ts.URL, f.Name())
+	if err != nil {
+		t.Fatalf("Error restoring: %v", err)
+	}
+	sort.Strings(restored)
+	exp := []string{"/.cbfs/backup/restore/a", "/.cbfs/backup/restore/c"}
+	if !reflect.DeepEqual(restored, exp) || stats.Quarantined != 3 {
+		t.Errorf("Expected %v restored and 3 quarantined, got %v and %+v",
+			exp, restored, *stats)
+	}
+
+	q, err := ioutil.ReadFile(qfn)
+	if err != nil {
+		t.Fatalf("Error reading quarantine: %v", err)
+	}
+	expq := `{"path": "b", "meta": {"oid": "bb
+{"path": 5, "meta": {}}
+{"path": "d", "meta"
+`
+	if string(q) != expq {
+		t.Errorf("Expected quarantine of\n%s\ngot\n%s", expq, q)
+	}
+}
+
+// With -log-json, every line is a JSON event, ending with the summary.
+func TestLogJSON(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			switch {
+			case strings.HasSuffix(req.URL.Path, "/exists"):
+				w.WriteHeader(409)
+			case strings.HasSuffix(req.URL.Path, "/bad"):
+				http.Error(w, "no", 400)
+			default:
+				w.WriteHeader(201)
+			}
+		}))
+	defer ts.Close()
+
+	fn := writeTestBackup(t, "good", "exists", "bad")
+	defer os.Remove(fn)
+
+	buf := &bytes.Buffer{}
+	restoreLog.SetOutput(buf)
+	defer restoreLog.SetOutput(os.Stderr)
+	defer func(b bool) { *restoreLogJSON = b }(*restoreLogJSON)
+	*restoreLogJSON = true
+
+	restore(context.Background(), context.Background(), ts.URL, fn)
+
+	statuses := map[string]string{}
+	var last logEntry
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		e := logEntry{}
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("Error parsing log line %q: %v", line, err)
+		}
+		if e.Path != "" {
+			statuses[e.Path] = e.Level + " " + e.Status
+		}
+		last = e
+	}
+	exp := map[string]string{
+		"good":   "info restored",
+		"exists": "info skipped",
+		"bad":    "error failed",
+	}
+	if !reflect.DeepEqual(statuses, exp) {
+		t.Errorf("Expected events %v, got %v", exp, statuses)
+	}
+	if last.Status != "summary" || last.Summary == nil ||
+		last.Summary.Restored != 1 || last.Summary.Failed != 1 {
+		t.Errorf("Expected a final summary, got %+v", last)
+	}
+}
+
+// Cancelling stops a decoder blocked on busy workers, and the wait is
+// counted.
+func TestDecodeBackupCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+
+	stats := &restoreStats{}
+	in := strings.NewReader(`{"path": "a", "meta": {}} {"path": "b", "meta": {}}`)
+	err := decodeBackup(ctx, in, func(string) bool { return true }, nil,
+		stats, make(chan restoreWorkItem))
+	if err != nil {
+		t.Fatalf("Error decoding: %v", err)
+	}
+	if stats.Seen != 1 || time.Duration(stats.BlockedNanos) < 20*time.Millisecond {
+		t.Errorf("Expected to block on the first entry, got %+v", *stats)
+	}
+}
+
+// -dedup-latest restores only the newest of repeated paths.
+func TestRestoreDedupLatest(t *testing.T) {
+	mu := sync.Mutex{}
+	got := map[string]string{}
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			fm := cbfsclient.FileMeta{}
+			json.NewDecoder(req.Body).Decode(&fm)
+			mu.Lock()
+			got[req.URL.Path] = fm.OID
+			mu.Unlock()
+			w.WriteHeader(201)
+		}))
+	defer ts.Close()
+
+	f, err := ioutil.TempFile("", "dupes")
+	if err != nil {
+		t.Fatalf("Error creating backup: %v", err)
+	}
+	defer os.Remove(f.Name())
+	fmt.Fprint(f, `{"path": "a", "meta": {"oid": "a2", "revno": 2}}
+{"path": "b", "meta": {"oid": "b1", "revno": 1, "modified": "2014-01-01T00:00:00Z"}}
+{"path": "a", "meta": {"oid": "a1", "revno": 1}}
+{"path": "b", "meta": {"oid": "b2", "revno": 1, "modified": "2014-02-01T00:00:00Z"}}
+{"path": "c", "meta": {"oid": "c1"}}
+`)
+	f.Close()
+
+	defer func(b bool) { *restoreDedupLatest = b }(*restoreDedupLatest)
+	*restoreDedupLatest = true
+
+	stats, err := restore(context.Background(), context.Background(),
+		ts.URL, f.Name())
+	if err != nil {
+		t.Fatalf("Error restoring: %v", err)
+	}
+	exp := map[string]string{
+		"/.cbfs/backup/restore/a": "a2",
+		"/.cbfs/backup/restore/b": "b2",
+		"/.cbfs/backup/restore/c": "c1",
+	}
+	if !reflect.DeepEqual(got, exp) || stats.Restored != 3 || stats.Skipped != 2 {
+		t.Errorf("Expected %v with 2 skipped, got %v and %+v", exp, got, *stats)
+	}
+}
+
+func TestHeaderFlag(t *testing.T) {
+	tests := []struct {
+		in string
+		ok bool
+	}{
+		{"X-Auth-Token: abc123", true},
+		{"X-Empty:", true},
+		{"X-Colon: a:b", true},
+		{"no colon", false},
+		{": value", false},
+		{"Bad Name: value", false},
+		{"X-Bad(Name): value", false},
+	}
+	h := headerFlag{}
+	for _, test := range tests {
+		if err := h.Set(test.in); (err == nil) != test.ok {
+			t.Errorf("Expected ok=%v for %q, got %v", test.ok, test.in, err)
+		}
+	}
+	exp := http.Header{"X-Auth-Token": {"abc123"}, "X-Empty": {""},
+		"X-Colon": {"a:b"}}
+	if !reflect.DeepEqual(http.Header(h), exp) {
+		t.Errorf("Expected %v, got %v", exp, h)
+	}
+}
+
+// -header headers go out with restore requests.
+func TestRestoreHeaders(t *testing.T) {
+	var got string
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			got = req.Header.Get("X-Auth-Token")
+			w.WriteHeader(201)
+		}))
+	defer ts.Close()
+
+	defer func(c *http.Client) { restoreClient = c }(restoreClient)
+	restoreClient = newHTTPClient(time.Second, 1, false)
+	extraHeaders.Set("X-Auth-Token: secret")
+	defer delete(extraHeaders, "X-Auth-Token")
+
+	meta := json.RawMessage(`{"oid": "abc"}`)
+	if _, err := restoreFile(context.Background(), newRestoreClient(ts.URL),
+		"a", &meta); err != nil {
+		t.Fatalf("Error restoring: %v", err)
+	}
+	if got != "" {
+		t.Errorf("Expected no auth header for an unnamed host, got %q", got)
+	}
+
+	sendHeadersTo(ts.URL)
+	if _, err := restoreFile(context.Background(), newRestoreClient(ts.URL),
+		"a", &meta); err != nil {
+		t.Fatalf("Error restoring: %v", err)
+	}
+	if got != "secret" {
+		t.Errorf("Expected the auth header to be sent, got %q", got)
+	}
+}
+
+// A backup downloaded from elsewhere isn't sent the cluster's -header
+// headers.
+func TestRestoreHeadersBackupURL(t *testing.T) {
+	mu := sync.Mutex{}
+	var clusterGot []string
+	cluster := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			clusterGot = append(clusterGot, req.Header.Get("X-Auth-Token"))
+			w.WriteHeader(201)
+		}))
+	defer cluster.Close()
+
+	fn := writeTestBackup(t, "a", "b")
+	defer os.Remove(fn)
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatalf("Error reading backup: %v", err)
+	}
+	var storeGot string
+	store := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			storeGot = req.Header.Get("X-Auth-Token")
+			w.Write(b)
+		}))
+	defer store.Close()
+
+	extraHeaders.Set("X-Auth-Token: secret")
+	defer delete(extraHeaders, "X-Auth-Token")
+	sendHeadersTo(cluster.URL)
+
+	stats, err := restore(context.Background(), context.Background(),
+		cluster.URL, store.URL+"/backups/full.gz")
+	if err != nil || stats.Restored != 2 {
+		t.Fatalf("Expected 2 restored, got %+v (%v)", *stats, err)
+	}
+	if storeGot != "" {
+		t.Errorf("Expected the backup host not to get the auth header, got %q",
+			storeGot)
+	}
+	if fmt.Sprint(clusterGot) != "[secret secret]" {
+		t.Errorf("Expected the cluster to get the auth header, got %q",
+			clusterGot)
+	}
+}
+
+// The transport's proxy follows -no-proxy and -proxy, falling back to
+// the environment.
+func TestProxyFlags(t *testing.T) {
+	defer func(p proxyFlag, n bool) {
+		proxyOverride, noProxy = p, n
+	}(proxyOverride, noProxy)
+
+	proxy := func(c *http.Client) *http.Transport {
+		if rt := c.Transport.(headerTransport).rt; rt != nil {
+			return rt.(*http.Transport)
+		}
+		return defaultTransport()
+	}
+	req := httptest.NewRequest("GET", "http://cbfs.example.com:8484/", nil)
+	for _, c := range []*http.Client{newHTTPClient(0, 1, true), headerClient} {
+		proxyOverride, noProxy = proxyFlag{}, false
+		got, err := proxy(c).Proxy(req)
+		exp, _ := http.ProxyFromEnvironment(req)
+		if err != nil || !reflect.DeepEqual(got, exp) {
+			t.Errorf("Expected the environment's %v by default, got %v (%v)",
+				exp, got, err)
+		}
+
+		if err := proxyOverride.Set("http://proxy.example.com:3128"); err != nil {
+			t.Fatalf("Error setting -proxy: %v", err)
+		}
+		got, err = proxy(c).Proxy(req)
+		if err != nil || got == nil || got.Host != "proxy.example.com:3128" {
+			t.Errorf("Expected the -proxy URL, got %v (%v)", got, err)
+		}
+
+		noProxy = true
+		if got, err := proxy(c).Proxy(req); err != nil || got != nil {
+			t.Errorf("Expected no proxy with -no-proxy, got %v (%v)", got, err)
+		}
+	}
+
+	for _, bad := range []string{"ftp://proxy:21", "http://", "::"} {
+		if err := (&proxyFlag{}).Set(bad); err == nil {
+			t.Errorf("Expected an error for -proxy %q", bad)
+		}
+	}
+}
+
+// Values below a month are relative (and suspicious if tiny); above,
+// they're absolute times.
+func TestCheckExpiration(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	tests := []struct {
+		exp int
+		ok  bool
+	}{
+		{-1, true},
+		{0, true},
+		{1, false},
+		{minPlausibleExpiration - 1, false},
+		{minPlausibleExpiration, true},
+		{cbfstool.MaxRelativeExpiration - 1, true},
+		{cbfstool.MaxRelativeExpiration, false},
+		{int(now.Unix()), false},
+		{int(now.Unix()) + 1, true},
+	}
+	for _, test := range tests {
+		if err := checkExpiration(test.exp, now); (err == nil) != test.ok {
+			t.Errorf("Expected ok=%v for %v, got %v", test.ok, test.exp, err)
+		}
+	}
+}
+
+// Segments read in parallel all reach the workers, and are counted
+// once.
+func TestRestoreInputWorkers(t *testing.T) {
+	var posts int64
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			atomic.AddInt64(&posts, 1)
+			w.WriteHeader(201)
+		}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "segments")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	for i := 0; i < 8; i++ {
+		paths := []string{}
+		for j := 0; j < 50; j++ {
+			paths = append(paths, fmt.Sprintf("s%v/f%v", i, j))
+		}
+		fn := writeTestBackup(t, paths...)
+		if err := os.Rename(fn, segmentName(filepath.Join(dir, "b"), i)); err != nil {
+			t.Fatalf("Error moving segment: %v", err)
+		}
+	}
+
+	defer func(n int) { *restoreInputWorkers = n }(*restoreInputWorkers)
+	*restoreInputWorkers = 3
+
+	stats, err := restore(context.Background(), context.Background(),
+		ts.URL, dir)
+	if err != nil {
+		t.Fatalf("Error restoring: %v", err)
+	}
+	if stats.Seen != 400 || stats.Restored != 400 || posts != 400 {
+		t.Errorf("Expected 400 restored, got %v posts and %+v", posts, *stats)
+	}
+}
+
+// The first failing segment stops the others.
+func TestReadSegmentsError(t *testing.T) {
+	segs := []string{"a", "b", "bad", "c", "d", "e", "f"}
+	var read int64
+	err := readSegments(context.Background(), segs, 2,
+		func(ctx context.Context, seg string) error {
+			atomic.AddInt64(&read, 1)
+			if seg == "bad" {
+				return fmt.Errorf("broken %v", seg)
+			}
+			<-time.After(10 * time.Millisecond)
+			return nil
+		})
+	if err == nil || err.Error() != "broken bad" {
+		t.Errorf("Expected the bad segment's error, got %v", err)
+	}
+	if read == int64(len(segs)) {
+		t.Errorf("Expected reading to stop early, read all %v", read)
+	}
+}
+
+// Past the -deadline, dispatching stops and the restore fails saying
+// how much is left.
+func TestRestoreDeadline(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			time.Sleep(20 * time.Millisecond)
+			w.WriteHeader(201)
+		}))
+	defer ts.Close()
+
+	paths := []string{}
+	for i := 0; i < 100; i++ {
+		paths = append(paths, fmt.Sprintf("f%v", i))
+	}
+	fn := writeTestBackup(t, paths...)
+	defer os.Remove(fn)
+
+	defer func(d time.Duration, p bool) {
+		*restoreDeadline, *restorePrecheck = d, p
+	}(*restoreDeadline, *restorePrecheck)
+	*restoreDeadline, *restorePrecheck = 50*time.Millisecond, true
+
+	stats, err := restore(context.Background(), context.Background(),
+		ts.URL, fn)
+	if err == nil || !strings.Contains(err.Error(), "deadline") {
+		t.Fatalf("Expected to stop at the deadline, got %v", err)
+	}
+	left := 100 - stats.Restored
+	if exp := fmt.Sprintf("leaving %v files unprocessed", left); left == 0 ||
+		!strings.Contains(err.Error(), exp) {
+		t.Errorf("Expected %q in %q", exp, err)
+	}
+}
+
+func TestCleanPath(t *testing.T) {
+	tests := []struct {
+		in, exp string
+	}{
+		{"a/b", "a/b"},
+		{"//a/b", "a/b"},
+		{"/a//b/", "a/b"},
+		{"a/../b", "b"},
+		{"a/./b", "a/b"},
+		{"/../etc", "etc"},
+		{"../etc", ""},
+		{"a/../../etc", ""},
+		{"..", ""},
+		{"a/..", ""},
+		{"", ""},
+	}
+	for _, test := range tests {
+		got, err := cleanPath(test.in)
+		if got != test.exp || (err == nil) != (test.exp != "") {
+			t.Errorf("Expected %q for %q, got %q, %v", test.exp, test.in, got, err)
+		}
+	}
+}
+
+// Messy paths are restored where they belong, and escaping ones not
+// at all.
+func TestRestoreCleansPaths(t *testing.T) {
+	mu := sync.Mutex{}
+	posted := []string{}
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			mu.Lock()
+			posted = append(posted, req.URL.Path)
+			mu.Unlock()
+			w.WriteHeader(201)
+		}))
+	defer ts.Close()
+
+	fn := writeTestBackup(t, "//a/b", "a/../b", "../etc")
+	defer os.Remove(fn)
+
+	stats, err := restore(context.Background(), context.Background(),
+		ts.URL, fn)
+	if err != nil {
+		t.Fatalf("Error restoring: %v", err)
+	}
+	sort.Strings(posted)
+	exp := []string{"/.cbfs/backup/restore/a/b", "/.cbfs/backup/restore/b"}
+	if !reflect.DeepEqual(posted, exp) || stats.Failed != 1 {
+		t.Errorf("Expected posts to %v and 1 failure, got %v and %+v",
+			exp, posted, *stats)
+	}
+}
+
+// -prefix puts every restored path, remapped or not, under it,
+// escaping the result properly.
+func TestRestorePrefix(t *testing.T) {
+	mu := sync.Mutex{}
+	posted := []string{}
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			mu.Lock()
+			posted = append(posted, req.URL.Path)
+			mu.Unlock()
+			if req.URL.RawQuery != "" {
+				t.Errorf("Expected no query, got %q", req.URL.RawQuery)
+			}
+			w.WriteHeader(201)
+		}))
+	defer ts.Close()
+
+	fn := writeTestBackup(t, "old/x", "a b/c?d%", "../etc")
+	defer os.Remove(fn)
+
+	defer func(p string, r pathRemap) {
+		*restorePrefix, restoreRemap = p, r
+	}(*restorePrefix, restoreRemap)
+	*restorePrefix = "/snapshots/2024-06-01/"
+	restoreRemap = pathRemap{{"old", "new"}}
+
+	stats, err := restore(context.Background(), context.Background(),
+		ts.URL, fn)
+	if err != nil {
+		t.Fatalf("Error restoring: %v", err)
+	}
+	sort.Strings(posted)
+	exp := []string{
+		"/.cbfs/backup/restore/snapshots/2024-06-01/a b/c?d%",
+		"/.cbfs/backup/restore/snapshots/2024-06-01/new/x",
+	}
+	if !reflect.DeepEqual(posted, exp) || stats.Failed != 1 {
+		t.Errorf("Expected posts to %v and 1 failure, got %v and %+v",
+			exp, posted, *stats)
+	}
+
+	*restorePrefix = "../up"
+	if _, err := restore(context.Background(), context.Background(),
+		ts.URL, fn); err == nil || !strings.Contains(err.Error(), "-prefix") {
+		t.Errorf("Expected an escaping -prefix refused, got %v", err)
+	}
+}
+
+// A backup's meta reaches the server byte for byte, whatever fields
+// it has.
+func TestRestoreForwardsMeta(t *testing.T) {
+	var body []byte
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			body, _ = ioutil.ReadAll(req.Body)
+			w.WriteHeader(201)
+		}))
+	defer ts.Close()
+
+	meta := `{"oid":  "abc", "owner": "alice",` + "\n" +
+		` "acl": [{"user": "bob", "perm": "rw"}], "userdata": {"n": 1.50},` +
+		` "headers": {"Content-Type": ["text/plain"]}}`
+	fn := filepath.Join(t.TempDir(), "backup.json")
+	backup := `{"path": "f", "meta": ` + meta + "}\n"
+	if err := ioutil.WriteFile(fn, []byte(backup), 0644); err != nil {
+		t.Fatalf("Error writing backup: %v", err)
+	}
+
+	defer func(w int) { *restoreWorkers = w }(*restoreWorkers)
+	*restoreWorkers = 1
+	stats, err := restore(context.Background(), context.Background(),
+		ts.URL, fn)
+	if err != nil || stats.Restored != 1 {
+		t.Fatalf("Expected 1 file restored, got %+v (%v)", *stats, err)
+	}
+	if string(body) != meta {
+		t.Errorf("Expected the meta verbatim:\n%s\ngot:\n%s", meta, body)
+	}
+}
+
+func TestStatusCounts(t *testing.T) {
+	c := statusCounts{}
+	for _, err := range []error{
+		nil, nil, nil, errExists,
+		cbfstool.StatusError{Code: 409, Err: errors.New("conflict")},
+		errUnchanged,
+		cbfstool.StatusError{Code: 400, Err: errors.New("bad")},
+		cbfstool.TempError{Err: cbfstool.StatusError{Code: 503,
+			Err: errors.New("busy")}},
+		cbfstool.TempError{Err: errors.New("connection refused")},
+		errors.New("invalid path"),
+	} {
+		c.add(err)
+	}
+	exp := statusCounts{Created: 3, NotModified: 1, Exists: 2, ClientError: 1,
+		ServerError: 1, Network: 1, Other: 1}
+	if c != exp {
+		t.Errorf("Expected %+v, got %+v", exp, c)
+	}
+	rows := c.rows()
+	if len(rows) != 7 || !strings.HasPrefix(rows[0], "201 restored") ||
+		!strings.Contains(rows[0], "3  30.0%") {
+		t.Errorf("Expected the most common first, got %q", rows)
+	}
+}
+
+// Backups joined with cat are restored whole, not just the first.
+func TestRestoreConcatenatedGzip(t *testing.T) {
+	mu := sync.Mutex{}
+	restored := []string{}
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			restored = append(restored,
+				strings.TrimPrefix(req.URL.Path, "/.cbfs/backup/restore/"))
+			w.WriteHeader(201)
+		}))
+	defer ts.Close()
+
+	all := &bytes.Buffer{}
+	for _, paths := range [][]string{{"a", "b"}, {}, {"c", "d"}} {
+		fn := writeTestBackup(t, paths...)
+		b, err := ioutil.ReadFile(fn)
+		os.Remove(fn)
+		if err != nil {
+			t.Fatalf("Error reading backup: %v", err)
+		}
+		all.Write(b)
+	}
+	fn := filepath.Join(t.TempDir(), "all.gz")
+	if err := ioutil.WriteFile(fn, all.Bytes(), 0644); err != nil {
+		t.Fatalf("Error writing backup: %v", err)
+	}
+
+	stats, err := restore(context.Background(), context.Background(),
+		ts.URL, fn)
+	sort.Strings(restored)
+	exp := []string{"a", "b", "c", "d"}
+	if err != nil || !reflect.DeepEqual(restored, exp) || stats.Seen != 4 {
+		t.Errorf("Expected %v restored, got %v, %+v (%v)",
+			exp, restored, *stats, err)
+	}
+}
+
+func TestRestoreMaxMetaBytes(t *testing.T) {
+	mu := sync.Mutex{}
+	var posted []string
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			posted = append(posted, strings.TrimPrefix(req.URL.Path,
+				"/.cbfs/backup/restore/"))
+			w.WriteHeader(201)
+		}))
+	defer ts.Close()
+
+	huge := strings.Repeat("x", 4096)
+	fn := writeJSONBackup(t, "backup.json",
+		`{"path": "small", "meta": {"oid": "abc"}}`,
+		`{"path": "huge", "meta": {"oid": "abc", "userdata": "`+huge+`"}}`,
+		`{"path": "after", "meta": {"oid": "abc"}}`)
+
+	defer func(n int64) { *restoreMaxMetaBytes = n }(*restoreMaxMetaBytes)
+	*restoreMaxMetaBytes = 1024
+
+	buf := &bytes.Buffer{}
+	restoreLog.SetOutput(buf)
+	defer restoreLog.SetOutput(os.Stderr)
+
+	stats, err := restore(context.Background(), context.Background(),
+		ts.URL, fn)
+	if err != nil {
+		t.Fatalf("Error restoring: %v", err)
+	}
+	sort.Strings(posted)
+	if fmt.Sprint(posted) != "[after small]" {
+		t.Errorf("Expected the oversized entry not sent, got %v", posted)
+	}
+	if stats.Oversized != 1 || stats.Skipped != 1 || stats.Restored != 2 ||
+		stats.Matched != 3 {
+		t.Errorf("Expected 1 oversized entry skipped of 3, got %+v", *stats)
+	}
+	if !strings.Contains(buf.String(), "Skipping huge: its metadata is") {
+		t.Errorf("Expected the skip logged, got:\n%v", buf.String())
+	}
+}
+
+func TestRateInterval(t *testing.T) {
+	tests := []struct {
+		rate float64
+		exp  time.Duration
+		ok   bool
+	}{
+		{0, 0, true},
+		{1, time.Second, true},
+		{4, 250 * time.Millisecond, true},
+		{1e9, time.Nanosecond, true},
+		{2e9, 0, false},
+		{1e-10, 0, false},
+		{-1, 0, false},
+		{math.Inf(1), 0, false},
+		{math.NaN(), 0, false},
+	}
+	for _, test := range tests {
+		got, err := rateInterval(test.rate)
+		if got != test.exp || (err == nil) != test.ok {
+			t.Errorf("Expected %v (ok=%v) for -rate %v, got %v (%v)",
+				test.exp, test.ok, test.rate, got, err)
+		}
+	}
+}
+
+// -rate limits the whole restore, not each target.
+func TestRestoreRateTargets(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			w.WriteHeader(201)
+		}))
+	defer ts.Close()
+	other := httptest.NewServer(ts.Config.Handler)
+	defer other.Close()
+
+	fn := writeTestBackup(t, "a", "b", "c", "d")
+	defer os.Remove(fn)
+
+	defer func(l targetList, r float64) {
+		restoreExtraTargets, *restoreRate = l, r
+	}(restoreExtraTargets, *restoreRate)
+	restoreExtraTargets = targetList{other.URL}
+
+	*restoreRate = 2e9
+	if _, err := restore(context.Background(), context.Background(),
+		ts.URL, fn); err == nil || !strings.Contains(err.Error(), "-rate") {
+		t.Errorf("Expected -rate 2e9 refused, got %v", err)
+	}
+
+	// Eight restores at 20 a second take 350ms or more if shared,
+	// half that if each target had its own limit.
+	*restoreRate = 20
+	start := time.Now()
+	stats, err := restore(context.Background(), context.Background(),
+		ts.URL, fn)
+	if err != nil || stats.Restored != 8 {
+		t.Fatalf("Expected 8 restored, got %+v (%v)", *stats, err)
+	}
+	if d := time.Since(start); d < 300*time.Millisecond {
+		t.Errorf("Expected at least 300ms at -rate 20 over two targets, "+
+			"took %v", d)
+	}
+}
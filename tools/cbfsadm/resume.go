@@ -0,0 +1,46 @@
+package main
+
+var restoreResumeFrom = restoreFlags.String("resume-from", "",
+	"Skip the backup's entries up to this path, restoring it and "+
+		"everything after (relies on the backup's order)")
+
+// Skips the entries of a backup stream until a given path is reached.
+// As it depends on the stream's order, segments must be read one at
+// a time.
+//
+// All methods are safe to call on a nil resumePoint, which skips
+// nothing.
+type resumePoint struct {
+	path    string
+	reached bool
+}
+
+// The resume point for -resume-from, nil if it isn't set.  Each pass
+// through a backup needs its own.
+func newResumePoint() *resumePoint {
+	if *restoreResumeFrom == "" {
+		return nil
+	}
+	return &resumePoint{path: *restoreResumeFrom}
+}
+
+// Wrap matches so that nothing before the resume point matches.
+func (r *resumePoint) wrap(matches func(string) bool) func(string) bool {
+	if r == nil {
+		return matches
+	}
+	return func(p string) bool {
+		if !r.reached {
+			if p != r.path {
+				return false
+			}
+			r.reached = true
+		}
+		return matches(p)
+	}
+}
+
+// True once the resume point has been passed.
+func (r *resumePoint) done() bool {
+	return r == nil || r.reached
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRestoreResumeFrom(t *testing.T) {
+	mu := sync.Mutex{}
+	restored := []string{}
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			restored = append(restored,
+				strings.TrimPrefix(req.URL.Path, "/.cbfs/backup/restore/"))
+			w.WriteHeader(201)
+		}))
+	defer ts.Close()
+
+	fn := writeTestBackup(t, "a", "b", "c", "d")
+	defer os.Remove(fn)
+
+	defer func(r string, n, w int, q bool) {
+		*restoreResumeFrom, *restoreInputWorkers = r, n
+		*restoreWorkers, *restoreQuiet = w, q
+	}(*restoreResumeFrom, *restoreInputWorkers, *restoreWorkers, *restoreQuiet)
+	*restoreWorkers, *restoreQuiet = 1, true
+
+	*restoreResumeFrom = "c"
+	stats, err := restore(context.Background(), context.Background(), ts.URL, fn)
+	if err != nil {
+		t.Fatalf("Error restoring: %v", err)
+	}
+	if exp := []string{"c", "d"}; !reflect.DeepEqual(restored, exp) {
+		t.Errorf("Expected %v restored, got %v", exp, restored)
+	}
+	if stats.Seen != 4 || stats.Matched != 2 {
+		t.Errorf("Expected 2 of 4 matched, got %+v", *stats)
+	}
+
+	restored = nil
+	*restoreResumeFrom = "zz"
+	_, err = restore(context.Background(), context.Background(), ts.URL, fn)
+	if err == nil || !strings.Contains(err.Error(), "isn't in the backup") {
+		t.Errorf("Expected an error for a missing resume point, got %v", err)
+	}
+	if len(restored) != 0 {
+		t.Errorf("Expected nothing restored, got %v", restored)
+	}
+
+	*restoreResumeFrom, *restoreInputWorkers = "c", 2
+	_, err = restore(context.Background(), context.Background(), ts.URL, fn)
+	if err == nil || !strings.Contains(err.Error(), "-input-workers") {
+		t.Errorf("Expected -input-workers to be refused, got %v", err)
+	}
+}
+
+// An interrupted restore resumed from its -checkpoint only restores
+// what the first run didn't, counting the rest as skipped.
+func TestRestoreCheckpointResume(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mu := sync.Mutex{}
+	restored := []string{}
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			p := strings.TrimPrefix(req.URL.Path, "/.cbfs/backup/restore/")
+			restored = append(restored, p)
+			if p == "b" {
+				// Interrupted during the second file's restore.
+				cancel()
+			}
+			w.WriteHeader(201)
+		}))
+	defer ts.Close()
+
+	fn := writeTestBackup(t, "a", "b", "c", "d", "e")
+	defer os.Remove(fn)
+
+	defer func(c string, r bool, w int, q bool) {
+		*restoreCheckpoint, *restoreResume = c, r
+		*restoreWorkers, *restoreQuiet = w, q
+	}(*restoreCheckpoint, *restoreResume, *restoreWorkers, *restoreQuiet)
+	*restoreCheckpoint = filepath.Join(t.TempDir(), "checkpoint")
+	*restoreWorkers, *restoreQuiet = 1, true
+
+	stats, err := restore(ctx, context.Background(), ts.URL, fn)
+	if err == nil || !strings.Contains(err.Error(), "interrupted") {
+		t.Fatalf("Expected the restore interrupted, got %v", err)
+	}
+	if exp := []string{"a", "b"}; !reflect.DeepEqual(restored, exp) ||
+		stats.Restored != 2 {
+		t.Fatalf("Expected %v restored before the interruption, got %v, %+v",
+			exp, restored, *stats)
+	}
+
+	restored = nil
+	*restoreResume = true
+	stats, err = restore(context.Background(), context.Background(),
+		ts.URL, fn)
+	if err != nil {
+		t.Fatalf("Error resuming: %v", err)
+	}
+	if exp := []string{"c", "d", "e"}; !reflect.DeepEqual(restored, exp) {
+		t.Errorf("Expected %v restored on resuming, got %v", exp, restored)
+	}
+	if stats.Restored != 3 || stats.Skipped != 2 || stats.Matched != 5 {
+		t.Errorf("Expected 3 restored and 2 skipped of 5, got %+v", *stats)
+	}
+
+	// Everything's now in the checkpoint, so resuming again restores
+	// nothing.
+	restored = nil
+	stats, err = restore(context.Background(), context.Background(),
+		ts.URL, fn)
+	if err != nil || len(restored) != 0 || stats.Skipped != 5 {
+		t.Errorf("Expected all 5 skipped, got %v restored, %+v (%v)",
+			restored, *stats, err)
+	}
+}
@@ -67,10 +67,10 @@ func rmBakWorker() {
 	defer rmbakWg.Done()
 
 	for u := range rmbakCh {
-		cbfstool.Verbose(*rmbakVerbose, "Deleting %V", u)
+		cbfstool.Verbose(*rmbakVerbose, "Deleting %v", u)
 
 		err := rmFile(u)
-		cbfstool.MaybeFatal(err, "Error Removing %V: %V", u, err)
+		cbfstool.MaybeFatal(err, "Error Removing %v: %v", u, err)
 	}
 }
 
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+)
+
+var restoreEmitScript = restoreFlags.String("emit-script", "",
+	"Write the restore as a shell script of curl commands instead of running it")
+
+// A shell script of the requests a restore would make.
+type restoreScript struct {
+	mu sync.Mutex
+	f  *os.File
+	w  *bufio.Writer
+}
+
+// The script written by restore, if -emit-script was given.
+var restoreScriptOut *restoreScript
+
+func createRestoreScript(fn string) (*restoreScript, error) {
+	f, err := os.Create(fn)
+	if err != nil {
+		return nil, err
+	}
+	s := &restoreScript{f: f, w: bufio.NewWriter(f)}
+	fmt.Fprintln(s.w, "#!/bin/sh")
+	fmt.Fprintln(s.w, "# Generated by cbfsadm restore -emit-script.")
+	fmt.Fprintln(s.w, "set -e")
+	return s, nil
+}
+
+// Quote s for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// Write the request restoring path into the cluster at base.
+func (s *restoreScript) add(base, path string, data *json.RawMessage) error {
+	req, err := newRestoreClient(base).NewRequest(context.Background(),
+		path, rawMeta(data))
+	if err != nil {
+		return err
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = fmt.Fprintf(s.w, "\n# %v\ncurl -sSf -X POST \\\n"+
+		"  -H %v \\\n"+
+		"  -H %v \\\n  --data-binary %v \\\n  %v\n",
+		strings.Replace(path, "\n", " ", -1),
+		shellQuote("Content-Type: "+req.Header.Get("Content-Type")),
+		shellQuote("X-CBFS-Expiration: "+req.Header.Get("X-CBFS-Expiration")),
+		shellQuote(string(body)), shellQuote(req.URL.String()))
+	return err
+}
+
+func (s *restoreScript) Close() error {
+	err := s.w.Flush()
+	if e := s.f.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Chmod(s.f.Name(), 0755)
+	}
+	return err
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// The emitted script passes curl exactly the request restore would
+// make, however odd the path.
+func TestEmitScript(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a POSIX shell")
+	}
+	dir, err := ioutil.TempDir("", "script")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A curl that prints its arguments, one per line.
+	fakeCurl := "#!/bin/sh\nfor a in \"$@\"; do echo \"$a\"; done\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "curl"), []byte(fakeCurl), 0755); err != nil {
+		t.Fatalf("Error writing fake curl: %v", err)
+	}
+
+	fn := filepath.Join(dir, "restore.sh")
+	s, err := createRestoreScript(fn)
+	if err != nil {
+		t.Fatalf("Error creating script: %v", err)
+	}
+	meta := json.RawMessage(`{"oid": "abc", "note": "it's $HOME"}`)
+	path := "it's a `file` $(x).txt"
+	if err := s.add("http://h:8484/", path, &meta); err != nil {
+		t.Fatalf("Error adding to script: %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Error closing script: %v", err)
+	}
+
+	cmd := exec.Command(fn)
+	cmd.Env = append(os.Environ(), "PATH="+dir+":"+os.Getenv("PATH"))
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("Error running script: %v", err)
+	}
+	exp := []string{"-sSf", "-X", "POST",
+		"-H", "Content-Type: application/json",
+		"-H", "X-CBFS-Expiration: -1",
+		"--data-binary", string(meta),
+		"http://h:8484/.cbfs/backup/restore/it%27s%20a%20%60file%60%20$%28x%29.txt"}
+	if got := strings.Split(strings.TrimSpace(string(out)), "\n"); !reflect.DeepEqual(got, exp) {
+		t.Errorf("Expected curl to get\n%q\ngot\n%q", exp, got)
+	}
+}
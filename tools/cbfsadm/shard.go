@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+)
+
+// The -shard i/n to restore: the entries whose path hashes to i
+// modulo n.  The zero shard is everything.
+type shardFlag struct {
+	i, n uint32
+}
+
+func (s *shardFlag) String() string {
+	if s.n == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%v/%v", s.i, s.n)
+}
+
+func (s *shardFlag) Set(v string) error {
+	parts := strings.SplitN(v, "/", 2)
+	if len(parts) != 2 {
+		return errors.New("must be of the form i/n")
+	}
+	i, ierr := strconv.ParseUint(parts[0], 10, 32)
+	n, nerr := strconv.ParseUint(parts[1], 10, 32)
+	if ierr != nil || nerr != nil || n == 0 || i >= n {
+		return fmt.Errorf("must be i/n with 0 <= i < n")
+	}
+	s.i, s.n = uint32(i), uint32(n)
+	return nil
+}
+
+var restoreShard shardFlag
+
+func init() {
+	restoreFlags.Var(&restoreShard, "shard",
+		"Only restore shard i/n of the backup, split by a hash of each "+
+			"path (so n hosts can share a restore)")
+}
+
+// True if path p is in the shard.  The FNV-1a hash of the backed up
+// path is the same on every host, whatever its -remap or -prefix.
+func (s shardFlag) has(p string) bool {
+	if s.n == 0 {
+		return true
+	}
+	h := fnv.New32a()
+	h.Write([]byte(p))
+	return h.Sum32()%s.n == s.i
+}
+
+// Wrap matches so only paths in the shard match.
+func (s shardFlag) wrap(matches func(string) bool) func(string) bool {
+	if s.n <= 1 {
+		return matches
+	}
+	return func(p string) bool {
+		return s.has(p) && matches(p)
+	}
+}
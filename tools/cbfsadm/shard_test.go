@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestShardFlag(t *testing.T) {
+	for _, bad := range []string{"", "1", "3/3", "-1/3", "1/0", "a/b", "1/2/3"} {
+		if err := (&shardFlag{}).Set(bad); err == nil {
+			t.Errorf("Expected an error for -shard %q", bad)
+		}
+	}
+
+	// Every path is in exactly one shard, and the shards are roughly
+	// even.
+	const n = 4
+	shards := make([]shardFlag, n)
+	for i := range shards {
+		if err := shards[i].Set(fmt.Sprintf("%v/%v", i, n)); err != nil {
+			t.Fatalf("Error setting shard %v: %v", i, err)
+		}
+	}
+	counts := make([]int, n)
+	for p := 0; p < 10000; p++ {
+		path := fmt.Sprintf("some/dir/file%v", p)
+		in := 0
+		for i, s := range shards {
+			if s.has(path) {
+				counts[i]++
+				in++
+			}
+		}
+		if in != 1 {
+			t.Fatalf("Expected %v in one shard, in %v", path, in)
+		}
+	}
+	for i, c := range counts {
+		if c < 2000 || c > 3000 {
+			t.Errorf("Expected about 2500 paths in shard %v, got %v", i, c)
+		}
+	}
+
+	// The hash is fixed, so hosts agree: FNV-1a of "a" is 0xe40c292c.
+	if !shards[0xe40c292c%n].has("a") {
+		t.Errorf("Expected a in shard %v", 0xe40c292c%n)
+	}
+	if !(shardFlag{}).has("anything") {
+		t.Errorf("Expected the zero shard to have everything")
+	}
+}
+
+// -shard narrows whatever else restore matches.
+func TestRestoreMatcherShard(t *testing.T) {
+	defer func(s shardFlag, p string) {
+		restoreShard, *restorePat = s, p
+	}(restoreShard, *restorePat)
+	restoreShard, *restorePat = shardFlag{0, 4}, "^keep/"
+
+	matches, err := restoreMatcher()
+	if err != nil {
+		t.Fatalf("Error building matcher: %v", err)
+	}
+	for p := 0; p < 100; p++ {
+		path := fmt.Sprintf("keep/%v", p)
+		if matches(path) != restoreShard.has(path) {
+			t.Errorf("Expected %v matched only in its shard", path)
+		}
+		if matches(fmt.Sprintf("drop/%v", p)) {
+			t.Errorf("Expected drop/%v not matched", p)
+		}
+	}
+}
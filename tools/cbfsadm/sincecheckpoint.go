@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var restoreSinceCheckpoint = restoreFlags.String("since-checkpoint", "",
+	"Only restore entries modified after the time in this file, saving "+
+		"the newest one restored there after a clean run")
+
+// The time kept by -since-checkpoint, and the newest modification
+// time of the entries restored after it.
+//
+// All methods are safe to call on a nil sinceCheckpoint, which
+// admits everything.
+type sinceCheckpoint struct {
+	fn    string
+	since time.Time
+
+	mu     sync.Mutex
+	newest time.Time
+}
+
+// The -since-checkpoint of the restore running, if any.
+var restoreSince *sinceCheckpoint
+
+// Load the time saved in fn.  Without the file (on the first run),
+// everything is restored.
+func openSinceCheckpoint(fn string) (*sinceCheckpoint, error) {
+	sc := &sinceCheckpoint{fn: fn}
+	b, err := ioutil.ReadFile(fn)
+	switch {
+	case os.IsNotExist(err):
+		return sc, nil
+	case err != nil:
+		return nil, err
+	}
+	sc.since, err = time.Parse(time.RFC3339Nano, strings.TrimSpace(string(b)))
+	if err != nil {
+		return nil, fmt.Errorf("%v doesn't hold a time: %v", fn, err)
+	}
+	sc.newest = sc.since
+	return sc, nil
+}
+
+// Whether ob was modified after the saved time, noting its time if
+// so.  As with export -since, entries without a modification time
+// are always restored.
+func (sc *sinceCheckpoint) admit(ob restoreWorkItem) bool {
+	if sc == nil {
+		return true
+	}
+	fm, err := parseMeta(ob.Meta)
+	if err != nil || fm.Modified.IsZero() {
+		return true
+	}
+	if !sc.since.IsZero() && !fm.Modified.After(sc.since) {
+		return false
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if fm.Modified.After(sc.newest) {
+		sc.newest = fm.Modified
+	}
+	return true
+}
+
+// Save the newest time admitted, for the next run to restore what's
+// been modified since.
+func (sc *sinceCheckpoint) save() error {
+	if sc == nil {
+		return nil
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if !sc.newest.After(sc.since) {
+		return nil
+	}
+	f, err := createAtomic(sc.fn)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintln(f, sc.newest.UTC().Format(time.RFC3339Nano)); err != nil {
+		f.Abort()
+		return err
+	}
+	return f.Commit()
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRestoreSinceCheckpoint(t *testing.T) {
+	mu := sync.Mutex{}
+	restored := []string{}
+	broken := ""
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			p := strings.TrimPrefix(req.URL.Path, "/.cbfs/backup/restore/")
+			if p == broken {
+				http.Error(w, "no", 400)
+				return
+			}
+			restored = append(restored, p)
+			w.WriteHeader(201)
+		}))
+	defer ts.Close()
+
+	entries := []string{
+		`{"path": "a", "meta": {"oid": "a1", "modified": "2024-01-01T00:00:00Z"}}`,
+		`{"path": "b", "meta": {"oid": "b1", "modified": "2024-03-01T00:00:00Z"}}`,
+		`{"path": "c", "meta": {"oid": "c1", "modified": "2024-02-01T00:00:00Z"}}`,
+		// Without a modification time, restored every run.
+		`{"path": "n", "meta": {"oid": "n1"}}`,
+	}
+	dir := t.TempDir()
+	since := filepath.Join(dir, "since")
+
+	defer func(s string) { *restoreSinceCheckpoint = s }(*restoreSinceCheckpoint)
+	*restoreSinceCheckpoint = since
+
+	tests := []struct {
+		// The backup's entries, and a path the cluster refuses.
+		entries  []string
+		broken   string
+		restored []string
+		saved    string
+	}{
+		// The first run restores everything.
+		{entries, "", []string{"a", "b", "c", "n"}, "2024-03-01T00:00:00Z"},
+		// Nothing's newer.
+		{entries, "", []string{"n"}, "2024-03-01T00:00:00Z"},
+		// The backup grew, but a failure keeps the time where it is.
+		{append(entries,
+			`{"path": "d", "meta": {"oid": "d1", "modified": "2024-04-01T00:00:00Z"}}`,
+			`{"path": "e", "meta": {"oid": "e1", "modified": "2024-05-01T00:00:00Z"}}`),
+			"d", []string{"e", "n"}, "2024-03-01T00:00:00Z"},
+		{append(entries,
+			`{"path": "d", "meta": {"oid": "d1", "modified": "2024-04-01T00:00:00Z"}}`,
+			`{"path": "e", "meta": {"oid": "e1", "modified": "2024-05-01T00:00:00Z"}}`),
+			"", []string{"d", "e", "n"}, "2024-05-01T00:00:00Z"},
+	}
+	for i, test := range tests {
+		fn := writeJSONBackup(t, "backup.json", test.entries...)
+		restored, broken = []string{}, test.broken
+
+		_, err := restore(context.Background(), context.Background(),
+			ts.URL, fn)
+		if err != nil {
+			t.Fatalf("Error in restore %v: %v", i, err)
+		}
+		sort.Strings(restored)
+		if !reflect.DeepEqual(restored, test.restored) {
+			t.Errorf("Expected restore %v to restore %v, got %v",
+				i, test.restored, restored)
+		}
+		b, err := ioutil.ReadFile(since)
+		if err != nil || string(b) != test.saved+"\n" {
+			t.Errorf("Expected %v saved after restore %v, got %q (%v)",
+				test.saved, i, b, err)
+		}
+	}
+
+	if err := ioutil.WriteFile(since, []byte("yesterday\n"), 0644); err != nil {
+		t.Fatalf("Error writing %v: %v", since, err)
+	}
+	fn := writeJSONBackup(t, "backup.json", entries...)
+	_, err := restore(context.Background(), context.Background(), ts.URL, fn)
+	if err == nil || !strings.Contains(err.Error(), "doesn't hold a time") {
+		t.Errorf("Expected a bad time to be refused, got %v", err)
+	}
+}
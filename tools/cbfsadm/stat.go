@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/couchbaselabs/cbfs/client"
+	"github.com/couchbaselabs/cbfs/tools"
+	"github.com/dustin/go-humanize"
+)
+
+var statFlags = flag.NewFlagSet("stat", flag.ExitOnError)
+var statRaw = statFlags.Bool("raw", false, "Print the metadata JSON as is")
+
+// The cluster's info document for a file.
+type fileInfoDoc struct {
+	Path string              `json:"path"`
+	Meta cbfsclient.FileMeta `json:"meta"`
+}
+
+// Write a readable summary of a file stored on the given nodes.
+func writeStat(w io.Writer, info fileInfoDoc, nodes []string) error {
+	fm := info.Meta
+	expires := "never"
+	if exp := fm.Headers.Get("X-CBFS-Expiration"); exp != "" && exp != "0" {
+		expires = exp
+	}
+	ctype := fm.Headers.Get("Content-Type")
+	if ctype == "" {
+		ctype = "-"
+	}
+	sort.Strings(nodes)
+
+	tw := tabwriter.NewWriter(w, 2, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "path:\t%v\n", info.Path)
+	fmt.Fprintf(tw, "size:\t%v (%v bytes)\n",
+		humanize.Bytes(uint64(fm.Length)), humanize.Comma(fm.Length))
+	fmt.Fprintf(tw, "hash:\t%v\n", fm.OID)
+	fmt.Fprintf(tw, "revision:\t%v\n", fm.Revno)
+	fmt.Fprintf(tw, "modified:\t%v\n", fm.Modified.Format(time.RFC3339))
+	fmt.Fprintf(tw, "replicas:\t%v %v\n", len(nodes), strings.Join(nodes, " "))
+	fmt.Fprintf(tw, "expiration:\t%v\n", expires)
+	fmt.Fprintf(tw, "content-type:\t%v\n", ctype)
+	return tw.Flush()
+}
+
+func statCommand(ustr string, args []string) {
+	path := statFlags.Arg(0)
+	ctx := context.Background()
+
+	data, err := fileInfo(ctx, ustr, path)
+	cbfstool.MaybeFatal(err, "Error getting info for %v: %v", path, err)
+
+	if *statRaw {
+		os.Stdout.Write(data)
+		return
+	}
+
+	info := fileInfoDoc{}
+	err = json.Unmarshal(data, &info)
+	cbfstool.MaybeFatal(err, "Error reading info for %v: %v", path, err)
+
+	nodes, err := blobNodes(ctx, ustr, info.Meta.OID)
+	cbfstool.MaybeFatal(err, "Error finding replicas of %v: %v", path, err)
+
+	writeStat(os.Stdout, info, nodes)
+}
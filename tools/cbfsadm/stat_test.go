@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestWriteStat(t *testing.T) {
+	info := fileInfoDoc{}
+	err := json.Unmarshal([]byte(`{"path": "a/b.txt", "meta": {
+  "oid": "abc", "length": 2048, "revno": 3,
+  "modified": "2020-01-02T03:04:05Z",
+  "headers": {"Content-Type": ["text/plain"], "X-Cbfs-Expiration": ["1600000000"]}}}`),
+		&info)
+	if err != nil {
+		t.Fatalf("Error parsing info: %v", err)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := writeStat(buf, info, []string{"n2", "n1"}); err != nil {
+		t.Fatalf("Error writing stat: %v", err)
+	}
+	exp := `path:          a/b.txt
+size:          2.0 kB (2,048 bytes)
+hash:          abc
+revision:      3
+modified:      2020-01-02T03:04:05Z
+replicas:      2 n1 n2
+expiration:    1600000000
+content-type:  text/plain
+`
+	if buf.String() != exp {
+		t.Errorf("Expected:\n%v\ngot:\n%v", exp, buf.String())
+	}
+}
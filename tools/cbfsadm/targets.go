@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+// Additional clusters to restore to, given by repeated (or comma
+// separated) -target flags.
+type targetList []string
+
+func (t targetList) String() string {
+	return strings.Join(t, ",")
+}
+
+func (t *targetList) Set(s string) error {
+	urls := strings.Split(s, ",")
+	for i, u := range urls {
+		if urls[i] = strings.TrimSpace(u); urls[i] == "" {
+			return errors.New("empty target URL")
+		}
+	}
+	*t = append(*t, urls...)
+	return nil
+}
+
+var restoreExtraTargets targetList
+
+func init() {
+	restoreFlags.Var(&restoreExtraTargets, "target",
+		"Also restore to this cluster (repeatable or comma separated)")
+}
+
+// The clusters to restore to: base, then any -target not repeating it.
+func restoreTargets(base string) []string {
+	targets := []string{base}
+	seen := map[string]bool{base: true}
+	for _, t := range restoreExtraTargets {
+		if !seen[t] {
+			seen[t] = true
+			targets = append(targets, t)
+		}
+	}
+	return targets
+}
+
+// Copy every item from ch to each of the queues, closing them once ch
+// is closed.  Each queue is buffered, so a slow target only holds the
+// others back once it falls a full buffer behind.
+func fanOut(ch <-chan restoreWorkItem, queues []chan restoreWorkItem) {
+	for ob := range ch {
+		for _, q := range queues {
+			q <- ob
+		}
+	}
+	for _, q := range queues {
+		close(q)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+var restoreFormat = restoreFlags.String("format", "auto",
+	"Backup format: json (a stream of records), tar (an archive of "+
+		"each file's meta) or auto to tell them apart")
+
+// Where a tar header's magic is, and what it says in the POSIX and
+// GNU formats.
+const tarMagicOffset = 257
+
+var tarMagic = []byte("ustar")
+
+// Decodes the entries of a backup, whatever its format.
+type backupDecoder interface {
+	// Decode the next entry into ob, returning io.EOF at the end.
+	decode(ob *restoreWorkItem) error
+}
+
+// A decoder of the (decompressed) backup stream r in the given
+// -format, setting malformed entries aside in q.
+func newBackupDecoder(r io.Reader, format string, q *quarantine,
+	stats *restoreStats) (backupDecoder, error) {
+
+	if format == "auto" {
+		br := bufio.NewReader(r)
+		head, err := br.Peek(tarMagicOffset + len(tarMagic))
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		r, format = br, "json"
+		if isTar(head) {
+			format = "tar"
+		}
+	}
+
+	switch format {
+	case "json":
+		return newRecordDecoder(r, q, stats), nil
+	case "tar":
+		return &tarDecoder{tr: tar.NewReader(r), q: q, stats: stats}, nil
+	}
+	return nil, fmt.Errorf("unknown -format %q (want json, tar or auto)",
+		format)
+}
+
+// Whether a stream starting with head is a tar archive.
+func isTar(head []byte) bool {
+	return len(head) > tarMagicOffset &&
+		bytes.HasPrefix(head[tarMagicOffset:], tarMagic)
+}
+
+// Decodes a tar archive holding a file's meta in each entry, named by
+// its path.  Anything but regular files (directories, links) is
+// passed over.
+type tarDecoder struct {
+	tr    *tar.Reader
+	q     *quarantine
+	stats *restoreStats
+}
+
+func (td *tarDecoder) decode(ob *restoreWorkItem) error {
+	for {
+		hdr, err := td.tr.Next()
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		data, err := ioutil.ReadAll(td.tr)
+		if err != nil {
+			return err
+		}
+		data = bytes.TrimSpace(data)
+		if !json.Valid(data) {
+			err := fmt.Errorf("tar entry %v isn't JSON", hdr.Name)
+			if td.q == nil {
+				return err
+			}
+			if err := td.q.add(td.stats, data, err); err != nil {
+				return err
+			}
+			continue
+		}
+		meta := json.RawMessage(data)
+		// Archives made of a directory (tar -C dir .) name
+		// everything ./path.
+		*ob = restoreWorkItem{Path: strings.TrimPrefix(hdr.Name, "./"),
+			Meta: &meta}
+		return nil
+	}
+}
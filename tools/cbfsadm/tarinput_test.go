@@ -0,0 +1,133 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Write a gzipped tar of the given entries (a name ending in / is a
+// directory) to a file in t's temporary directory.
+func writeTarBackup(t *testing.T, entries ...[2]string) string {
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gz)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e[0], Mode: 0644, Size: int64(len(e[1])),
+			Typeflag: tar.TypeReg}
+		if strings.HasSuffix(e[0], "/") {
+			hdr.Typeflag, hdr.Size = tar.TypeDir, 0
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("Error writing tar header: %v", err)
+		}
+		if _, err := tw.Write([]byte(e[1])); err != nil {
+			t.Fatalf("Error writing tar entry: %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Error closing tar: %v", err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatalf("Error closing gzip: %v", err)
+	}
+	fn := filepath.Join(t.TempDir(), "backup.tar.gz")
+	if err := ioutil.WriteFile(fn, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("Error writing %v: %v", fn, err)
+	}
+	return fn
+}
+
+// Read fn with readBackup, returning "path meta" for each entry.
+func readTestEntries(fn string) ([]string, error) {
+	ch := make(chan restoreWorkItem, 10)
+	err := readBackup(context.Background(), fn, nil,
+		func(p string) bool { return !strings.HasPrefix(p, "skip/") },
+		nil, &restoreStats{}, ch)
+	close(ch)
+	got := []string{}
+	for ob := range ch {
+		got = append(got, ob.Path+" "+string(*ob.Meta))
+	}
+	return got, err
+}
+
+func TestTarBackup(t *testing.T) {
+	defer func(f string) { *restoreFormat = f }(*restoreFormat)
+
+	tarFn := writeTarBackup(t,
+		[2]string{"./", ""},
+		[2]string{"./d/", ""},
+		[2]string{"./d/a", `{"oid": "a1"}`},
+		[2]string{"b", "{\"oid\": \"b1\", \"length\": 2}\n"},
+		[2]string{"skip/c", `{"oid": "c1"}`})
+	jsonFn := writeJSONBackup(t, "backup.json",
+		`{"path": "d/a", "meta": {"oid": "a1"}}`,
+		`{"path": "b", "meta": {"oid": "b1", "length": 2}}`)
+	exp := []string{`d/a {"oid": "a1"}`, `b {"oid": "b1", "length": 2}`}
+
+	tests := []struct {
+		format, fn string
+		err        string
+	}{
+		{"auto", tarFn, ""},
+		{"tar", tarFn, ""},
+		{"auto", jsonFn, ""},
+		{"json", jsonFn, ""},
+		{"json", tarFn, "invalid character"},
+		{"tar", jsonFn, "unexpected EOF"},
+		{"zip", jsonFn, `unknown -format "zip"`},
+	}
+	for _, test := range tests {
+		*restoreFormat = test.format
+		got, err := readTestEntries(test.fn)
+		switch {
+		case test.err != "":
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("Expected %q reading %v as %v, got %v",
+					test.err, filepath.Base(test.fn), test.format, err)
+			}
+		case err != nil:
+			t.Errorf("Error reading %v as %v: %v",
+				filepath.Base(test.fn), test.format, err)
+		case !reflect.DeepEqual(got, exp):
+			t.Errorf("Expected %v reading %v as %v, got %v",
+				exp, filepath.Base(test.fn), test.format, got)
+		}
+	}
+}
+
+func TestTarBackupMalformed(t *testing.T) {
+	defer func(f string, q *quarantine) {
+		*restoreFormat, restoreQuarantine = f, q
+	}(*restoreFormat, restoreQuarantine)
+	*restoreFormat = "auto"
+
+	fn := writeTarBackup(t,
+		[2]string{"a", `{"oid": "a1"}`},
+		[2]string{"bad", `{"oid": `},
+		[2]string{"c", `{"oid": "c1"}`})
+
+	restoreQuarantine = nil
+	if _, err := readTestEntries(fn); err == nil ||
+		!strings.Contains(err.Error(), "tar entry bad isn't JSON") {
+		t.Errorf("Expected the bad entry to stop the read, got %v", err)
+	}
+
+	q := &bytes.Buffer{}
+	restoreQuarantine = &quarantine{w: q}
+	got, err := readTestEntries(fn)
+	exp := []string{`a {"oid": "a1"}`, `c {"oid": "c1"}`}
+	if err != nil || !reflect.DeepEqual(got, exp) {
+		t.Errorf("Expected %v past the bad entry, got %v (%v)", exp, got, err)
+	}
+	if q.String() != "{\"oid\":\n" {
+		t.Errorf("Expected the bad entry quarantined, got %q", q)
+	}
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/couchbaselabs/cbfs/client"
+	"github.com/couchbaselabs/cbfs/tools"
+	"github.com/dustin/httputil"
+)
+
+var verifyFlags = flag.NewFlagSet("verify", flag.ExitOnError)
+var verifyPat = verifyFlags.String("match", ".*", "Regex for paths to check")
+var verifyExclude = verifyFlags.String("exclude", "",
+	"Regex for paths to skip (wins over -match)")
+var verifyWorkers = verifyFlags.Int("workers", 4, "Number of verify workers")
+var verifyTimeout = verifyFlags.Duration("timeout", 30*time.Second,
+	"Timeout for each request (0 for none)")
+var verifyHTTP2 = verifyFlags.Bool("http2", true,
+	"Use HTTP/2 with TLS servers that support it")
+var verifyKeyfile = verifyFlags.String("keyfile", "",
+	"Key for encrypted backups (default $CBFS_BACKUP_KEY)")
+var verifyReportFile = verifyFlags.String("report", "",
+	"Write a JSON report of discrepancies to this file")
+var verifyContent = verifyFlags.Bool("content", false,
+	"Also download each file and check its digest against the backup")
+var verifyChecksum = verifyFlags.String("checksum-algorithm", "",
+	"The digest -content computes (default the cluster's configured hash)")
+
+var errNoMeta = errors.New("no metadata in backup")
+var errNotFound = errors.New("not found")
+
+func parseMeta(meta *json.RawMessage) (cbfsclient.FileMeta, error) {
+	fm := cbfsclient.FileMeta{}
+	if meta == nil {
+		return fm, errNoMeta
+	}
+	err := json.Unmarshal(*meta, &fm)
+	return fm, err
+}
+
+// Find the hash of the file the cluster currently serves at path.
+func clusterOID(ctx context.Context, base, path string) (string, error) {
+	u := cbfstool.ClusterURL(base, path)
+
+	req, err := http.NewRequestWithContext(ctx, "HEAD", u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	res, err := restoreClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	res.Body.Close()
+	switch res.StatusCode {
+	case 200:
+	case 404:
+		return "", errNotFound
+	default:
+		return "", httputil.HTTPErrorf(res, "error checking %v: %S", path)
+	}
+	return strings.Trim(res.Header.Get("Etag"), `"`), nil
+}
+
+// Confirm the cluster serves path with the hash recorded in meta.
+func verifyFile(ctx context.Context, base, path string,
+	meta *json.RawMessage) error {
+
+	fm, err := parseMeta(meta)
+	if err != nil {
+		return err
+	}
+
+	got, err := clusterOID(ctx, base, path)
+	if err != nil {
+		return err
+	}
+	if got != fm.OID {
+		return fmt.Errorf("hash mismatch on %v: backup has %v, cluster has %v",
+			path, fm.OID, got)
+	}
+	return nil
+}
+
+// Log what restoring path would change.  Returns errExists if the
+// cluster already has the backed up version.
+func diffFile(ctx context.Context, base, path string,
+	meta *json.RawMessage) error {
+
+	fm, err := parseMeta(meta)
+	if err != nil {
+		return err
+	}
+
+	got, err := clusterOID(ctx, base, path)
+	switch {
+	case err == errNotFound:
+		logFor(ctx).Printf("new: %v (%v)", path, fm.OID)
+	case err != nil:
+		return err
+	case got == fm.OID:
+		return errExists
+	case *restoreForce:
+		logFor(ctx).Printf("overwrite: %v (%v -> %v)", path, got, fm.OID)
+	default:
+		logFor(ctx).Printf("differs: %v (%v, backup has %v; use -f to overwrite)",
+			path, got, fm.OID)
+	}
+	return nil
+}
+
+// Fetch the metadata the cluster currently has for path.
+func clusterMeta(ctx context.Context, base, path string) (cbfsclient.FileMeta, error) {
+	j := fileInfoDoc{}
+	data, err := fileInfo(ctx, base, path)
+	if err == nil {
+		err = json.Unmarshal(data, &j)
+	}
+	return j.Meta, err
+}
+
+// Fetch the cluster's info document ({"path": ..., "meta": ...}) for
+// path.
+func fileInfo(ctx context.Context, base, path string) ([]byte, error) {
+	u := cbfstool.ClusterURL(base, "/.cbfs/info/file/"+path)
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := restoreClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case 200:
+	case 404:
+		return nil, errNotFound
+	default:
+		return nil, httputil.HTTPErrorf(res, "error checking %v: %S", path)
+	}
+	return ioutil.ReadAll(res.Body)
+}
+
+// Download the file the cluster serves at path and compute its digest
+// with the named algorithm, as a hex string like an OID.
+func contentDigest(ctx context.Context, base, path, alg string) (string, error) {
+	h, err := newDigest(alg)
+	if err != nil {
+		return "", err
+	}
+	u := cbfstool.ClusterURL(base, path)
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	res, err := restoreClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case 200:
+	case 404:
+		return "", errNotFound
+	default:
+		return "", httputil.HTTPErrorf(res, "error fetching %v: %S", path)
+	}
+	if _, err := io.Copy(h, res.Body); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// A difference between a backup and the cluster.
+type discrepancy struct {
+	Path   string `json:"path"`
+	Kind   string `json:"kind"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// Compare the backed up meta for path with what the cluster has, and
+// with alg (when not empty) the digest of its content with the
+// backed up hash.  Returns nil if they agree.
+func checkFile(ctx context.Context, base, path string,
+	meta *json.RawMessage, alg string) *discrepancy {
+
+	want, err := parseMeta(meta)
+	if err != nil {
+		return &discrepancy{path, "error", err.Error()}
+	}
+
+	got, err := clusterMeta(ctx, base, path)
+	switch {
+	case err == errNotFound:
+		return &discrepancy{path, "missing", ""}
+	case err != nil:
+		return &discrepancy{path, "error", err.Error()}
+	case got.OID != want.OID:
+		return &discrepancy{path, "mismatch",
+			fmt.Sprintf("backup has %v, cluster has %v", want.OID, got.OID)}
+	case got.Length != want.Length:
+		return &discrepancy{path, "drift",
+			fmt.Sprintf("length %v in backup, %v in cluster",
+				want.Length, got.Length)}
+	}
+	wct := want.Headers.Get("Content-Type")
+	if gct := got.Headers.Get("Content-Type"); gct != wct {
+		return &discrepancy{path, "drift",
+			fmt.Sprintf("content type %q in backup, %q in cluster", wct, gct)}
+	}
+	if alg == "" {
+		return nil
+	}
+	sum, err := contentDigest(ctx, base, path, alg)
+	switch {
+	case err != nil:
+		return &discrepancy{path, "error", err.Error()}
+	case sum != want.OID:
+		return &discrepancy{path, "corrupt",
+			fmt.Sprintf("backup has %v, content's %v is %v", want.OID, alg, sum)}
+	}
+	return nil
+}
+
+// The document written by verify -report.
+type verifyReport struct {
+	Seen          int64          `json:"seen"`
+	Checked       int64          `json:"checked"`
+	Counts        map[string]int `json:"counts"`
+	Discrepancies []discrepancy  `json:"discrepancies"`
+}
+
+// Check every matching entry of the backup fn against the cluster at
+// ustr.
+func verify(ctx context.Context, ustr, fn string,
+	matches func(string) bool) (*verifyReport, error) {
+
+	key, err := loadBackupKey(*verifyKeyfile)
+	if err != nil {
+		return nil, fmt.Errorf("Error loading backup key: %v", err)
+	}
+	segs, err := backupSegments(fn)
+	if err != nil {
+		return nil, fmt.Errorf("Error finding backup files: %v", err)
+	}
+
+	restoreClient = newHTTPClient(*verifyTimeout, *verifyWorkers,
+		*verifyHTTP2)
+
+	// The content is hashed as the cluster hashes it, unless told
+	// otherwise.
+	alg := ""
+	if *verifyContent {
+		alg = *verifyChecksum
+		if alg == "" {
+			if alg, err = clusterHash(ctx, ustr); err != nil {
+				return nil, fmt.Errorf("Error finding the cluster's hash "+
+					"algorithm: %v", err)
+			}
+		}
+		if _, err := newDigest(alg); err != nil {
+			return nil, fmt.Errorf("Can't check content: %v", err)
+		}
+	}
+
+	rep := &verifyReport{Counts: map[string]int{}}
+	mu := sync.Mutex{}
+	wg := sync.WaitGroup{}
+	ch := make(chan restoreWorkItem, *verifyWorkers)
+	for i := 0; i < *verifyWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ob := range ch {
+				d := checkFile(ctx, ustr, ob.Path, ob.Meta, alg)
+				if d == nil {
+					continue
+				}
+				if !*verifyCompareOnly {
+					log.Printf("%v: %v %v", d.Kind, d.Path, d.Detail)
+				}
+				mu.Lock()
+				rep.Counts[d.Kind]++
+				rep.Discrepancies = append(rep.Discrepancies, *d)
+				mu.Unlock()
+			}
+		}()
+	}
+
+	stats := &restoreStats{}
+	for _, seg := range segs {
+		if err = readBackup(ctx, seg, key, matches, nil, stats, ch); err != nil {
+			break
+		}
+	}
+	close(ch)
+	wg.Wait()
+
+	rep.Seen, rep.Checked = stats.Seen, stats.Matched
+	return rep, err
+}
+
+func verifyCommand(ustr string, args []string) {
+	matches, err := newMatcher(*verifyPat, *verifyExclude)
+	cbfstool.MaybeFatal(err, "Error parsing match pattern: %v", err)
+
+	start := time.Now()
+	rep, err := verify(context.Background(), ustr, verifyFlags.Arg(0), matches)
+	if *verifyCompareOnly {
+		if err == nil && *verifyReportFile != "" {
+			if err = writeReport(*verifyReportFile, rep); err != nil {
+				err = fmt.Errorf("Error writing report: %v", err)
+			}
+		}
+		status, summary := compareSummary(rep, err)
+		fmt.Println(summary)
+		os.Exit(status)
+	}
+	cbfstool.MaybeFatal(err, "%v", err)
+
+	if *verifyReportFile != "" {
+		err := writeReport(*verifyReportFile, rep)
+		cbfstool.MaybeFatal(err, "Error writing report: %v", err)
+	}
+
+	log.Printf("Checked %v of %v files in %v: %v missing, %v mismatched, "+
+		"%v drifted, %v corrupt, %v errors", rep.Checked, rep.Seen,
+		time.Since(start), rep.Counts["missing"], rep.Counts["mismatch"],
+		rep.Counts["drift"], rep.Counts["corrupt"], rep.Counts["error"])
+	if len(rep.Discrepancies) > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	// writeTestBackup records every path with oid abc.
+	cluster := map[string]string{
+		"same":    `{"oid": "abc"}`,
+		"changed": `{"oid": "def"}`,
+		"longer":  `{"oid": "abc", "length": 10}`,
+	}
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			p := strings.TrimPrefix(req.URL.Path, "/.cbfs/info/file/")
+			m, ok := cluster[p]
+			if !ok {
+				http.NotFound(w, req)
+				return
+			}
+			fmt.Fprintf(w, `{"path": %q, "meta": %v}`, p, m)
+		}))
+	defer ts.Close()
+
+	fn := writeTestBackup(t, "same", "changed", "longer", "gone")
+	defer os.Remove(fn)
+
+	rep, err := verify(context.Background(), ts.URL, fn,
+		func(string) bool { return true })
+	if err != nil {
+		t.Fatalf("Error verifying: %v", err)
+	}
+
+	exp := map[string]int{"mismatch": 1, "drift": 1, "missing": 1}
+	if rep.Checked != 4 || fmt.Sprint(rep.Counts) != fmt.Sprint(exp) {
+		t.Errorf("Expected 4 checked with %v, got %v with %v",
+			exp, rep.Checked, rep.Counts)
+	}
+}
+
+func TestVerifyContent(t *testing.T) {
+	sum := func(s string) string {
+		h := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(h[:])
+	}
+	// Each file's content, and the hash the cluster's meta has.
+	files := map[string][2]string{
+		"good":    {"hello", sum("hello")},
+		"corrupt": {"hellO", sum("hello")},
+	}
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			if req.URL.Path == "/.cbfs/config/" {
+				fmt.Fprint(w, `{"hash": "sha256"}`)
+				return
+			}
+			p := strings.TrimPrefix(req.URL.Path, "/.cbfs/info/file/")
+			f, ok := files[strings.TrimPrefix(p, "/")]
+			switch {
+			case !ok:
+				http.NotFound(w, req)
+			case p != req.URL.Path:
+				fmt.Fprintf(w, `{"path": %q, "meta": {"oid": %q}}`, p, f[1])
+			default:
+				fmt.Fprint(w, f[0])
+			}
+		}))
+	defer ts.Close()
+
+	fn := writeJSONBackup(t, "backup.json",
+		fmt.Sprintf(`{"path": "good", "meta": {"oid": %q}}`, sum("hello")),
+		fmt.Sprintf(`{"path": "corrupt", "meta": {"oid": %q}}`, sum("hello")))
+
+	defer func(c bool, a string) {
+		*verifyContent, *verifyChecksum = c, a
+	}(*verifyContent, *verifyChecksum)
+	*verifyContent = true
+
+	all := func(string) bool { return true }
+	rep, err := verify(context.Background(), ts.URL, fn, all)
+	if err != nil {
+		t.Fatalf("Error verifying: %v", err)
+	}
+	if len(rep.Discrepancies) != 1 || rep.Discrepancies[0].Path != "corrupt" ||
+		rep.Discrepancies[0].Kind != "corrupt" {
+		t.Errorf("Expected just the corrupt file reported, got %+v",
+			rep.Discrepancies)
+	}
+
+	// Hashing with the wrong algorithm finds nothing right.
+	*verifyChecksum = "sha1"
+	rep, err = verify(context.Background(), ts.URL, fn, all)
+	if err != nil || rep.Counts["corrupt"] != 2 {
+		t.Errorf("Expected both files corrupt by sha1, got %v (%v)",
+			rep.Counts, err)
+	}
+
+	for alg, exp := range map[string]string{
+		"md4":   `"md4" isn't supported`,
+		"crc32": `unknown hash algorithm "crc32"`,
+	} {
+		*verifyChecksum = alg
+		_, err := verify(context.Background(), ts.URL, fn, all)
+		if err == nil || !strings.Contains(err.Error(), exp) {
+			t.Errorf("Expected %q for %v, got %v", exp, alg, err)
+		}
+	}
+}
+
+// restore -diff logs what would change, and restores nothing.
+func TestRestoreDiff(t *testing.T) {
+	var posts int64
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			switch {
+			case req.Method == "POST":
+				atomic.AddInt64(&posts, 1)
+				w.WriteHeader(201)
+			case req.URL.Path == "/same":
+				w.Header().Set("Etag", `"abc"`)
+			case req.URL.Path == "/changed":
+				w.Header().Set("Etag", `"def"`)
+			default:
+				w.WriteHeader(404)
+			}
+		}))
+	defer ts.Close()
+
+	// writeTestBackup records every path with oid abc.
+	fn := writeTestBackup(t, "same", "changed", "new")
+	defer os.Remove(fn)
+
+	defer func(d, f bool) {
+		*restoreDiff, *restoreForce = d, f
+	}(*restoreDiff, *restoreForce)
+	*restoreDiff = true
+	defer restoreLog.SetOutput(os.Stderr)
+
+	for _, test := range []struct {
+		force   bool
+		changed string
+	}{
+		{false, "differs: changed (def, backup has abc; use -f to overwrite)"},
+		{true, "overwrite: changed (def -> abc)"},
+	} {
+		*restoreForce = test.force
+		buf := &bytes.Buffer{}
+		restoreLog.SetOutput(buf)
+
+		stats, err := restore(context.Background(), context.Background(),
+			ts.URL, fn)
+		if err != nil {
+			t.Fatalf("Error diffing: %v", err)
+		}
+		log := buf.String()
+		for _, exp := range []string{test.changed, "new: new (abc)"} {
+			if !strings.Contains(log, exp) {
+				t.Errorf("Expected %q with -f=%v, got:\n%s", exp, test.force, log)
+			}
+		}
+		if strings.Contains(log, ": same (") {
+			t.Errorf("Expected nothing logged for the unchanged file, got:\n%s",
+				log)
+		}
+		if stats.Skipped != 1 || stats.Failed != 0 {
+			t.Errorf("Expected the unchanged file skipped, got %+v", *stats)
+		}
+	}
+	if n := atomic.LoadInt64(&posts); n != 0 {
+		t.Errorf("Expected nothing restored by -diff, got %v posts", n)
+	}
+}
+
+// restore -verify counts and reports files the cluster serves with
+// another hash once restored, and makes the exit status 1.
+func TestRestoreVerify(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			switch {
+			case req.Method == "POST":
+				w.WriteHeader(201)
+			case req.URL.Path == "/bad":
+				w.Header().Set("Etag", `"def"`)
+			default:
+				w.Header().Set("Etag", `"abc"`)
+			}
+		}))
+	defer ts.Close()
+
+	defer func(v bool, r string) {
+		*restoreVerify, *restoreReportFile = v, r
+	}(*restoreVerify, *restoreReportFile)
+	*restoreVerify = true
+
+	tests := []struct {
+		paths      []string
+		mismatched int64
+		status     int
+	}{
+		{[]string{"a", "bad", "c"}, 1, 1},
+		{[]string{"a", "c"}, 0, 0},
+	}
+	for _, test := range tests {
+		fn := writeTestBackup(t, test.paths...)
+		defer os.Remove(fn)
+		*restoreReportFile = filepath.Join(t.TempDir(), "report.json")
+
+		stats, err := restore(context.Background(), context.Background(),
+			ts.URL, fn)
+		if err != nil {
+			t.Fatalf("Error restoring %v: %v", test.paths, err)
+		}
+		if stats.Mismatched != test.mismatched ||
+			stats.Restored != int64(len(test.paths)) {
+			t.Errorf("Expected %v of %v mismatched, got %+v",
+				test.mismatched, test.paths, *stats)
+		}
+		if got := restoreStatus(stats); got != test.status {
+			t.Errorf("Expected exit status %v restoring %v, got %v",
+				test.status, test.paths, got)
+		}
+
+		b, err := ioutil.ReadFile(*restoreReportFile)
+		if err != nil {
+			t.Fatalf("Error reading report: %v", err)
+		}
+		rep := restoreReport{}
+		if err := json.Unmarshal(b, &rep); err != nil {
+			t.Fatalf("Error parsing report: %v", err)
+		}
+		if rep.Mismatched != test.mismatched ||
+			int64(len(rep.Failures)) != test.mismatched {
+			t.Errorf("Expected %v mismatches reported, got %s",
+				test.mismatched, b)
+		}
+		for _, f := range rep.Failures {
+			if f.Path != "bad" || !strings.Contains(f.Error,
+				"backup has abc, cluster has def") {
+				t.Errorf("Expected bad's mismatch reported, got %+v", f)
+			}
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package cbfstool
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+)
+
+var configFile = flag.String("config", "",
+	"Read the base URL, credentials and command options from this JSON file")
+
+// Settings read from a -config file, e.g.
+//
+//	{
+//	  "url": "https://cbfs.example.com:8484/",
+//	  "auth": "user:pass",
+//	  "flags": {"timeout": "1m", "header": ["X-Team: storage"]},
+//	  "commands": {"restore": {"workers": 16}}
+//	}
+//
+// The base URL given on the command line wins over "url", which wins
+// over $CBFS_URL.  Flags given on the command line win over
+// "commands", which wins over "flags".  Values are strings, numbers
+// or booleans, or lists of them for flags that may be repeated.
+type Config struct {
+	URL string `json:"url"`
+	// user:pass for basic auth, unless the URL has credentials.
+	Auth string `json:"auth"`
+	// Flag values for any command having the flag.
+	Flags map[string]json.RawMessage `json:"flags"`
+	// Flag values for a single command, by command name.
+	Commands map[string]map[string]json.RawMessage `json:"commands"`
+}
+
+// Read the config file fn.  Unknown keys are an error.
+func LoadConfig(fn string) (*Config, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	c := &Config{}
+	d := json.NewDecoder(f)
+	d.DisallowUnknownFields()
+	if err := d.Decode(c); err != nil {
+		return nil, fmt.Errorf("error parsing %v: %v", fn, err)
+	}
+	return c, nil
+}
+
+// Make sure every flag c sets exists: each of Flags on at least one
+// command, and each of Commands on that command.
+func (c *Config) check(commands map[string]Command) error {
+	for _, name := range sortedKeys(c.Flags) {
+		found := false
+		for _, cmd := range commands {
+			found = found || (cmd.Flags != nil && cmd.Flags.Lookup(name) != nil)
+		}
+		if !found {
+			return fmt.Errorf("no command has a -%v flag", name)
+		}
+	}
+	for cname, opts := range c.Commands {
+		cmd, ok := commands[cname]
+		if !ok {
+			return fmt.Errorf("unknown command %q", cname)
+		}
+		for _, name := range sortedKeys(opts) {
+			if cmd.Flags == nil || cmd.Flags.Lookup(name) == nil {
+				return fmt.Errorf("%v has no -%v flag", cname, name)
+			}
+		}
+	}
+	return nil
+}
+
+// Set the flags of command cname from c, leaving alone any given on
+// the command line.
+func (c *Config) apply(cname string, fs *flag.FlagSet) error {
+	given := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+
+	vals := map[string]json.RawMessage{}
+	for name, v := range c.Flags {
+		if fs.Lookup(name) != nil {
+			vals[name] = v
+		}
+	}
+	for name, v := range c.Commands[cname] {
+		vals[name] = v
+	}
+
+	for _, name := range sortedKeys(vals) {
+		if given[name] {
+			continue
+		}
+		strs, err := flagValues(vals[name])
+		if err != nil {
+			return fmt.Errorf("invalid value for -%v: %v", name, err)
+		}
+		for _, s := range strs {
+			if err := fs.Set(name, s); err != nil {
+				return fmt.Errorf("invalid value for -%v: %v", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// The base URL to use, with the config's credentials added if it has
+// none of its own.
+func (c *Config) baseURL(arg string) (string, error) {
+	if arg == "" {
+		arg = c.URL
+	}
+	u := BaseURL(arg)
+	if c.Auth == "" {
+		return u, nil
+	}
+	pu, err := url.Parse(u)
+	if err != nil {
+		return "", err
+	}
+	if pu.User == nil {
+		parts := strings.SplitN(c.Auth, ":", 2)
+		if len(parts) == 2 {
+			pu.User = url.UserPassword(parts[0], parts[1])
+		} else {
+			pu.User = url.User(parts[0])
+		}
+	}
+	return pu.String(), nil
+}
+
+// The flag values in a config value: a string, number or boolean, or
+// a list of them.
+func flagValues(raw json.RawMessage) ([]string, error) {
+	var list []json.RawMessage
+	if bytes.HasPrefix(bytes.TrimSpace(raw), []byte("[")) {
+		if err := json.Unmarshal(raw, &list); err != nil {
+			return nil, err
+		}
+	} else {
+		list = []json.RawMessage{raw}
+	}
+
+	var rv []string
+	for _, v := range list {
+		var x interface{}
+		d := json.NewDecoder(bytes.NewReader(v))
+		d.UseNumber()
+		if err := d.Decode(&x); err != nil {
+			return nil, err
+		}
+		switch x := x.(type) {
+		case string:
+			rv = append(rv, x)
+		case json.Number:
+			rv = append(rv, x.String())
+		case bool:
+			rv = append(rv, fmt.Sprint(x))
+		default:
+			return nil, fmt.Errorf("unsupported value %s", v)
+		}
+	}
+	return rv, nil
+}
+
+func sortedKeys(m map[string]json.RawMessage) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
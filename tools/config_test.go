@@ -0,0 +1,114 @@
+package cbfstool
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	fn := filepath.Join(t.TempDir(), "cbfs.json")
+	if err := ioutil.WriteFile(fn, []byte(content), 0644); err != nil {
+		t.Fatalf("Error writing config: %v", err)
+	}
+	return fn
+}
+
+// A list flag, like cbfsadm's -header.
+type listFlag []string
+
+func (l *listFlag) String() string     { return strings.Join(*l, ",") }
+func (l *listFlag) Set(s string) error { *l = append(*l, s); return nil }
+
+func TestConfigApply(t *testing.T) {
+	c, err := LoadConfig(writeConfig(t, `{
+  "flags": {"timeout": "1m", "workers": 2, "header": ["A: 1", "B: 2"]},
+  "commands": {"restore": {"workers": 16, "f": true}}
+}`))
+	if err != nil {
+		t.Fatalf("Error loading config: %v", err)
+	}
+
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	workers := fs.Int("workers", 4, "")
+	timeout := fs.Duration("timeout", time.Second, "")
+	force := fs.Bool("f", false, "")
+	quiet := fs.Bool("quiet", false, "")
+	hdrs := listFlag{}
+	fs.Var(&hdrs, "header", "")
+	commands := map[string]Command{"restore": {Flags: fs}}
+	if err := c.check(commands); err != nil {
+		t.Fatalf("Error checking config: %v", err)
+	}
+
+	// Given on the command line, so the config doesn't override it.
+	fs.Parse([]string{"-timeout", "5s"})
+	if err := c.apply("restore", fs); err != nil {
+		t.Fatalf("Error applying config: %v", err)
+	}
+	if *workers != 16 || *timeout != 5*time.Second || !*force || *quiet {
+		t.Errorf("Expected 16 workers, 5s timeout, -f and not -quiet, "+
+			"got %v, %v, %v, %v", *workers, *timeout, *force, *quiet)
+	}
+	if strings.Join(hdrs, ",") != "A: 1,B: 2" {
+		t.Errorf("Expected both headers, got %v", hdrs)
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	fs.Int("workers", 4, "")
+	commands := map[string]Command{"restore": {Flags: fs}, "ls": {}}
+
+	tests := map[string]string{
+		"unknown key":     `{"url": "http://x/", "wrokers": 4}`,
+		"unknown flag":    `{"flags": {"wrokers": 4}}`,
+		"unknown command": `{"commands": {"restroe": {"workers": 4}}}`,
+		"command flag":    `{"commands": {"ls": {"workers": 4}}}`,
+	}
+	for name, content := range tests {
+		c, err := LoadConfig(writeConfig(t, content))
+		if err == nil {
+			err = c.check(commands)
+		}
+		if err == nil {
+			t.Errorf("Expected an error for %v", name)
+		}
+	}
+
+	c, err := LoadConfig(writeConfig(t, `{"flags": {"workers": "lots"}}`))
+	if err != nil {
+		t.Fatalf("Error loading config: %v", err)
+	}
+	if err := c.apply("restore", fs); err == nil {
+		t.Errorf("Expected an error setting -workers to lots")
+	}
+}
+
+func TestConfigBaseURL(t *testing.T) {
+	defer os.Setenv("CBFS_URL", os.Getenv("CBFS_URL"))
+	os.Setenv("CBFS_URL", "http://env:8484/")
+
+	tests := []struct {
+		cfg Config
+		arg string
+		exp string
+	}{
+		{Config{}, "", "http://env:8484/"},
+		{Config{URL: "http://cfg:8484/"}, "", "http://cfg:8484/"},
+		{Config{URL: "http://cfg:8484/"}, "http://arg:8484/", "http://arg:8484/"},
+		{Config{URL: "http://cfg:8484/", Auth: "u:p"}, "", "http://u:p@cfg:8484/"},
+		{Config{Auth: "u:p"}, "http://a:b@arg/", "http://a:b@arg/"},
+	}
+	for _, test := range tests {
+		got, err := test.cfg.baseURL(test.arg)
+		if err != nil || got != test.exp {
+			t.Errorf("Expected %v for %+v and %q, got %v (%v)",
+				test.exp, test.cfg, test.arg, got, err)
+		}
+	}
+}
@@ -0,0 +1,374 @@
+package cbfstool
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/couchbaselabs/cbfs/client"
+	"github.com/dustin/httputil"
+)
+
+// ErrExists is returned when restoring a file the cluster already has
+// (and the restore isn't forced).
+var ErrExists = errors.New("file exists")
+
+// ErrUnchanged is returned when the server answers 304 Not Modified:
+// it already has the file just as backed up, so nothing needed
+// restoring.
+var ErrUnchanged = errors.New("file unchanged")
+
+// A failure that may succeed if tried again (network error, 5xx).
+type TempError struct {
+	Err error
+	// How long the server asked us to wait before trying again
+	// (zero for the default backoff).
+	Wait time.Duration
+}
+
+func (e TempError) Error() string { return e.Err.Error() }
+
+// True if err is a TempError.
+func IsTemporary(err error) bool {
+	_, ok := err.(TempError)
+	return ok
+}
+
+// An error status from the server.
+type StatusError struct {
+	Code int
+	Err  error
+}
+
+func (e StatusError) Error() string { return e.Err.Error() }
+
+// The HTTP status of the response behind a Restore error: 409 for
+// ErrExists, 304 for ErrUnchanged, 0 for an error without a response
+// (such as a network error).
+func StatusCode(err error) int {
+	if t, ok := err.(TempError); ok {
+		err = t.Err
+	}
+	if s, ok := err.(StatusError); ok {
+		return s.Code
+	}
+	switch err {
+	case ErrExists:
+		return 409
+	case ErrUnchanged:
+		return 304
+	}
+	return 0
+}
+
+// Expirations below this many seconds are relative, not absolute.
+const MaxRelativeExpiration = 60 * 60 * 24 * 30
+
+// Restores files into a cbfs cluster from their backed up metadata.
+type RestoreClient struct {
+	// The cluster's base URL.
+	Base string
+	// Used for all requests (http.DefaultClient if nil).
+	Client *http.Client
+	// Overwrite files the cluster already has, rather than
+	// returning ErrExists.
+	Force bool
+	// The expiration to request: seconds, an absolute unix time, or
+	// "keep" for the one recorded in the backed up headers.  Empty
+	// means none.
+	Expiration string
+	// If positive, request an expiration this long after each file's
+	// creation, where its backed up meta shows when that was, and
+	// Expiration for the rest.  A time that has already passed is
+	// sent as the current one.
+	ExpireAfterCreation time.Duration
+	// How many times to retry a temporary failure, and the delay
+	// before the first retry (doubling each time).
+	Retries   int
+	RetryBase time.Duration
+	// If set, called with a description of each retry.
+	Logf func(ctx context.Context, format string, args ...interface{})
+	// Send the meta as the "meta" part of a multipart/form-data body,
+	// for servers that stream large metadata, rather than as the
+	// whole body.
+	Multipart bool
+}
+
+// Restore path from its backed up meta.
+func (c *RestoreClient) Restore(path string, meta json.RawMessage) error {
+	return c.RestoreContext(context.Background(), path, meta)
+}
+
+// Restore path from its backed up meta, giving up when ctx is done.
+func (c *RestoreClient) RestoreContext(ctx context.Context, path string,
+	meta json.RawMessage) error {
+
+	delay := c.RetryBase
+	for i := 0; ; i++ {
+		err := c.restoreOnce(ctx, path, meta)
+		if !IsTemporary(err) || i >= c.Retries {
+			return err
+		}
+		wait := delay
+		if w := err.(TempError).Wait; w > 0 {
+			wait = w
+		}
+		if c.Logf != nil {
+			c.Logf(ctx, "Retrying %v in %v: %v", path, wait, err)
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return err
+		}
+		delay *= 2
+	}
+}
+
+// Build the request restoring path from its backed up meta.
+func (c *RestoreClient) NewRequest(ctx context.Context, path string,
+	meta json.RawMessage) (*http.Request, error) {
+
+	body, err := restoreBody(meta)
+	if err != nil {
+		return nil, err
+	}
+	ctype := "application/json"
+	if c.Multipart {
+		body, ctype, err = multipartBody(body)
+		if err != nil {
+			return nil, err
+		}
+	}
+	u, err := ParseClusterURL(c.Base, "/.cbfs/backup/restore/"+path)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", u.String(),
+		bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", ctype)
+	req.Header.Set("X-CBFS-Expiration", c.expiration(meta))
+	return req, nil
+}
+
+func (c *RestoreClient) restoreOnce(ctx context.Context, path string,
+	meta json.RawMessage) error {
+
+	req, err := c.NewRequest(ctx, path, meta)
+	if err != nil {
+		return err
+	}
+
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return TempError{Err: err}
+	}
+
+	defer res.Body.Close()
+	switch {
+	case res.StatusCode == 201:
+		// OK
+	case res.StatusCode == 304:
+		return ErrUnchanged
+	case res.StatusCode == 409 && !c.Force:
+		return ErrExists
+	case res.StatusCode >= 500:
+		err := httputil.HTTPErrorf(res, "restore error on %v - %S\n%B", path)
+		return TempError{Err: StatusError{res.StatusCode, err},
+			Wait: retryAfter(res.Header.Get("Retry-After"))}
+	default:
+		return StatusError{res.StatusCode,
+			httputil.HTTPErrorf(res, "restore error on %v - %S\n%B", path)}
+	}
+
+	return nil
+}
+
+// Find the expiration to request for a restored file.  With
+// Expiration "keep", this is the expiration recorded in the backed up
+// headers.
+func (c *RestoreClient) expiration(meta json.RawMessage) string {
+	if c.ExpireAfterCreation > 0 {
+		if t, ok := created(meta); ok {
+			exp := t.Add(c.ExpireAfterCreation)
+			if now := time.Now(); exp.Before(now) {
+				exp = now
+			}
+			return strconv.FormatInt(exp.Unix(), 10)
+		}
+	}
+
+	switch c.Expiration {
+	case "":
+		return "-1"
+	case "keep":
+	default:
+		return c.Expiration
+	}
+
+	fm := cbfsclient.FileMeta{}
+	if meta == nil || json.Unmarshal(meta, &fm) != nil {
+		return "-1"
+	}
+	exp, err := strconv.Atoi(fm.Headers.Get("X-CBFS-Expiration"))
+	if err != nil || exp <= 0 {
+		return "-1"
+	}
+	if exp < MaxRelativeExpiration {
+		exp = int(fm.Modified.Add(time.Duration(exp) * time.Second).Unix())
+	}
+	return strconv.Itoa(exp)
+}
+
+// When a backed up file was created: the modification time of its
+// first revision (revision 0), if the meta still records it.  The
+// server keeps only so many older revisions, so a long history may not.
+func created(meta json.RawMessage) (time.Time, bool) {
+	fm := cbfsclient.FileMeta{}
+	if meta == nil || json.Unmarshal(meta, &fm) != nil {
+		return time.Time{}, false
+	}
+	t := fm.Modified
+	if fm.Revno != 0 {
+		t = time.Time{}
+		for _, p := range fm.Previous {
+			if p.Revno == 0 {
+				t = p.Modified
+			}
+		}
+	}
+	return t, !t.IsZero()
+}
+
+// Build the meta document to send to the server for a backed up file.
+//
+// The server serves a restored file's Content-Type from its stored
+// headers, looked up by canonical name, and ignores "ctype".  So if
+// the headers don't carry the type as the server expects, fix them up
+// from whatever the backup has.  Anything else is sent as it is,
+// including fields this package doesn't know; it's for the server to
+// decide which of them it keeps.
+func restoreBody(meta json.RawMessage) ([]byte, error) {
+	if meta == nil {
+		return json.Marshal(meta)
+	}
+	if unchangedBody(meta) {
+		return []byte(meta), nil
+	}
+	return fixBody(meta)
+}
+
+// Wrap a restore body as a multipart/form-data one, returning it and
+// its Content-Type.  It has a single part, named "meta", holding the
+// JSON document otherwise sent on its own.
+func multipartBody(meta []byte) ([]byte, string, error) {
+	buf := &bytes.Buffer{}
+	w := multipart.NewWriter(buf)
+	h := textproto.MIMEHeader{}
+	h.Set("Content-Disposition", `form-data; name="meta"`)
+	h.Set("Content-Type", "application/json")
+	part, err := w.CreatePart(h)
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err := part.Write(meta); err != nil {
+		return nil, "", err
+	}
+	if err := w.Close(); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), w.FormDataContentType(), nil
+}
+
+// The body for meta when unchangedBody isn't sure it needs none.
+func fixBody(meta json.RawMessage) ([]byte, error) {
+	doc := map[string]json.RawMessage{}
+	hdrs := http.Header{}
+	ctype := ""
+	if json.Unmarshal(meta, &doc) != nil {
+		return []byte(meta), nil
+	}
+	if h, ok := doc["headers"]; ok && json.Unmarshal(h, &hdrs) != nil {
+		return []byte(meta), nil
+	}
+	if c, ok := doc["ctype"]; ok {
+		json.Unmarshal(c, &ctype)
+	}
+
+	fixed := http.Header{}
+	for k, v := range hdrs {
+		ck := http.CanonicalHeaderKey(k)
+		fixed[ck] = append(fixed[ck], v...)
+	}
+	if fixed.Get("Content-Type") == "" && ctype != "" {
+		fixed.Set("Content-Type", ctype)
+	}
+	if reflect.DeepEqual(fixed, hdrs) || len(fixed) == 0 {
+		return []byte(meta), nil
+	}
+
+	h, err := json.Marshal(fixed)
+	if err != nil {
+		return nil, err
+	}
+	doc["headers"] = h
+	return json.Marshal(doc)
+}
+
+// A quick check, allocating far less than restoreBody's own, that
+// meta needs no fixing up.  False when in any doubt.
+func unchangedBody(meta json.RawMessage) bool {
+	doc := struct {
+		Headers http.Header     `json:"headers"`
+		Ctype   json.RawMessage `json:"ctype"`
+	}{}
+	if json.Unmarshal(meta, &doc) != nil {
+		return false
+	}
+	// Field names match case insensitively, restoreBody's don't.
+	if (doc.Headers != nil && !bytes.Contains(meta, []byte(`"headers"`))) ||
+		(doc.Ctype != nil && !bytes.Contains(meta, []byte(`"ctype"`))) {
+		return false
+	}
+	for k, v := range doc.Headers {
+		if k != http.CanonicalHeaderKey(k) || (v != nil && len(v) == 0) {
+			return false
+		}
+	}
+	ctype := ""
+	json.Unmarshal(doc.Ctype, &ctype)
+	return doc.Headers.Get("Content-Type") != "" || ctype == ""
+}
+
+// Parse a Retry-After header, either a number of seconds or an HTTP
+// date.  Returns zero if there's no usable value.
+func retryAfter(h string) time.Duration {
+	if h == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(h); err == nil {
+		if secs < 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	t, err := http.ParseTime(h)
+	if err != nil || time.Until(t) < 0 {
+		return 0
+	}
+	return time.Until(t)
+}
@@ -0,0 +1,320 @@
+package cbfstool
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRestoreClient(t *testing.T) {
+	var got *http.Request
+	var body string
+	status := 201
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			b, _ := ioutil.ReadAll(req.Body)
+			got, body = req, string(b)
+			w.WriteHeader(status)
+		}))
+	defer ts.Close()
+
+	c := &RestoreClient{Base: ts.URL + "/prefix/"}
+	meta := json.RawMessage(`{"oid": "abc"}`)
+	if err := c.Restore("a b", meta); err != nil {
+		t.Fatalf("Error restoring: %v", err)
+	}
+	if got.Method != "POST" || got.URL.Path != "/prefix/.cbfs/backup/restore/a b" {
+		t.Errorf("Expected POST to the restore path, got %v %v",
+			got.Method, got.URL.Path)
+	}
+	if h := got.Header.Get("X-CBFS-Expiration"); h != "-1" {
+		t.Errorf("Expected no expiration, got %q", h)
+	}
+	if body != string(meta) {
+		t.Errorf("Expected the meta as the body, got %q", body)
+	}
+
+	c.Expiration = "3600"
+	c.Restore("a", meta)
+	if h := got.Header.Get("X-CBFS-Expiration"); h != "3600" {
+		t.Errorf("Expected expiration 3600, got %q", h)
+	}
+
+	status = 409
+	if err := c.Restore("a", meta); err != ErrExists {
+		t.Errorf("Expected ErrExists, got %v", err)
+	}
+	c.Force = true
+	if err := c.Restore("a", meta); err == nil || err == ErrExists {
+		t.Errorf("Expected a conflict error when forced, got %v", err)
+	}
+
+	status = 304
+	if err := c.Restore("a", meta); err != ErrUnchanged || StatusCode(err) != 304 {
+		t.Errorf("Expected ErrUnchanged, got %v", err)
+	}
+}
+
+// A bad base URL is an error from the client, not an exit.
+func TestRestoreClientBadBase(t *testing.T) {
+	c := &RestoreClient{Base: "http://%zz/"}
+	meta := json.RawMessage(`{"oid": "abc"}`)
+	if _, err := c.NewRequest(context.Background(), "a", meta); err == nil {
+		t.Errorf("Expected an error building a request for %v", c.Base)
+	}
+	if err := c.Restore("a", meta); err == nil || IsTemporary(err) {
+		t.Errorf("Expected a permanent error restoring to %v, got %v",
+			c.Base, err)
+	}
+}
+
+// With Multipart, the meta is the one part of a form-data body.
+func TestRestoreClientMultipart(t *testing.T) {
+	var part []byte
+	var partType string
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			r, err := req.MultipartReader()
+			if err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+			p, err := r.NextPart()
+			if err != nil || p.FormName() != "meta" {
+				http.Error(w, "no meta part", 400)
+				return
+			}
+			part, _ = ioutil.ReadAll(p)
+			partType = p.Header.Get("Content-Type")
+			if _, err := r.NextPart(); err != io.EOF {
+				http.Error(w, "more than one part", 400)
+				return
+			}
+			w.WriteHeader(201)
+		}))
+	defer ts.Close()
+
+	c := &RestoreClient{Base: ts.URL, Multipart: true, Retries: 1}
+	meta := json.RawMessage(`{"oid": "abc", "older": []}`)
+	if err := c.Restore("f", meta); err != nil {
+		t.Fatalf("Error restoring: %v", err)
+	}
+	if string(part) != string(meta) || partType != "application/json" {
+		t.Errorf("Expected a JSON meta part of %s, got %q of %s",
+			meta, partType, part)
+	}
+}
+
+func TestRestoreClientRetries(t *testing.T) {
+	calls := 0
+	ts := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			calls++
+			if calls < 3 {
+				http.Error(w, "rebalancing", 503)
+				return
+			}
+			w.WriteHeader(201)
+		}))
+	defer ts.Close()
+
+	c := &RestoreClient{Base: ts.URL, Retries: 1, RetryBase: time.Millisecond}
+	err := c.Restore("f", json.RawMessage(`{}`))
+	if !IsTemporary(err) || calls != 2 {
+		t.Fatalf("Expected a temporary error after 2 calls, got %v after %v",
+			err, calls)
+	}
+	for _, exp := range []string{"f", "503", "rebalancing"} {
+		if !strings.Contains(err.Error(), exp) {
+			t.Errorf("Expected %q in error, got %q", exp, err)
+		}
+	}
+
+	calls, c.Retries = 0, 2
+	if err := c.Restore("f", json.RawMessage(`{}`)); err != nil || calls != 3 {
+		t.Errorf("Expected success on the third call, got %v after %v",
+			err, calls)
+	}
+}
+
+func TestRestoreExpirationKeep(t *testing.T) {
+	c := &RestoreClient{Expiration: "keep"}
+	tests := []struct {
+		meta string
+		exp  string
+	}{
+		{`{}`, "-1"},
+		{`{"headers": {"X-Cbfs-Expiration": ["0"]}}`, "-1"},
+		{`{"headers": {"X-Cbfs-Expiration": ["1999999999"]}}`, "1999999999"},
+		{`{"modified": "2020-01-01T00:00:00Z",
+		   "headers": {"X-Cbfs-Expiration": ["60"]}}`, "1577836860"},
+	}
+	for _, test := range tests {
+		if got := c.expiration(json.RawMessage(test.meta)); got != test.exp {
+			t.Errorf("Expected %v for %v, got %v", test.exp, test.meta, got)
+		}
+	}
+	if got := c.expiration(nil); got != "-1" {
+		t.Errorf("Expected -1 without meta, got %v", got)
+	}
+}
+
+func TestRestoreExpireAfterCreation(t *testing.T) {
+	life := 100 * 365 * 24 * time.Hour
+	c := &RestoreClient{Expiration: "3600", ExpireAfterCreation: life}
+	at := func(s string) string {
+		ts, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			t.Fatalf("Error parsing %v: %v", s, err)
+		}
+		return strconv.FormatInt(ts.Add(life).Unix(), 10)
+	}
+	tests := []struct {
+		meta string
+		exp  string
+	}{
+		{`{"modified": "2020-01-01T00:00:00Z"}`, at("2020-01-01T00:00:00Z")},
+		{`{"modified": "2020-01-01T00:00:00Z", "revno": 2,
+		   "older": [{"modified": "2019-06-01T00:00:00Z", "revno": 0},
+		             {"modified": "2019-09-01T00:00:00Z", "revno": 1}]}`,
+			at("2019-06-01T00:00:00Z")},
+		// The first revision is no longer recorded.
+		{`{"modified": "2020-01-01T00:00:00Z", "revno": 5,
+		   "older": [{"modified": "2019-09-01T00:00:00Z", "revno": 4}]}`,
+			"3600"},
+		{`{}`, "3600"},
+		{`junk`, "3600"},
+	}
+	for _, test := range tests {
+		if got := c.expiration(json.RawMessage(test.meta)); got != test.exp {
+			t.Errorf("Expected %v for %v, got %v", test.exp, test.meta, got)
+		}
+	}
+
+	c.ExpireAfterCreation = time.Hour
+	before := time.Now().Unix()
+	got, err := strconv.ParseInt(c.expiration(
+		json.RawMessage(`{"modified": "2020-01-01T00:00:00Z"}`)), 10, 64)
+	if err != nil || got < before || got > time.Now().Unix() {
+		t.Errorf("Expected a past expiration clamped to now, got %v (%v)",
+			got, err)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		in  string
+		min time.Duration
+		max time.Duration
+	}{
+		{"", 0, 0},
+		{"junk", 0, 0},
+		{"-5", 0, 0},
+		{"120", 2 * time.Minute, 2 * time.Minute},
+		{time.Now().Add(time.Hour).UTC().Format(http.TimeFormat),
+			59 * time.Minute, time.Hour},
+		{"Mon, 02 Jan 2006 15:04:05 GMT", 0, 0},
+	}
+	for _, test := range tests {
+		if got := retryAfter(test.in); got < test.min || got > test.max {
+			t.Errorf("Expected %v-%v for %q, got %v",
+				test.min, test.max, test.in, got)
+		}
+	}
+}
+
+// unchangedBody only skips fixBody where it would change nothing.
+func TestUnchangedBody(t *testing.T) {
+	metas := []string{
+		`{"oid": "abc"}`,
+		`null`,
+		`[1, 2]`,
+		`{"headers": {"Content-Type": ["a/b"]}, "ctype": "c/d"}`,
+		`{"headers": {"content-type": ["a/b"]}}`,
+		`{"headers": {"X-Thing": []}}`,
+		`{"headers": {"X-Thing": null}}`,
+		`{"headers": {"X-Thing": ["1"]}, "ctype": "a/b"}`,
+		`{"headers": {"X-Thing": ["1"]}, "ctype": 5}`,
+		`{"headers": 5, "ctype": "a/b"}`,
+		`{"Headers": {"Content-Type": ["a/b"]}, "ctype": "c/d"}`,
+		`{"oid": "abc", "CTYPE": "a/b"}`,
+	}
+	for _, meta := range metas {
+		if !unchangedBody(json.RawMessage(meta)) {
+			continue
+		}
+		got, err := fixBody(json.RawMessage(meta))
+		if err != nil || string(got) != meta {
+			t.Errorf("Expected %v unchanged, got %s (%v)", meta, got, err)
+		}
+	}
+}
+
+// Fields the client doesn't know about, such as ownership and ACLs
+// from newer servers, are passed on untouched: verbatim when the
+// headers need no fixing, and with every other field's value intact
+// when they do.
+func TestRestoreBodyKeepsFields(t *testing.T) {
+	extra := `"owner": "alice", "acl": [{"user": "bob", "perm": "r"}], ` +
+		`"userdata": {"x": [1, 2.50, "y"]}, "oid": "abc"`
+	meta := json.RawMessage(`{"headers": {"Content-Type": ["text/plain"]}, ` +
+		extra + `}`)
+	body, err := restoreBody(meta)
+	if err != nil || string(body) != string(meta) {
+		t.Errorf("Expected %s verbatim, got %s (%v)", meta, body, err)
+	}
+
+	meta = json.RawMessage(`{"headers": {"content-type": ["text/plain"]}, ` +
+		extra + `}`)
+	body, err = restoreBody(meta)
+	if err != nil {
+		t.Fatalf("Error building body: %v", err)
+	}
+	want, got := map[string]json.RawMessage{}, map[string]json.RawMessage{}
+	if err := json.Unmarshal(meta, &want); err != nil {
+		t.Fatalf("Error parsing %s: %v", meta, err)
+	}
+	if err := json.Unmarshal(body, &got); err != nil {
+		t.Fatalf("Error parsing body %s: %v", body, err)
+	}
+	for k, v := range want {
+		if k == "headers" {
+			continue
+		}
+		var exp bytes.Buffer
+		json.Compact(&exp, v)
+		if string(got[k]) != exp.String() {
+			t.Errorf("Expected %v to be %s, got %s", k, exp.Bytes(), got[k])
+		}
+	}
+	if len(got) != len(want) {
+		t.Errorf("Expected the fields of %s, got %s", meta, body)
+	}
+}
+
+func BenchmarkRestoreBody(b *testing.B) {
+	metas := map[string]json.RawMessage{
+		"canonical": json.RawMessage(`{"oid": "abc", "length": 12,
+			"headers": {"Content-Type": ["text/plain"]}}`),
+		"fixed": json.RawMessage(`{"oid": "abc", "length": 12,
+			"ctype": "text/plain"}`),
+	}
+	for name, meta := range metas {
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := restoreBody(meta); err != nil {
+					b.Fatalf("Error building body: %v", err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package cbfstool
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+var caCertFile = flag.String("cacert", "",
+	"Also trust TLS servers with certificates from this PEM file's CAs")
+var certFile = flag.String("cert", "",
+	"Present this PEM client certificate to TLS servers (needs -key)")
+var keyFile = flag.String("key", "", "The PEM private key for -cert")
+var insecureTLS = flag.Bool("insecure", false,
+	"Don't verify TLS servers' certificates")
+
+var tlsConfig *tls.Config
+
+// The TLS settings from the -cacert, -cert, -key and -insecure flags,
+// or nil for Go's defaults.  ToolMain also installs these in
+// http.DefaultTransport; tools building their own transports should
+// use a Clone of this.
+func TLSConfig() *tls.Config {
+	return tlsConfig
+}
+
+// Build the TLS settings for the given flag values, nil if they're
+// all the defaults.
+func newTLSConfig(caFile, certFile, keyFile string,
+	insecure bool) (*tls.Config, error) {
+
+	if (certFile == "") != (keyFile == "") {
+		return nil, errors.New("-cert and -key must be given together")
+	}
+	if caFile == "" && certFile == "" && !insecure {
+		return nil, nil
+	}
+
+	c := &tls.Config{InsecureSkipVerify: insecure}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %v", caFile)
+		}
+		c.RootCAs = pool
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+	return c, nil
+}
+
+// Set up TLS from the command line flags.
+func setupTLS() error {
+	c, err := newTLSConfig(*caCertFile, *certFile, *keyFile, *insecureTLS)
+	if err != nil || c == nil {
+		return err
+	}
+	tlsConfig = c
+	if t, ok := http.DefaultTransport.(*http.Transport); ok {
+		t.TLSClientConfig = c.Clone()
+	}
+	return nil
+}
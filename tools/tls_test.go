@@ -0,0 +1,124 @@
+package cbfstool
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writePEM(t *testing.T, name, typ string, der []byte) string {
+	fn := filepath.Join(t.TempDir(), name)
+	b := pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der})
+	if err := ioutil.WriteFile(fn, b, 0600); err != nil {
+		t.Fatalf("Error writing %v: %v", fn, err)
+	}
+	return fn
+}
+
+// Make a self-signed client certificate, returning its cert and key
+// files.
+func writeClientCert(t *testing.T) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Error creating certificate: %v", err)
+	}
+	kder, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Error marshaling key: %v", err)
+	}
+	return writePEM(t, "client.pem", "CERTIFICATE", der),
+		writePEM(t, "client.key", "EC PRIVATE KEY", kder)
+}
+
+func tlsGet(c *tls.Config, u string) error {
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: c}}
+	res, err := client.Get(u)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+func TestTLSConfig(t *testing.T) {
+	clientCerts := 0
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			clientCerts = len(req.TLS.PeerCertificates)
+		}))
+	ts.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	ts.StartTLS()
+	defer ts.Close()
+
+	if c, err := newTLSConfig("", "", "", false); c != nil || err != nil {
+		t.Errorf("Expected the defaults without flags, got %v (%v)", c, err)
+	}
+	if err := tlsGet(nil, ts.URL); err == nil {
+		t.Errorf("Expected the test server's certificate to be untrusted")
+	}
+
+	ca := writePEM(t, "ca.pem", "CERTIFICATE", ts.Certificate().Raw)
+	c, err := newTLSConfig(ca, "", "", false)
+	if err != nil {
+		t.Fatalf("Error with -cacert: %v", err)
+	}
+	if err := tlsGet(c, ts.URL); err != nil {
+		t.Errorf("Expected -cacert to trust the server, got %v", err)
+	}
+
+	c, err = newTLSConfig("", "", "", true)
+	if err != nil {
+		t.Fatalf("Error with -insecure: %v", err)
+	}
+	if err := tlsGet(c, ts.URL); err != nil {
+		t.Errorf("Expected -insecure to connect, got %v", err)
+	}
+
+	cert, key := writeClientCert(t)
+	c, err = newTLSConfig(ca, cert, key, false)
+	if err != nil {
+		t.Fatalf("Error with -cert and -key: %v", err)
+	}
+	if err := tlsGet(c, ts.URL); err != nil || clientCerts != 1 {
+		t.Errorf("Expected the client certificate sent, got %v certs (%v)",
+			clientCerts, err)
+	}
+
+	bad := []struct {
+		ca, cert, key string
+		err           string
+	}{
+		{"", cert, "", "must be given together"},
+		{"", "", key, "must be given together"},
+		{key, "", "", "no certificates found"},
+		{filepath.Join(t.TempDir(), "missing.pem"), "", "", "no such file"},
+		{"", key, cert, ""},
+	}
+	for _, test := range bad {
+		_, err := newTLSConfig(test.ca, test.cert, test.key, false)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("Expected %q for %+v, got %v", test.err, test, err)
+		}
+	}
+}
@@ -19,6 +19,10 @@ import (
 	"github.com/dustin/httputil"
 )
 
+// The base URL used when none is given on the command line or in the
+// CBFS_URL environment variable.
+const DefaultURL = "http://localhost:8484/"
+
 func init() {
 	rand.Seed(time.Now().UnixNano())
 }
@@ -42,8 +46,13 @@ func (c Command) Usage(name string) {
 func setUsage(commands map[string]Command) {
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr,
-			"Usage:\n  %s [http://cbfs:8484/] cmd [-opts] cmdargs\n",
-			os.Args[0])
+			"Usage:\n  %s [-opts] [%s] cmd [-opts] cmdargs\n",
+			os.Args[0], DefaultURL)
+		fmt.Fprintf(os.Stderr,
+			"\nThe URL defaults to the -config file's, then $CBFS_URL if set.\n")
+
+		fmt.Fprintf(os.Stderr, "\nOptions:\n")
+		flag.PrintDefaults()
 
 		fmt.Fprintf(os.Stderr, "\nCommands:\n")
 
@@ -56,6 +65,7 @@ func setUsage(commands map[string]Command) {
 		for _, k := range ss {
 			fmt.Fprintf(os.Stderr, "  %s %s\n", k, commands[k].Argstr)
 		}
+		fmt.Fprintf(os.Stderr, "  version\n")
 
 		fmt.Fprintf(os.Stderr, "\n---- Subcommand Options ----\n")
 
@@ -122,12 +132,53 @@ func Verbose(v bool, f string, a ...interface{}) {
 	}
 }
 
+// Parse a cbfs URL.  Both http and https are supported, and any
+// user:pass@ credentials are kept so requests made to the URL (or
+// URLs derived from it) are sent with basic auth.
 func ParseURL(ustr string) *url.URL {
 	u, err := url.Parse(ustr)
 	MaybeFatal(err, "Error parsing URL: %v", err)
 	return u
 }
 
+// Build the URL of path p (such as "/.cbfs/info/file/x") on the
+// cluster at base.  Any path in base is kept as a prefix, so a
+// cluster mounted under a subpath by a reverse proxy is addressed
+// correctly.  Exits if base can't be parsed; see ParseClusterURL.
+func ClusterURL(base, p string) *url.URL {
+	u, err := ParseClusterURL(base, p)
+	MaybeFatal(err, "Error parsing URL: %v", err)
+	return u
+}
+
+// Like ClusterURL, but returning the error parsing base, for code
+// that mustn't exit the process.
+func ParseClusterURL(base, p string) (*url.URL, error) {
+	u, err := url.Parse(base)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = strings.TrimRight(u.Path, "/") + "/" + strings.TrimLeft(p, "/")
+	u.RawPath = ""
+	return u, nil
+}
+
+// Pick the cbfs base URL.  An explicit argument wins, followed by the
+// CBFS_URL environment variable, and finally DefaultURL.
+func BaseURL(arg string) string {
+	if arg != "" {
+		return arg
+	}
+	if env := os.Getenv("CBFS_URL"); env != "" {
+		return env
+	}
+	return DefaultURL
+}
+
+func isBaseURL(s string) bool {
+	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")
+}
+
 func ToolMain(commands map[string]Command) {
 	log.SetFlags(log.Lmicroseconds)
 
@@ -135,17 +186,36 @@ func ToolMain(commands map[string]Command) {
 
 	flag.Parse()
 
+	if versionRequested(flag.Args()) {
+		fmt.Println(VersionString(os.Args[0]))
+		return
+	}
+
 	if flag.NArg() < 1 {
 		flag.Usage()
 	}
 
+	err := setupTLS()
+	MaybeFatal(err, "Error setting up TLS: %v", err)
+
+	cfg := &Config{}
+	if *configFile != "" {
+		var err error
+		cfg, err = LoadConfig(*configFile)
+		MaybeFatal(err, "Error reading config: %v", err)
+		err = cfg.check(commands)
+		MaybeFatal(err, "Error in config %v: %v", *configFile, err)
+	}
+
 	off := 0
-	u := "http://cbfs:8484/"
+	arg := ""
 
-	if strings.HasPrefix(flag.Arg(0), "http://") {
-		u = flag.Arg(0)
+	if isBaseURL(flag.Arg(0)) {
+		arg = flag.Arg(0)
 		off++
 	}
+	u, err := cfg.baseURL(arg)
+	MaybeFatal(err, "Error parsing URL: %v", err)
 
 	cmdName := flag.Arg(off)
 	cmd, ok := commands[cmdName]
@@ -159,6 +229,8 @@ func ToolMain(commands map[string]Command) {
 	if cmd.Flags != nil {
 		cmd.Flags.Parse(args)
 		nargs = cmd.Flags.NArg()
+		err := cfg.apply(cmdName, cmd.Flags)
+		MaybeFatal(err, "Error in config %v: %v", *configFile, err)
 	}
 
 	if cmd.Nargs == 0 {
@@ -0,0 +1,70 @@
+package cbfstool
+
+import (
+	"flag"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strings"
+)
+
+var showVersion = flag.Bool("version", false,
+	"Print the build's version and exit (as does the version command)")
+
+// The version and commit of a build, set with
+//
+//	go build -ldflags "-X github.com/couchbaselabs/cbfs/tools.Version=v1.2 \
+//		-X github.com/couchbaselabs/cbfs/tools.Commit=$(git rev-parse HEAD)"
+//
+// When empty, they're taken from the build info Go embeds, where it
+// has them.
+var Version, Commit string
+
+// Describe the running build of the tool named name, in one line.
+func VersionString(name string) string {
+	bi, _ := debug.ReadBuildInfo()
+	return formatVersion(name, bi)
+}
+
+func formatVersion(name string, bi *debug.BuildInfo) string {
+	version, commit, modified := Version, Commit, false
+	if bi != nil {
+		if version == "" && bi.Main.Version != "" && bi.Main.Version != "(devel)" {
+			version = bi.Main.Version
+		}
+		for _, s := range bi.Settings {
+			switch {
+			case s.Key == "vcs.revision" && commit == "":
+				commit = s.Value
+			case s.Key == "vcs.modified":
+				modified = s.Value == "true"
+			}
+		}
+	}
+	if version == "" {
+		version = "unknown"
+	}
+
+	parts := []string{strings.TrimSuffix(filepath.Base(name), ".exe"),
+		"version", version}
+	if commit != "" {
+		if modified {
+			commit += " (modified)"
+		}
+		parts = append(parts, "commit", commit)
+	}
+	parts = append(parts, runtime.Version(), runtime.GOOS+"/"+runtime.GOARCH)
+	return strings.Join(parts, " ")
+}
+
+// True if the command line asks for the version, with -version or the
+// version command (with or without a URL before it).
+func versionRequested(args []string) bool {
+	if *showVersion {
+		return true
+	}
+	if len(args) > 0 && isBaseURL(args[0]) {
+		args = args[1:]
+	}
+	return len(args) > 0 && args[0] == "version"
+}
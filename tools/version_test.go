@@ -0,0 +1,62 @@
+package cbfstool
+
+import (
+	"runtime"
+	"runtime/debug"
+	"testing"
+)
+
+func TestFormatVersion(t *testing.T) {
+	bi := &debug.BuildInfo{
+		Main: debug.Module{Version: "v0.3.1"},
+		Settings: []debug.BuildSetting{
+			{Key: "vcs.revision", Value: "abc123"},
+			{Key: "vcs.modified", Value: "true"},
+		},
+	}
+	suffix := " " + runtime.Version() + " " + runtime.GOOS + "/" + runtime.GOARCH
+
+	tests := []struct {
+		version, commit string
+		bi              *debug.BuildInfo
+		exp             string
+	}{
+		{"", "", nil, "cbfsadm version unknown"},
+		{"", "", &debug.BuildInfo{Main: debug.Module{Version: "(devel)"}},
+			"cbfsadm version unknown"},
+		{"", "", bi, "cbfsadm version v0.3.1 commit abc123 (modified)"},
+		{"v1.0", "def456", bi, "cbfsadm version v1.0 commit def456 (modified)"},
+		{"v1.0", "def456", nil, "cbfsadm version v1.0 commit def456"},
+	}
+	defer func(v, c string) { Version, Commit = v, c }(Version, Commit)
+	for _, test := range tests {
+		Version, Commit = test.version, test.commit
+		got := formatVersion("/usr/local/bin/cbfsadm", test.bi)
+		if got != test.exp+suffix {
+			t.Errorf("Expected %q, got %q", test.exp+suffix, got)
+		}
+	}
+}
+
+func TestVersionRequested(t *testing.T) {
+	tests := []struct {
+		args []string
+		exp  bool
+	}{
+		{nil, false},
+		{[]string{"version"}, true},
+		{[]string{"http://host:8484/", "version"}, true},
+		{[]string{"restore", "version"}, false},
+		{[]string{"http://host:8484/", "restore", "version"}, false},
+	}
+	for _, test := range tests {
+		if got := versionRequested(test.args); got != test.exp {
+			t.Errorf("Expected %v for %v, got %v", test.exp, test.args, got)
+		}
+	}
+	defer func(v bool) { *showVersion = v }(*showVersion)
+	*showVersion = true
+	if !versionRequested([]string{"restore"}) {
+		t.Errorf("Expected -version to win")
+	}
+}